@@ -0,0 +1,116 @@
+package aliyun
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// Commands sent through Cloud Assistant, the agent preinstalled on official
+// images. Unlike SSH it needs neither a public IP nor credentials.
+
+var (
+	ErrCommandFailed = errors.New("cloud assistant command failed")
+)
+
+type CommandResult struct {
+	InvokeId string
+	Status   string
+	ExitCode int64
+	Output   string
+	Started  string
+	Finished string
+}
+
+func (r *CommandResult) finished() bool {
+	switch r.Status {
+	case "Finished", "Failed", "Stopped", "PartialFailed":
+		return true
+	}
+	return false
+}
+
+// RunShellCommand runs script on the instance through Cloud Assistant and
+// waits for it to finish.
+func (c *EcsClient) RunShellCommand(ctx context.Context, instanceId, script string, timeout time.Duration) (*CommandResult, error) {
+	req := ecs.CreateRunCommandRequest()
+	req.RegionId = string(c.region)
+	req.Type = "RunShellScript"
+	req.CommandContent = base64.StdEncoding.EncodeToString([]byte(script))
+	req.ContentEncoding = "Base64"
+	req.Timeout = requests.NewInteger(int(timeout.Seconds()))
+	req.InstanceId = &[]string{instanceId}
+
+	c.log.With(F("op", "run-command"), F("instance", instanceId)).Debug("calling RunCommand")
+	var resp *ecs.RunCommandResponse
+	err := c.api.call(ctx, "RunCommand", func() (err error) {
+		resp, err = c.ecs.RunCommand(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := DefaultWaiter
+	w.Timeout = timeout + time.Minute
+	var r *CommandResult
+	err = w.WaitFor(ctx, "command "+resp.InvokeId, func(ctx context.Context) (bool, error) {
+		res, err := c.describeInvocationResult(ctx, instanceId, resp.InvokeId)
+		if err != nil {
+			return false, err
+		}
+		if res == nil {
+			return false, nil
+		}
+		RecordState(ctx, res.Status)
+		r = res
+		return res.finished(), nil
+	})
+	if err != nil {
+		return r, err
+	}
+	if r.Status != "Finished" || r.ExitCode != 0 {
+		return r, fmt.Errorf("%w: %s, exit code %d", ErrCommandFailed, r.Status, r.ExitCode)
+	}
+	return r, nil
+}
+
+func (c *EcsClient) describeInvocationResult(ctx context.Context, instanceId, invokeId string) (*CommandResult, error) {
+	req := ecs.CreateDescribeInvocationResultsRequest()
+	req.RegionId = string(c.region)
+	req.InvokeId = invokeId
+	req.InstanceId = instanceId
+
+	var resp *ecs.DescribeInvocationResultsResponse
+	err := c.api.call(ctx, "DescribeInvocationResults", func() (err error) {
+		resp, err = c.ecs.DescribeInvocationResults(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range resp.Invocation.InvocationResults.InvocationResult {
+		if res.InstanceId != instanceId {
+			continue
+		}
+		out, err := base64.StdEncoding.DecodeString(res.Output)
+		if err != nil {
+			out = []byte(res.Output)
+		}
+		return &CommandResult{
+			InvokeId: res.InvokeId,
+			Status:   res.InvokeRecordStatus,
+			ExitCode: res.ExitCode,
+			Output:   string(out),
+			Started:  res.StartTime,
+			Finished: res.FinishedTime,
+		}, nil
+	}
+	return nil, nil
+}
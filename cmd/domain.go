@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/iamjinlei/aliecs"
@@ -11,8 +13,19 @@ import (
 func main() {
 	op := flag.String("op", "list", "list, check")
 	domain := flag.String("domain", "", "domain name")
+	feeCmds := flag.String("fee", "create", "comma separated fee commands: create, renew, transfer, restore")
+	currencies := flag.String("currency", "CNY", "comma separated fee currencies: CNY, USD")
+	periods := flag.String("period", "1", "comma separated fee periods in years")
+	logFlags := aliyun.RegisterLogFlags(flag.CommandLine)
 	flag.Parse()
 
+	logCloser, err := logFlags.Setup()
+	if err != nil {
+		aliyun.Error("error setting up logging: %v", err)
+		return
+	}
+	defer logCloser.Close()
+
 	cfg, err := aliyun.NewEcsConfig()
 	if err != nil {
 		aliyun.Error("error creating config: %v", err)
@@ -25,19 +38,21 @@ func main() {
 		return
 	}
 
-	statusMap := map[int]string{
-		1:  "可注册",
-		3:  "预登记",
-		4:  "可删除预订",
-		0:  "不可注册",
-		-1: "异常",
-		-2: "暂停注册",
-		-3: "黑名单",
+	ctx := context.Background()
+
+	statusMap := map[aliyun.DomainStatus]string{
+		aliyun.DomainAvailable:       "可注册",
+		aliyun.DomainPreRegistration: "预登记",
+		aliyun.DomainPendingDelete:   "可删除预订",
+		aliyun.DomainUnavailable:     "不可注册",
+		aliyun.DomainAbnormal:        "异常",
+		aliyun.DomainSuspended:       "暂停注册",
+		aliyun.DomainBlacklisted:     "黑名单",
 	}
 
 	switch *op {
 	case "list":
-		domains, err := c.ListDomains()
+		domains, err := c.ListDomains(ctx)
 		if err != nil {
 			aliyun.Error("error listing domains: %v", err)
 			return
@@ -57,16 +72,56 @@ func main() {
 		aliyun.Text(strings.Join(lines, "\n"))
 
 	case "check":
-		name, status, reason, price, err := c.CheckDomain(*domain)
+		opts := &aliyun.DomainCheckOptions{}
+		for _, v := range splitList(*feeCmds) {
+			opts.Commands = append(opts.Commands, aliyun.FeeCommand(v))
+		}
+		for _, v := range splitList(*currencies) {
+			opts.Currencies = append(opts.Currencies, aliyun.Currency(strings.ToUpper(v)))
+		}
+		for _, v := range splitList(*periods) {
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				aliyun.Error("invalid fee period %q: %v", v, err)
+				return
+			}
+			opts.Periods = append(opts.Periods, p)
+		}
+
+		r, err := c.CheckDomain(ctx, *domain, opts)
 		if err != nil {
-			aliyun.Error("error listing domains: %v", err)
+			aliyun.Error("error checking domain: %v", err)
 			return
 		}
 
+		reason := r.Reason
 		if len(reason) == 0 {
 			reason = "-"
 		}
 
-		aliyun.Text("Domain = %v, Status = %v / %v, Price = %v", name, statusMap[status], reason, price)
+		aliyun.Text("Domain = %v, Status = %v / %v, Premium = %v", r.DomainName, statusMap[r.Status], reason, r.Premium)
+
+		schema := "| %-8s | %-8s | %-6s | %-12s |"
+		rowSeparator := "+----------+----------+--------+--------------+"
+		lines := []string{
+			rowSeparator,
+			fmt.Sprintf(schema, "Command", "Currency", "Period", "Price"),
+			rowSeparator,
+		}
+		for _, p := range r.Prices {
+			lines = append(lines, fmt.Sprintf(schema, p.Command, p.Currency, fmt.Sprintf("%v", p.Period), fmt.Sprintf("%v", p.Amount)))
+		}
+		lines = append(lines, rowSeparator)
+		aliyun.Text(strings.Join(lines, "\n"))
+	}
+}
+
+func splitList(s string) []string {
+	var r []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			r = append(r, v)
+		}
 	}
+	return r
 }
@@ -1,24 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
 
 	"github.com/iamjinlei/aliecs"
-	"github.com/iamjinlei/gossh"
 )
 
-const (
-	loopInterval = 500 * time.Millisecond
+var (
+	errInstanceNotExist = errors.New("instance does NOT exist")
 )
 
-func acquireInstanceByIp(c *aliyun.EcsClient, region, ip string) (*ecs.Instance, error) {
-	instances, err := c.DescribeInstances(aliyun.RegionId(region), ip)
+// exitCode is the status main exits with once it has cleaned up.
+var exitCode = 0
+
+// plan collects skipped changes with -dry-run, nil otherwise. Commands run
+// over SSH are always simulated as there is no telling what they'd change.
+var plan *aliyun.Plan
+
+func acquireInstanceByIp(ctx context.Context, c *aliyun.EcsClient, region, ip string) (*ecs.Instance, error) {
+	instances, err := c.DescribeInstances(ctx, aliyun.RegionId(region), ip)
 	if err != nil {
 		return nil, err
 	}
@@ -34,18 +50,14 @@ func acquireInstanceByIp(c *aliyun.EcsClient, region, ip string) (*ecs.Instance,
 	return &instances[0], nil
 }
 
-func acquireInstanceByName(c *aliyun.EcsClient, region, name string) (*ecs.Instance, error) {
-	instances, err := c.DescribeInstances(aliyun.RegionId(region), "")
+func acquireInstanceById(ctx context.Context, c *aliyun.EcsClient, region, id string) (*ecs.Instance, error) {
+	instances, err := c.DescribeInstances(ctx, aliyun.RegionId(region), "")
 	if err != nil {
 		return nil, err
 	}
 
-	if len(instances) == 0 {
-		return nil, nil
-	}
-
 	for _, ins := range instances {
-		if ins.InstanceName == name {
+		if ins.InstanceId == id {
 			return &ins, nil
 		}
 	}
@@ -71,21 +83,97 @@ func (s instanceList) Less(i, j int) bool {
 }
 
 func main() {
-	op := flag.String("op", "up", "up, down, del, desc, run, reboot")
+	op := flag.String("op", "up", "up, down, del, desc, run, reboot, cloud-init, recipes, push, pull, exec, refresh, gc, plan, apply, spot-prices, watch, bake, image, snapshot, disk, resize, schedule, tick, daemon, top, stats, console")
 	idx := flag.Int("idx", 0, "idx")
+	provisionTimeout := flag.Duration("provision-timeout", 30*time.Minute, "give up waiting for cloud-init provisioning after this long")
+	logLines := flag.Int("lines", 50, "number of cloud-init log or console output lines to fetch")
+	recipes := flag.String("recipe", "", "comma separated recipes for run, instead of the profile's")
+	set := kvFlag{}
+	flag.Var(set, "set", "recipe parameter as key=value or recipe.key=value, repeatable")
+	recursive := flag.Bool("r", false, "push/pull: copy directories recursively")
+	resume := flag.Bool("resume", true, "push/pull: resume interrupted transfers")
+	delta := flag.Bool("delta", false, "push/pull: skip files that are already identical")
+	stepTimeout := flag.Duration("step-timeout", 30*time.Minute, "up/run/apply: kill a provisioning step after this long, 0 for no limit")
+	onError := flag.String("on-error", "stop", "up/run/apply: stop or continue when a provisioning step fails")
+	execTimeout := flag.Duration("exec-timeout", 0, "exec: kill the command on a host after this long, 0 for no limit")
+	parallel := flag.Int("parallel", 10, "exec/apply: number of hosts or changes to work on at once")
+	fleetFile := flag.String("fleet", "fleet.json", "plan/apply: fleet definition file")
+	jsonOut := flag.Bool("json", false, "exec: print results as JSON instead of streaming output")
+	dryRun := flag.Bool("dry-run", false, "show what would be changed without changing anything")
+	yes := flag.Bool("yes", false, "gc/apply/image prune: go ahead without asking for confirmation")
+	cheapestZone := flag.Bool("cheapest-zone", false, "up/watch: create spot instances in the region's zone with the lowest spot price")
+	replace := flag.Bool("replace", false, "watch: re-create a reclaimed spot instance from its latest image or snapshot")
+	imageName := flag.String("name", "", "bake: catalog image name, a new version is added if it exists")
+	snapshot := flag.Bool("snapshot", false, "del: snapshot the instance's disks before deleting it")
+	fromSnapshot := flag.String("from-snapshot", "", "up: create the instance with its disks restored from a snapshot set, latest or a snapshot or set id")
+	keep := flag.Int("keep", 3, "image prune: number of versions to keep in each region")
+	watchInterval := flag.Duration("interval", 30*time.Second, "watch: how often to check for a spot reclaim notice")
+	force := flag.Bool("force", false, "down/del: stop the instance at once rather than shutting it down gracefully")
+	stoppedMode := flag.String("stopped-mode", "", "down: KeepCharging or StopCharging, overrides ECS_STOPPED_MODE")
+	screenshot := flag.String("screenshot", "", "console: where to save the screenshot, <name>-<time>.jpg by default")
+	since := flag.Duration("since", time.Hour, "stats: how far back to chart the metrics")
+	creditWarn := flag.Float64("credit-warn", 20, "top/stats: warn when a burstable instance has fewer CPU credits left, or will run out within an hour; 0 to turn off")
+	newType := flag.String("type", "", "resize: new instance type, the instance is stopped and started again")
+	bandwidthOut := flag.Int("bandwidth-out", 0, "resize: new outbound bandwidth in Mbps")
+	diskSize := flag.Int("disk-size", 0, "resize: grow a disk and its file system to this many GB")
+	creditMode := flag.String("credit-mode", "", "resize: Standard or Unlimited for burstable instances")
+	diskName := flag.String("disk", "", "resize: data disk to grow by name or id, the system disk if empty")
+	selFlag := flag.String("sel", "", "instance selector: name, name glob, instance ID or tag:key=value; overrides idx")
+	timeout := flag.Duration("timeout", 10*time.Minute, "give up waiting for an instance state change after this long")
+	logFlags := aliyun.RegisterLogFlags(flag.CommandLine)
 	flag.Parse()
 
+	// deferred first so it runs after every other deferred cleanup
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	logCloser, err := logFlags.Setup()
+	if err != nil {
+		aliyun.Error("error setting up logging: %v", err)
+		return
+	}
+	defer logCloser.Close()
+
 	cfg, err := aliyun.NewEcsConfig()
 	if err != nil {
 		aliyun.Error("error creating config: %v", err)
 		return
 	}
 
+	cfg.DryRun = *dryRun
+
 	c, err := aliyun.NewEcsClient(cfg)
 	if err != nil {
 		aliyun.Error("error creating ecs client: %v", err)
 		return
 	}
+
+	state, err := aliyun.LoadState(aliyun.StatePath())
+	if err != nil {
+		aliyun.Error("error loading state: %v", err)
+		return
+	}
+	c.UseState(state)
+	if c.DryRun() {
+		plan = c.Plan()
+		defer printPlan(plan)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleInterrupt(cancel)
+
+	if *onError != "stop" && *onError != "continue" {
+		aliyun.Error("-on-error must be stop or continue, got %q", *onError)
+		return
+	}
+	stepOpts := aliyun.StepOptions{ContinueOnError: *onError == "continue", Timeout: *stepTimeout}
+
+	waiter := aliyun.DefaultWaiter
+	waiter.Timeout = *timeout
 	//c.DescribeZones(ecs.RegionHk, ecs.PostPaid)
 
 	regions := map[aliyun.RegionId]bool{}
@@ -94,7 +182,7 @@ func main() {
 	}
 	instances := []ecs.Instance{}
 	for r, _ := range regions {
-		results, err := c.DescribeInstances(r, "")
+		results, err := c.DescribeInstances(ctx, r, "")
 		if err != nil {
 			aliyun.Error("error describe region %v: %v", r, err)
 			return
@@ -111,9 +199,7 @@ func main() {
 		rowSeparator,
 	}
 
-	ip := ""
-	region := ""
-	name := ""
+	var target *ecs.Instance
 	if len(instances) == 0 {
 		lines = append(lines, fmt.Sprintf(schema, "", "", "", "", "", "", "", ""))
 		lines = append(lines, rowSeparator)
@@ -127,236 +213,2180 @@ func main() {
 			lines = append(lines, rowSeparator)
 		}
 		if *idx < len(instances) {
-			targetIns := &instances[*idx]
-			if len(targetIns.PublicIpAddress.IpAddress) > 0 {
-				ip = targetIns.PublicIpAddress.IpAddress[0]
-			}
-			region = targetIns.RegionId
-			name = targetIns.InstanceName
+			target = &instances[*idx]
 		}
 	}
-	aliyun.Text(strings.Join(lines, "\n"))
+	if !*jsonOut {
+		aliyun.Text(strings.Join(lines, "\n"))
+	}
+
+	var sel aliyun.Selector
+	if *selFlag != "" {
+		if sel, err = aliyun.ParseSelector(*selFlag); err != nil {
+			aliyun.Error("error parsing selector %q: %v", *selFlag, err)
+			return
+		}
+		// exec is the one op that takes many instances
+		if *op == "exec" {
+			target = nil
+		} else if target, err = sel.One(instances); err != nil {
+			aliyun.Error("%v", err)
+			return
+		}
+	}
+
+	ip := ""
+	region := ""
+	id := ""
+	name := ""
+	if target != nil {
+		if len(target.PublicIpAddress.IpAddress) > 0 {
+			ip = target.PublicIpAddress.IpAddress[0]
+		}
+		region = target.RegionId
+		id = target.InstanceId
+		name = target.InstanceName
+	}
+
+	book, err := aliyun.LoadRecipeBook()
+	if err != nil {
+		aliyun.Error("error loading recipes: %v", err)
+		return
+	}
+
+	prog := aliyun.NewProgress(os.Stderr)
+	defer prog.Stop()
 
 	switch *op {
 	case "desc":
-	case "up":
-		instanceIp, isCreated := up(c, cfg)
-		if isCreated {
-			if err := runCmds(instanceIp, cfg.RootPwd, cfg.InitCmds); err != nil {
-				aliyun.Error("error initializing instance environment: %v", err)
+		for _, ins := range instances {
+			if ins.Status == string(aliyun.Stopped) {
+				aliyun.Info("%s is stopped, %s", ins.InstanceName, chargingNote(&ins))
+			}
+			burstable, err := c.Burstable(ctx, aliyun.InstanceType(ins.InstanceType))
+			if err != nil {
+				aliyun.Error("error looking up instance type %s: %v", ins.InstanceType, err)
+				exitCode = 1
+				break
 			}
+			if burstable {
+				aliyun.Info("%s is burstable, credit mode %s", ins.InstanceName, ins.CreditSpecification)
+			}
+		}
+	case "up":
+		if *selFlag == "" {
+			// up never picks an instance by index, it converges on a name
+			sel, _ = aliyun.ParseSelector(cfg.InstanceName)
+		}
+		// render before anything is created so a missing parameter fails fast
+		if c.FindImage(cfg.Derived.Region, cfg.Image) != nil {
+			aliyun.Info("%s is a baked image, skipping recipes", cfg.Image)
+		} else if cfg.InitCmds, err = cfg.ProvisionCmds(book, set); err != nil {
+			aliyun.Error("error rendering recipes: %v", err)
+			exitCode = 1
+			return
+		}
+		if *cheapestZone && !pickSpotZone(ctx, c, cfg) {
+			exitCode = 1
+			return
+		}
+		createOpts := aliyun.CreateOptions{}
+		if *fromSnapshot != "" && !restore(ctx, c, cfg, instances, sel, *fromSnapshot, &createOpts) {
+			exitCode = 1
+			return
+		}
+		ins, isCreated, err := up(ctx, c, cfg, sel, createOpts, waiter, prog)
+		if err != nil {
+			exitCode = 1
+			return
+		}
+		if ins != nil && provision(ctx, c, cfg, ins, isCreated, waiter, *provisionTimeout, stepOpts, prog) != nil {
+			exitCode = 1
 		}
 	case "reboot":
 		if name == "" {
 			aliyun.Error("no instance is running")
 			return
 		}
-		reboot(c, region, name)
+		if reboot(ctx, c, region, id, name, waiter, prog) != nil {
+			exitCode = 1
+		}
 	case "down":
 		if name == "" {
 			aliyun.Error("no instance is running")
 			return
 		}
-		down(c, region, name)
+		if *stoppedMode != "" {
+			cfg.StoppedMode = aliyun.StoppedMode(*stoppedMode)
+			if err := cfg.StoppedMode.Validate(aliyun.InstanceChargeType(target.InstanceChargeType)); err != nil {
+				aliyun.Error("%v", err)
+				exitCode = 1
+				return
+			}
+		}
+		if err := down(ctx, c, region, id, name, *force, waiter, prog); err == nil {
+			msg := "instance is stopped"
+			if ins, err := c.DescribeInstance(ctx, id); err == nil && ins != nil {
+				msg += ", " + chargingNote(ins)
+			}
+			prog.Task(name).Done("%s", msg)
+		} else if !errors.Is(err, aliyun.ErrDryRunOperation) {
+			exitCode = 1
+		}
 	case "del":
 		if name == "" {
 			aliyun.Error("no instance is running")
 			return
 		}
-		if down(c, region, name) {
-			del(c, region, name)
+		if err := down(ctx, c, region, id, name, *force, waiter, prog); err != nil && !errors.Is(err, aliyun.ErrDryRunOperation) {
+			exitCode = 1
+			return
+		}
+		if *snapshot && !snapshotInstance(ctx, c, target, waiter, prog) {
+			aliyun.Error("not deleting %s without its snapshot", name)
+			exitCode = 1
+			return
+		}
+		if del(ctx, c, region, id, name, waiter, prog) != nil {
+			exitCode = 1
+		}
+	case "cloud-init":
+		if id == "" {
+			aliyun.Error("no instance is running")
+			return
+		}
+		st, err := c.CloudInitStatus(ctx, id, *logLines)
+		if err != nil {
+			aliyun.Error("error fetching cloud-init status: %v", err)
+			exitCode = 1
+			return
 		}
+		aliyun.Text("%s", st.Log)
+		aliyun.Info("cloud-init on %s is %s %s", name, st.State, st.Detail)
 	case "run":
 		if ip == "" {
 			aliyun.Error("no instance has no public IP")
 			return
 		}
-		if err := runCmds(ip, cfg.RootPwd, cfg.InitCmds); err != nil {
+		var cmds []string
+		if *recipes != "" {
+			cmds, err = book.Render(strings.Split(*recipes, ","), c.ImageOS(aliyun.RegionId(region), aliyun.ImageId(target.ImageId)), set)
+		} else {
+			cmds, err = cfg.ProvisionCmds(book, set)
+		}
+		if err != nil {
+			aliyun.Error("error rendering recipes: %v", err)
+			return
+		}
+		if err := runCmds(ctx, ip, cfg.RootSSHConfig(), cmds, stepOpts); err != nil {
 			aliyun.Error("error running commands: %v", err)
+			exitCode = 1
+		}
+	case "push", "pull":
+		opts := aliyun.TransferOptions{Recursive: *recursive, Resume: *resume, Delta: *delta}
+		if err := transfer(ctx, *op, instances, cfg.RootSSHConfig(), flag.Args(), opts, prog); err != nil {
+			aliyun.Error("error copying files: %v", err)
+			exitCode = 1
+		}
+	case "exec":
+		targets := instances
+		if *selFlag != "" {
+			targets = sel.Filter(instances)
+		} else if target != nil {
+			targets = []ecs.Instance{*target}
+		}
+		opts := aliyun.ExecOptions{SSH: cfg.RootSSHConfig(), Timeout: *execTimeout, Concurrency: *parallel}
+		if !exec(ctx, targets, flag.Args(), opts, *jsonOut) {
+			exitCode = 1
+		}
+	case "refresh":
+		rs := []aliyun.RegionId{}
+		for r := range regions {
+			rs = append(rs, r)
+		}
+		drifts, err := c.Refresh(ctx, rs)
+		if err != nil {
+			aliyun.Error("error refreshing state: %v", err)
+			return
+		}
+		printState(state)
+		for _, d := range drifts {
+			aliyun.Warn("drift: %v", d)
+		}
+		if len(drifts) == 0 {
+			aliyun.Info("state matches the cloud")
+		}
+	case "gc":
+		rs := []aliyun.RegionId{}
+		for r := range regions {
+			rs = append(rs, r)
+		}
+		if !gc(ctx, c, rs, *yes) {
+			exitCode = 1
+		}
+	case "plan", "apply":
+		rs := []aliyun.RegionId{}
+		for r := range regions {
+			rs = append(rs, r)
+		}
+		if !fleet(ctx, c, *op, *fleetFile, rs, book, *parallel, stepOpts, waiter, *yes) {
+			exitCode = 1
+		}
+	case "spot-prices":
+		prices, err := c.SpotPrices(ctx, cfg.InstanceType)
+		if err != nil {
+			aliyun.Error("error fetching spot prices: %v", err)
+			return
+		}
+		schema := "| %-18s | %-20s | %-10s | %-10s | %-8s |"
+		rowSeparator := "+--------------------+----------------------+------------+------------+----------+"
+		lines := []string{
+			rowSeparator,
+			fmt.Sprintf(schema, "ZoneId", "InstanceType", "Spot/hr", "Origin/hr", "Discount"),
+			rowSeparator,
+		}
+		for _, p := range prices {
+			discount := ""
+			if p.OriginPrice > 0 {
+				discount = fmt.Sprintf("%.0f%%", 100-100*p.Price/p.OriginPrice)
+			}
+			lines = append(lines, fmt.Sprintf(schema, p.Zone, p.InstanceType, fmt.Sprintf("%.4f", p.Price), fmt.Sprintf("%.4f", p.OriginPrice), discount))
+		}
+		lines = append(lines, rowSeparator)
+		aliyun.Text(strings.Join(lines, "\n"))
+	case "watch":
+		if target == nil {
+			aliyun.Error("no instance to watch")
+			exitCode = 1
+			return
+		}
+		if !target.IsSpot && (target.SpotStrategy == "" || target.SpotStrategy == string(aliyun.NoSpot)) {
+			aliyun.Error("%s is not a spot instance", target.InstanceName)
+			exitCode = 1
+			return
+		}
+		if cfg.InitCmds, err = cfg.ProvisionCmds(book, set); err != nil {
+			aliyun.Error("error rendering recipes: %v", err)
+			exitCode = 1
+			return
+		}
+		opts := spotWatch{
+			Interval:         *watchInterval,
+			Replace:          *replace,
+			CheapestZone:     *cheapestZone,
+			ProvisionTimeout: *provisionTimeout,
+			Steps:            stepOpts,
+		}
+		if watchSpot(ctx, c, cfg, target, opts, waiter, prog) != nil {
+			exitCode = 1
+		}
+	case "bake":
+		if target == nil {
+			aliyun.Error("no instance to bake")
+			return
+		}
+		if *imageName == "" {
+			aliyun.Error("usage: bake <selector> -name <image name>")
+			return
+		}
+		if !bake(ctx, c, target, *imageName, waiter, prog) {
+			exitCode = 1
+		}
+	case "schedule":
+		if !schedule(flag.Args()) {
+			exitCode = 1
+		}
+	case "tick", "daemon":
+		if c.FindImage(cfg.Derived.Region, cfg.Image) == nil {
+			if cfg.InitCmds, err = cfg.ProvisionCmds(book, set); err != nil {
+				aliyun.Error("error rendering recipes: %v", err)
+				return
+			}
+		}
+		scheds, err := aliyun.LoadSchedules(aliyun.SchedulesPath())
+		if err != nil {
+			aliyun.Error("error loading schedules: %v", err)
+			return
+		}
+		if !c.DryRun() {
+			unlock, err := scheds.Lock()
+			if errors.Is(err, aliyun.ErrSchedulesLocked) && *op == "tick" {
+				// the runs due meanwhile are caught up by the next tick
+				aliyun.Warn("previous tick is still running, skipping this one")
+				return
+			}
+			if err != nil {
+				aliyun.Error("error locking schedules: %v", err)
+				return
+			}
+			defer unlock()
+		}
+		st := scheduler{
+			schedules:        scheds,
+			regions:          regions,
+			waiter:           waiter,
+			provisionTimeout: *provisionTimeout,
+			steps:            stepOpts,
 		}
+		if *op == "tick" {
+			if !st.tick(ctx, c, cfg, prog) {
+				exitCode = 1
+			}
+			return
+		}
+		st.daemon(ctx, c, cfg, prog)
+	case "console":
+		if target == nil {
+			aliyun.Error("no instance to show the console of")
+			return
+		}
+		if !console(ctx, c, target, *logLines, *screenshot) {
+			exitCode = 1
+		}
+	case "top":
+		running := []ecs.Instance{}
+		for _, ins := range instances {
+			if ins.Status == string(aliyun.Running) {
+				running = append(running, ins)
+			}
+		}
+		if !top(ctx, c, running, *creditWarn) {
+			exitCode = 1
+		}
+	case "stats":
+		if target == nil {
+			aliyun.Error("no instance to show stats of")
+			return
+		}
+		if !stats(ctx, c, target, *since, *creditWarn) {
+			exitCode = 1
+		}
+	case "resize":
+		if target == nil {
+			aliyun.Error("no instance to resize")
+			return
+		}
+		opts := aliyun.ResizeOptions{
+			Type:         aliyun.InstanceType(*newType),
+			BandwidthOut: *bandwidthOut,
+			Disk:         *diskName,
+			DiskSize:     *diskSize,
+			CreditMode:   aliyun.CreditMode(*creditMode),
+		}
+		if m := opts.CreditMode; m != "" && m != aliyun.CreditStandard && m != aliyun.CreditUnlimited {
+			aliyun.Error("%v", aliyun.ErrBadCreditMode)
+			return
+		}
+		if opts == (aliyun.ResizeOptions{Disk: *diskName}) {
+			aliyun.Error("usage: resize <selector> [-type <type>] [-bandwidth-out <Mbps>] [-disk-size <GB> [-disk <name>]] [-credit-mode Standard|Unlimited]")
+			return
+		}
+		if !resize(ctx, c, cfg, target, opts, stepOpts, waiter, prog) {
+			exitCode = 1
+		}
+	case "disk":
+		if !disks(ctx, c, cfg, instances, flag.Args(), stepOpts) {
+			exitCode = 1
+		}
+	case "snapshot":
+		if !snapshots(ctx, c, instances, flag.Args(), waiter, prog) {
+			exitCode = 1
+		}
+	case "image":
+		if !imageCatalog(ctx, c, regions, flag.Args(), *keep, *yes) {
+			exitCode = 1
+		}
+	case "recipes":
+		for _, n := range book.Names() {
+			r, _ := book.Get(n)
+			aliyun.Text("%-16s %s", r.Name, r.Description)
+			for _, p := range r.Params {
+				req := ""
+				if p.Required {
+					req = ", required"
+				}
+				aliyun.Text("    %-12s %s (default %q%s)", p.Name, p.Description, p.Default, req)
+			}
+		}
+	}
+}
+
+// chargingNote tells whether a stopped instance still pays for compute.
+func chargingNote(ins *ecs.Instance) string {
+	if aliyun.StillCharging(ins) {
+		return "still charging for compute"
+	}
+	return "not charging for compute"
+}
+
+// kvFlag collects repeated key=value flags.
+type kvFlag map[string]string
+
+func (f kvFlag) String() string {
+	kvs := []string{}
+	for k, v := range f {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (f kvFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expecting key=value, got %q", s)
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// handleInterrupt cancels in-flight waits on the first Ctrl-C so the current
+// operation stops issuing calls and reports where it left the instance. A
+// second Ctrl-C exits immediately.
+func handleInterrupt(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		aliyun.Warn("interrupted, stopping after the current call; press Ctrl-C again to exit immediately")
+		cancel()
+		<-sigs
+		os.Exit(130)
+	}()
+}
+
+// transient reports whether an API error should just be retried on the next
+// poll instead of aborting the op. The client has already retried it within
+// its own budget.
+func transient(err error) bool {
+	return aliyun.IsRetryable(err) ||
+		errors.Is(err, aliyun.ErrIncorrectStatus) ||
+		errors.Is(err, aliyun.ErrOperationConflict)
+}
+
+// dryRunDone reports whether err is a change skipped by -dry-run, which ends
+// the op successfully as there is nothing to wait for.
+func dryRunDone(task *aliyun.Task, err error) bool {
+	if !errors.Is(err, aliyun.ErrDryRunOperation) {
+		return false
+	}
+	task.Done("dry run, nothing changed")
+	return true
+}
+
+// waitFailed reports why an op stopped waiting, including the last state the
+// instance was seen in so the user knows what was left behind.
+func waitFailed(task *aliyun.Task, log aliyun.Logger, status string, err error) error {
+	if err == context.Canceled {
+		if status == "" {
+			status = "unknown"
+		}
+		err = fmt.Errorf("interrupted, instance was last seen %s", status)
 	}
+	log.Error("%v", err)
+	task.Fail(err)
+	return err
 }
 
-func up(c *aliyun.EcsClient, cfg *aliyun.EcsCfg) (string, bool) {
-	ticker := time.NewTicker(loopInterval)
-	pt := aliyun.NewProgressTracker()
+// up converges on exactly one running instance matching sel: a stopped match
+// is started, and only if nothing matches is a new instance created, named
+// after the selector. Creation uses a ClientToken derived from the name and
+// its generation in the state, so concurrent ups for the same name end up
+// with the same instance.
+func up(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, sel aliyun.Selector, opts aliyun.CreateOptions, w aliyun.Waiter, prog *aliyun.Progress) (*ecs.Instance, bool, error) {
+	region := cfg.Derived.Region
+	log := aliyun.DefaultLogger().With(aliyun.F("op", "up"), aliyun.F("region", region), aliyun.F("selector", sel))
 	isCreated := false
 
-	instanceName := aliyun.RegionToBr[cfg.Derived.Region] + "-" + time.Now().Format("20060102T1504")
-	for range ticker.C {
-		if ins, err := acquireInstanceByName(c, string(cfg.Derived.Region), instanceName); err != nil {
-			aliyun.Error("error querying instances: %v", err)
-			continue
-		} else {
-			if ins == nil {
-				// instance does NOT exist
-				if _, err := c.CreateInstance(cfg, instanceName); err != nil {
-					aliyun.Error("error creating instance %v", err)
-				}
-				isCreated = true
-				continue
+	instanceName, nameErr := sel.Name()
+	task := prog.Task(sel.String())
+	token := c.InstanceClientToken(instanceName)
+	createdId := ""
+	missing := 0
+
+	var running *ecs.Instance
+	ip := ""
+	status := ""
+	err := w.WaitFor(ctx, "instance "+sel.String(), func(ctx context.Context) (bool, error) {
+		instances, err := c.DescribeInstances(ctx, region, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if !transient(err) {
+				return false, err
 			}
+			log.Warn("error querying instances: %v", err)
+			return false, nil
+		}
 
-			// instance exists
-			ip := ""
-			if len(ins.PublicIpAddress.IpAddress) > 0 {
-				ip = ins.PublicIpAddress.IpAddress[0]
-			}
-			switch ins.Status {
-			case string(aliyun.Running):
-				if len(ip) == 0 {
-					aliyun.Info("public IP address is missing, requesting a new one")
-					if _, err := c.BindPublicIp(ins.InstanceId); err != nil {
-						aliyun.Error("error binding public ip to instance: %v", err)
-					}
-				} else {
-					aliyun.Info("instance is up running, IP: %s", ip)
-					return ip, isCreated
-				}
-			case string(aliyun.Starting):
-				pt.Info("instance is being started up")
-			case string(aliyun.Stopping):
-				pt.Info("instance is being stopped")
-			case string(aliyun.Stopped):
-				aliyun.Info("instance is stopped, trying to start it up")
-				if err := c.StartInstance(ins.InstanceId); err != nil {
-					aliyun.Error("error starting ecs instance: %v", err)
+		ins, err := sel.One(instances)
+		if err != nil {
+			return false, err
+		}
+		if ins == nil && createdId != "" {
+			for i := range instances {
+				if instances[i].InstanceId == createdId {
+					ins = &instances[i]
 				}
 			}
 		}
-	}
-
-	return "", false
-}
 
-func reboot(c *aliyun.EcsClient, region, name string) bool {
-	ticker := time.NewTicker(loopInterval)
-	pt := aliyun.NewProgressTracker()
-	rebooted := false
-	for range ticker.C {
-		if ins, err := acquireInstanceByName(c, region, name); err != nil {
-			aliyun.Error("error querying instances: %v", err)
-			continue
-		} else {
-			if ins == nil {
-				aliyun.Info("instance does NOT exist")
-				return false
+		if ins == nil {
+			// instance does NOT exist
+			if nameErr != nil {
+				return false, fmt.Errorf("no instance matches %s and it can't be created: %v", sel, nameErr)
+			}
+			if createdId != "" {
+				// a new instance may take a moment to be listed, but one that
+				// never shows up was deleted outside aliecs and the API keeps
+				// handing back its ID for the token
+				if missing++; missing < 3 {
+					return false, nil
+				}
+				log.Warn("created instance %s vanished, retrying with a fresh client token", createdId)
+				c.InstanceGone(instanceName)
+				token = c.InstanceClientToken(instanceName)
+				createdId, missing = "", 0
 			}
 
-			if !rebooted {
-				if err := c.RebootInstance(ins.InstanceId); err != nil {
-					aliyun.Error("error starting ecs instance: %v", err)
-				} else {
-					rebooted = true
+			task.State("Creating", "creating instance")
+			opts.Name, opts.ClientToken = instanceName, token
+			id, err := c.CreateInstance(ctx, cfg, opts)
+			if err != nil {
+				if !transient(err) {
+					return false, err
 				}
-				continue
+				log.Warn("error creating instance %v", err)
+				return false, nil
 			}
+			createdId = id
+			isCreated = true
+			return false, nil
+		}
 
-			// instance exists
-			switch ins.Status {
-			case string(aliyun.Running):
-				aliyun.Info("instance is up running")
-				return true
-			case string(aliyun.Starting):
-				pt.Info("instance is being started up")
-			case string(aliyun.Stopping):
-				pt.Info("instance is being stopped")
-			case string(aliyun.Stopped):
-				aliyun.Info("instance is stopped")
+		// instance exists
+		log := log.With(aliyun.F("instance", ins.InstanceId))
+		status = ins.Status
+		aliyun.RecordState(ctx, status)
+		if len(ins.PublicIpAddress.IpAddress) > 0 {
+			ip = ins.PublicIpAddress.IpAddress[0]
+		}
+		switch ins.Status {
+		case string(aliyun.Running):
+			if len(ip) == 0 {
+				task.State(ins.Status, "public IP address is missing, requesting a new one")
+				if _, err := c.BindPublicIp(ctx, ins.InstanceId); err != nil {
+					if !transient(err) {
+						return false, err
+					}
+					log.Warn("error binding public ip to instance: %v", err)
+				}
+				return false, nil
+			}
+			running = ins
+			return true, nil
+		case string(aliyun.Starting), string(aliyun.Pending):
+			task.State(ins.Status, "instance is being started up")
+		case string(aliyun.Stopping):
+			task.State(ins.Status, "instance is being stopped")
+		case string(aliyun.Stopped):
+			task.State(ins.Status, "instance is stopped, trying to start it up")
+			if err := c.StartInstance(ctx, ins.InstanceId); err != nil {
+				if !transient(err) {
+					return false, err
+				}
+				log.Warn("error starting ecs instance: %v", err)
 			}
 		}
+		return false, nil
+	})
+	if dryRunDone(task, err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, isCreated, waitFailed(task, log, status, err)
 	}
 
-	return false
+	task.Done("instance is up running, IP: %s", ip)
+	return running, isCreated, nil
 }
 
-func down(c *aliyun.EcsClient, region, name string) bool {
-	ticker := time.NewTicker(loopInterval)
-	pt := aliyun.NewProgressTracker()
-	for range ticker.C {
-		if ins, err := acquireInstanceByName(c, region, name); err != nil {
-			aliyun.Error("error querying instances: %v", err)
-			continue
-		} else {
-			if ins == nil {
-				aliyun.Info("instance does NOT exist")
-				return false
+func reboot(ctx context.Context, c *aliyun.EcsClient, region, id, name string, w aliyun.Waiter, prog *aliyun.Progress) error {
+	log := aliyun.DefaultLogger().With(aliyun.F("op", "reboot"), aliyun.F("region", region), aliyun.F("instance", name))
+	task := prog.Task(name)
+	rebooted := false
+	status := ""
+	err := w.WaitFor(ctx, "instance "+name, func(ctx context.Context) (bool, error) {
+		ins, err := acquireInstanceById(ctx, c, region, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if !transient(err) {
+				return false, err
 			}
+			log.Warn("error querying instances: %v", err)
+			return false, nil
+		}
+		if ins == nil {
+			return false, errInstanceNotExist
+		}
 
-			// instance exists
-			switch ins.Status {
-			case string(aliyun.Running):
-				aliyun.Info("instance is running, trying to stop it")
-				if err := c.StopInstance(ins.InstanceId); err != nil {
-					aliyun.Error("error starting ecs instance: %v", err)
+		status = ins.Status
+		aliyun.RecordState(ctx, status)
+		if !rebooted {
+			if err := c.RebootInstance(ctx, ins.InstanceId); err != nil {
+				if !transient(err) {
+					return false, err
 				}
-			case string(aliyun.Starting):
-				pt.Info("instance is being started up")
-			case string(aliyun.Stopping):
-				pt.Info("instance is being stopped")
-			case string(aliyun.Stopped):
-				aliyun.Info("instance is stopped")
-				return true
+				log.Warn("error starting ecs instance: %v", err)
+			} else {
+				task.State("Rebooting", "reboot requested")
+				rebooted = true
 			}
+			return false, nil
+		}
+
+		// instance exists
+		switch ins.Status {
+		case string(aliyun.Running):
+			return true, nil
+		case string(aliyun.Starting):
+			task.State(ins.Status, "instance is being started up")
+		case string(aliyun.Stopping):
+			task.State(ins.Status, "instance is being stopped")
+		case string(aliyun.Stopped):
+			task.State(ins.Status, "instance is stopped")
 		}
+		return false, nil
+	})
+	if dryRunDone(task, err) {
+		return nil
+	}
+	if err != nil {
+		return waitFailed(task, log, status, err)
 	}
 
-	return false
+	task.Done("instance is up running")
+	return nil
 }
 
-func del(c *aliyun.EcsClient, region, name string) {
-	ticker := time.NewTicker(loopInterval)
-	pt := aliyun.NewProgressTracker()
-	for range ticker.C {
-		if ins, err := acquireInstanceByName(c, region, name); err != nil {
-			aliyun.Error("error querying instances: %v", err)
-			continue
-		} else {
-			if ins == nil {
-				aliyun.Info("instance does NOT exist")
-				return
+func down(ctx context.Context, c *aliyun.EcsClient, region, id, name string, force bool, w aliyun.Waiter, prog *aliyun.Progress) error {
+	log := aliyun.DefaultLogger().With(aliyun.F("op", "down"), aliyun.F("region", region), aliyun.F("instance", name))
+	task := prog.Task(name)
+	status := ""
+	forceAfter := c.Config().ForceStopAfter
+	var requested time.Time
+	err := w.WaitFor(ctx, "instance "+name, func(ctx context.Context) (bool, error) {
+		ins, err := acquireInstanceById(ctx, c, region, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
 			}
-
-			// instance exists
-			aliyun.Info("instance exists, trying to delete it")
-			if err := c.DeleteInstance(aliyun.RegionId(region), ins.InstanceId); err != nil {
-				aliyun.Error("error deleting ecs instance: %v", err)
-				continue
+			if !transient(err) {
+				return false, err
 			}
-			break
+			log.Warn("error querying instances: %v", err)
+			return false, nil
+		}
+		if ins == nil {
+			return false, errInstanceNotExist
 		}
-	}
 
-	for range ticker.C {
-		if ins, err := acquireInstanceByName(c, region, name); err != nil {
-			aliyun.Error("error querying instances: %v", err)
-			continue
-		} else if ins == nil {
-			aliyun.Info("instance is deleted")
-			return
+		// instance exists
+		status = ins.Status
+		aliyun.RecordState(ctx, status)
+		switch ins.Status {
+		case string(aliyun.Running), string(aliyun.Stopping):
+			opts := c.DefaultStopOptions(ins)
+			opts.Force = force
+			if !requested.IsZero() {
+				if force || time.Since(requested) < forceAfter {
+					task.State(ins.Status, "instance is being stopped")
+					return false, nil
+				}
+				// the OS didn't shut down in time, pull the plug
+				task.State(ins.Status, "instance did not stop in %v, forcing it", forceAfter)
+				opts.Force, force = true, true
+			} else if ins.Status == string(aliyun.Stopping) {
+				task.State(ins.Status, "instance is being stopped")
+				return false, nil
+			} else {
+				task.State(ins.Status, "instance is running, trying to stop it")
+			}
+			if err := c.StopInstance(ctx, ins.InstanceId, opts); err != nil {
+				if !transient(err) {
+					return false, err
+				}
+				log.Warn("error stopping ecs instance: %v", err)
+				return false, nil
+			}
+			requested = time.Now()
+		case string(aliyun.Starting):
+			task.State(ins.Status, "instance is being started up")
+		case string(aliyun.Stopped):
+			task.State(ins.Status, "instance is stopped")
+			return true, nil
 		}
-		pt.Info("instance is being deleted")
+		return false, nil
+	})
+	if dryRunDone(task, err) {
+		return err
 	}
-}
-
-func runCmds(ip, rootPwd string, cmds []string) error {
-	s, err := gossh.NewSessionWithRetry(ip+":22", "root", rootPwd, "", 10*time.Minute)
 	if err != nil {
-		return err
+		return waitFailed(task, log, status, err)
 	}
-	defer s.Close()
+	return nil
+}
 
-	for _, cmd := range cmds {
-		c, err := s.Run(cmd)
+func del(ctx context.Context, c *aliyun.EcsClient, region, id, name string, w aliyun.Waiter, prog *aliyun.Progress) error {
+	log := aliyun.DefaultLogger().With(aliyun.F("op", "del"), aliyun.F("region", region), aliyun.F("instance", name))
+	task := prog.Task(name)
+	deleted := false
+	status := ""
+	err := w.WaitFor(ctx, "instance "+name, func(ctx context.Context) (bool, error) {
+		ins, err := acquireInstanceById(ctx, c, region, id)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if !transient(err) {
+				return false, err
+			}
+			log.Warn("error querying instances: %v", err)
+			return false, nil
+		}
+		if ins == nil {
+			if !deleted {
+				return false, errInstanceNotExist
+			}
+			return true, nil
+		}
+
+		status = ins.Status
+		aliyun.RecordState(ctx, status)
+		if deleted {
+			task.Message("instance is being deleted")
+			return false, nil
 		}
 
-		for line := range c.CombinedOut() {
-			fmt.Printf(string(line) + "\n")
+		// instance exists
+		task.State("Deleting", "instance exists, trying to delete it")
+		if err := c.DeleteInstance(ctx, aliyun.RegionId(region), ins.InstanceId); err != nil {
+			if !transient(err) {
+				return false, err
+			}
+			log.Warn("error deleting ecs instance: %v", err)
+			return false, nil
 		}
-		c.Close()
+		deleted = true
+		return false, nil
+	})
+	if dryRunDone(task, err) {
+		return nil
+	}
+	if err != nil {
+		return waitFailed(task, log, status, err)
 	}
 
+	task.Done("instance is deleted")
+	return nil
+}
+
+// waitCloudInit follows first boot provisioning through Cloud Assistant and
+// reports the tail of the cloud-init log once it finishes.
+func waitCloudInit(ctx context.Context, c *aliyun.EcsClient, ins *ecs.Instance, w aliyun.Waiter, prog *aliyun.Progress) error {
+	log := aliyun.DefaultLogger().With(aliyun.F("op", "provision"), aliyun.F("instance", ins.InstanceId))
+	task := prog.Task(ins.InstanceName + " cloud-init")
+
+	var st *aliyun.CloudInitStatus
+	state := ""
+	err := w.WaitFor(ctx, "cloud-init on "+ins.InstanceName, func(ctx context.Context) (bool, error) {
+		s, err := c.CloudInitStatus(ctx, ins.InstanceId, 20)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			// the assistant agent comes up a little after the instance
+			log.Debug("cloud-init status not available yet: %v", err)
+			return false, nil
+		}
+		st = s
+		state = string(s.State)
+		aliyun.RecordState(ctx, state)
+		switch s.State {
+		case aliyun.CloudInitDone, aliyun.CloudInitError, aliyun.CloudInitDisabled:
+			return true, nil
+		}
+		task.State(state, "%s", lastLine(s.Log))
+		return false, nil
+	})
+	if err != nil {
+		return waitFailed(task, log, state, err)
+	}
+
+	aliyun.Text("%s", st.Log)
+	if st.State != aliyun.CloudInitDone {
+		err := fmt.Errorf("cloud-init %s: %s", st.State, st.Detail)
+		log.Error("%v", err)
+		task.Fail(err)
+		return err
+	}
+	task.Done("provisioning finished")
+	return nil
+}
+
+// disks manages the configured data disks of an instance: ls <selector>,
+// attach <selector> [name...] and detach <selector> <name>.
+func disks(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, instances []ecs.Instance, args []string, stepOpts aliyun.StepOptions) bool {
+	usage := "usage: disk ls <selector> | attach <selector> [name...] | detach <selector> <name>"
+	if len(args) < 2 {
+		aliyun.Error(usage)
+		return false
+	}
+	sel, err := aliyun.ParseSelector(args[1])
+	if err != nil {
+		aliyun.Error("%v", err)
+		return false
+	}
+	ins, err := sel.One(instances)
+	if err != nil || ins == nil {
+		aliyun.Error("no instance matches %s", sel)
+		return false
+	}
+	configured := map[string]aliyun.DataDisk{}
+	for _, d := range cfg.DataDisks {
+		configured[d.Name] = d
+	}
+
+	switch {
+	case args[0] == "ls" && len(args) == 2:
+		current, err := c.InstanceDisks(ctx, ins.InstanceId)
+		if err != nil {
+			aliyun.Error("error listing disks: %v", err)
+			return false
+		}
+		schema := "| %-24s | %-16s | %-6s | %-16s | %-7s | %-10s | %-6s |"
+		rowSeparator := "+--------------------------+------------------+--------+------------------+---------+------------+--------+"
+		lines := []string{
+			rowSeparator,
+			fmt.Sprintf(schema, "DiskId", "Name", "Type", "Category", "Size", "Status", "Keep"),
+			rowSeparator,
+		}
+		for _, d := range current {
+			category := d.Category
+			if d.PerformanceLevel != "" {
+				category += " " + d.PerformanceLevel
+			}
+			keep := "no"
+			if !d.DeleteWithInstance {
+				keep = "yes"
+			}
+			lines = append(lines, fmt.Sprintf(schema, d.DiskId, d.DiskName, d.Type, category, fmt.Sprintf("%dGB", d.Size), d.Status, keep))
+		}
+		lines = append(lines, rowSeparator)
+		aliyun.Text(strings.Join(lines, "\n"))
+		return true
+	case args[0] == "attach":
+		want := cfg.DataDisks
+		if len(args) > 2 {
+			want = nil
+			for _, n := range args[2:] {
+				d, ok := configured[n]
+				if !ok {
+					aliyun.Error("no data disk %s in ECS_DATA_DISKS", n)
+					return false
+				}
+				want = append(want, d)
+			}
+		}
+		if len(want) == 0 {
+			aliyun.Error("no data disks configured, set ECS_DATA_DISKS")
+			return false
+		}
+		attached, err := c.EnsureDataDisks(ctx, ins, want)
+		if errors.Is(err, aliyun.ErrDryRunOperation) {
+			return true
+		}
+		if err != nil {
+			aliyun.Error("error attaching disks to %s: %v", ins.InstanceName, err)
+			return false
+		}
+		mounts := []string{}
+		for _, d := range attached {
+			if d.New {
+				aliyun.Info("attached %s (%s) to %s", d.Name, d.Id, ins.InstanceName)
+			}
+			if d.MountPoint != "" {
+				mounts = append(mounts, d.MountCmd())
+			}
+		}
+		if len(mounts) == 0 {
+			return true
+		}
+		if len(ins.PublicIpAddress.IpAddress) == 0 {
+			aliyun.Warn("%s has no public IP, disks are not mounted", ins.InstanceName)
+			return true
+		}
+		if err := runCmds(ctx, ins.PublicIpAddress.IpAddress[0], cfg.RootSSHConfig(), mounts, stepOpts); err != nil {
+			aliyun.Error("error mounting disks: %v", err)
+			return false
+		}
+		return true
+	case args[0] == "detach" && len(args) == 3:
+		current, err := c.InstanceDisks(ctx, ins.InstanceId)
+		if err != nil {
+			aliyun.Error("error listing disks: %v", err)
+			return false
+		}
+		for _, d := range current {
+			if d.Type == "system" || (d.DiskName != args[2] && d.DiskId != args[2] && d.DiskName != ins.InstanceName+"-"+args[2]) {
+				continue
+			}
+			if mp := configured[args[2]].MountPoint; mp != "" && len(ins.PublicIpAddress.IpAddress) > 0 {
+				// fstab mounts it with nofail, the instance still boots
+				unmount := fmt.Sprintf("# unmount disk %s\n! mountpoint -q %s || umount %s", args[2], mp, mp)
+				if err := runCmds(ctx, ins.PublicIpAddress.IpAddress[0], cfg.RootSSHConfig(), []string{unmount}, stepOpts); err != nil {
+					aliyun.Error("error unmounting %s: %v", mp, err)
+					return false
+				}
+			}
+			err := c.DetachDisk(ctx, ins.InstanceId, d.DiskId)
+			if errors.Is(err, aliyun.ErrDryRunOperation) {
+				return true
+			}
+			if err != nil {
+				aliyun.Error("error detaching %s: %v", args[2], err)
+				return false
+			}
+			aliyun.Info("detached %s (%s) from %s", args[2], d.DiskId, ins.InstanceName)
+			return true
+		}
+		aliyun.Error("%s has no data disk %s", ins.InstanceName, args[2])
+		return false
+	}
+	aliyun.Error(usage)
+	return false
+}
+
+// restore sets cfg and opts up to create the instance sel names from one of
+// its snapshot sets. It reports whether up should go ahead.
+func restore(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, instances []ecs.Instance, sel aliyun.Selector, ref string, opts *aliyun.CreateOptions) bool {
+	name, err := sel.Name()
+	if err != nil {
+		aliyun.Error("can't restore %s: %v", sel, err)
+		return false
+	}
+	if ins, _ := sel.One(instances); ins != nil {
+		aliyun.Error("%s already exists, delete it before restoring it", name)
+		return false
+	}
+	set, err := c.FindSnapshotSet(ctx, name, ref)
+	if err != nil {
+		aliyun.Error("%v", err)
+		return false
+	}
+	aliyun.Info("restoring %s from snapshot set %s, %d disk(s), %dGB", name, set.Id, len(set.Snapshots()), set.Size())
+	image, disks, err := c.RestoreDisks(ctx, set)
+	if errors.Is(err, aliyun.ErrDryRunOperation) {
+		// there is no image to validate the instance against
+		return false
+	}
+	if err != nil {
+		aliyun.Error("error restoring %s: %v", name, err)
+		return false
+	}
+	cfg.Image = image
+	// the disks come provisioned
+	cfg.InitCmds = nil
+	opts.DataDisks = disks
+	return true
+}
+
+// snapshotInstance snapshots every disk of an instance. It reports whether
+// that went fine.
+func snapshotInstance(ctx context.Context, c *aliyun.EcsClient, ins *ecs.Instance, w aliyun.Waiter, prog *aliyun.Progress) bool {
+	task := prog.Task("snapshot " + ins.InstanceName)
+	task.State("Creating", "snapshotting disks")
+	// snapshots of large disks take a while
+	w.Timeout = time.Hour
+	set, err := c.SnapshotInstance(ctx, w, ins)
+	if dryRunDone(task, err) {
+		return true
+	}
+	if err != nil {
+		aliyun.Error("error snapshotting %s: %v", ins.InstanceName, err)
+		task.Fail(err)
+		return false
+	}
+	task.Done("snapshot set %s is complete", set)
+	return true
+}
+
+// snapshots manages snapshot sets: ls [name], create <selector> and
+// rm <set or snapshot id>...
+func snapshots(ctx context.Context, c *aliyun.EcsClient, instances []ecs.Instance, args []string, w aliyun.Waiter, prog *aliyun.Progress) bool {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	switch {
+	case args[0] == "ls" && len(args) <= 2:
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		sets, err := c.SnapshotSets(ctx, name)
+		if err != nil {
+			aliyun.Error("error listing snapshots: %v", err)
+			return false
+		}
+		schema := "| %-16s | %-15s | %-24s | %-6s | %-6s | %-12s |"
+		rowSeparator := "+------------------+-----------------+--------------------------+--------+--------+--------------+"
+		lines := []string{
+			rowSeparator,
+			fmt.Sprintf(schema, "Instance", "Set", "SnapshotId", "Disk", "Size", "Status"),
+			rowSeparator,
+		}
+		for _, set := range sets {
+			for _, sn := range set.Snapshots() {
+				status := sn.Status
+				if status != "accomplished" {
+					status += " " + sn.Progress
+				}
+				lines = append(lines, fmt.Sprintf(schema, set.Name, set.Id, sn.SnapshotId, strings.ToLower(sn.SourceDiskType), sn.SourceDiskSize+"GB", status))
+			}
+			lines = append(lines, rowSeparator)
+		}
+		if len(sets) == 0 {
+			lines = append(lines, fmt.Sprintf(schema, "", "", "", "", "", ""), rowSeparator)
+		}
+		aliyun.Text(strings.Join(lines, "\n"))
+		return true
+	case args[0] == "create" && len(args) == 2:
+		sel, err := aliyun.ParseSelector(args[1])
+		if err != nil {
+			aliyun.Error("%v", err)
+			return false
+		}
+		ins, err := sel.One(instances)
+		if err != nil || ins == nil {
+			aliyun.Error("no instance matches %s", sel)
+			return false
+		}
+		return snapshotInstance(ctx, c, ins, w, prog)
+	case args[0] == "rm" && len(args) >= 2:
+		ok := true
+		for _, ref := range args[1:] {
+			set, err := c.FindSnapshotSet(ctx, "", ref)
+			if err != nil {
+				aliyun.Error("%v", err)
+				ok = false
+				continue
+			}
+			for _, sn := range set.Snapshots() {
+				// a whole set goes when its id is given
+				if ref != set.Id && ref != sn.SnapshotId {
+					continue
+				}
+				err := c.DeleteSnapshot(ctx, sn.SnapshotId)
+				if errors.Is(err, aliyun.ErrDryRunOperation) {
+					continue
+				}
+				if err != nil {
+					aliyun.Error("error deleting %s: %v", sn.SnapshotId, err)
+					ok = false
+					continue
+				}
+				aliyun.Info("deleted %s of %s", sn.SnapshotId, set.Name)
+			}
+		}
+		return ok
+	}
+	aliyun.Error("usage: snapshot ls [name] | create <selector> | rm <set or snapshot id>...")
+	return false
+}
+
+// schedule manages the schedules: list, add <selector> <up|down> <cron>,
+// rm <id>, skip <id> <date> and holiday add|rm <date>.
+func schedule(args []string) bool {
+	usage := "usage: schedule list | add <selector> <up|down> <cron> | rm <id> | skip <id> <YYYY-MM-DD> | holiday add|rm <YYYY-MM-DD>"
+	scheds, err := aliyun.LoadSchedules(aliyun.SchedulesPath())
+	if err != nil {
+		aliyun.Error("error loading schedules: %v", err)
+		return false
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch {
+	case args[0] == "list" || args[0] == "ls":
+		schema := "| %-4s | %-20s | %-6s | %-18s | %-16s | %-16s | %-24s |"
+		rowSeparator := "+------+----------------------+--------+--------------------+------------------+------------------+--------------------------+"
+		lines := []string{
+			rowSeparator,
+			fmt.Sprintf(schema, "Id", "Selector", "Action", "Cron", "Next", "LastRun", "LastResult"),
+			rowSeparator,
+		}
+		now := time.Now()
+		for _, sc := range scheds.Schedules {
+			next := ""
+			if cr, err := aliyun.ParseCron(sc.Cron); err == nil {
+				// the next run that isn't skipped
+				for t := cr.Next(now); !t.IsZero(); t = cr.Next(t) {
+					if !sc.Skips(t) && !(sc.Action == aliyun.ScheduleUp && scheds.Holiday(t)) {
+						next = t.Format("2006-01-02 15:04")
+						break
+					}
+					if t.Sub(now) > 366*24*time.Hour {
+						break
+					}
+				}
+			}
+			last := ""
+			if !sc.LastRun.IsZero() {
+				last = sc.LastRun.Local().Format("2006-01-02 15:04")
+			}
+			lines = append(lines, fmt.Sprintf(schema, sc.Id, sc.Selector, sc.Action, sc.Cron, next, last, sc.LastResult))
+			if len(sc.Skip) > 0 {
+				lines = append(lines, fmt.Sprintf(schema, "", "", "", "skips", strings.Join(sc.Skip, ", "), "", ""))
+			}
+		}
+		lines = append(lines, rowSeparator)
+		aliyun.Text(strings.Join(lines, "\n"))
+		if len(scheds.Holidays) > 0 {
+			aliyun.Text("holidays: %s", strings.Join(scheds.Holidays, ", "))
+		}
+		if !scheds.LastTick.IsZero() && time.Since(scheds.LastTick) > 5*time.Minute {
+			aliyun.Warn("schedules were last applied at %s, is ecs tick or ecs daemon running?", scheds.LastTick.Local().Format("2006-01-02 15:04"))
+		}
+		return true
+	case args[0] == "add" && len(args) >= 4:
+		sc, err := scheds.Add(args[1], aliyun.ScheduleAction(args[2]), strings.Join(args[3:], " "))
+		if err != nil {
+			aliyun.Error("error adding schedule: %v", err)
+			return false
+		}
+		aliyun.Info("added schedule %s: %s %s at %s", sc.Id, sc.Action, sc.Selector, sc.Cron)
+		return true
+	case args[0] == "rm" && len(args) == 2:
+		if err := scheds.Remove(args[1]); err != nil {
+			aliyun.Error("error removing schedule: %v", err)
+			return false
+		}
+		aliyun.Info("removed schedule %s", args[1])
+		return true
+	case args[0] == "skip" && len(args) == 3:
+		if err := scheds.SkipDate(args[1], args[2]); err != nil {
+			aliyun.Error("error skipping %s: %v", args[2], err)
+			return false
+		}
+		aliyun.Info("schedule %s won't run on %s", args[1], args[2])
+		return true
+	case args[0] == "holiday" && len(args) == 3 && args[1] == "add":
+		if err := scheds.AddHoliday(args[2]); err != nil {
+			aliyun.Error("error adding holiday: %v", err)
+			return false
+		}
+		aliyun.Info("no instance is brought up on %s", args[2])
+		return true
+	case args[0] == "holiday" && len(args) == 3 && args[1] == "rm":
+		if err := scheds.RemoveHoliday(args[2]); err != nil {
+			aliyun.Error("error removing holiday: %v", err)
+			return false
+		}
+		aliyun.Info("%s is no longer a holiday", args[2])
+		return true
+	}
+	aliyun.Error(usage)
+	return false
+}
+
+// scheduler applies the schedules with the same up and down as the
+// commands.
+type scheduler struct {
+	schedules        *aliyun.Schedules
+	regions          map[aliyun.RegionId]bool
+	waiter           aliyun.Waiter
+	provisionTimeout time.Duration
+	steps            aliyun.StepOptions
+}
+
+// daemon ticks at the start of every minute until interrupted.
+func (st scheduler) daemon(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, prog *aliyun.Progress) {
+	aliyun.Info("applying %d schedules from %s every minute", len(st.schedules.Schedules), aliyun.SchedulesPath())
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		st.tick(ctx, c, cfg, prog)
+	}
+}
+
+// tick runs the schedules due since the last tick. It reports whether all
+// of them went well.
+func (st scheduler) tick(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, prog *aliyun.Progress) bool {
+	now := time.Now()
+	// pick up schedules added since the daemon started
+	if err := st.schedules.Reload(); err != nil {
+		aliyun.Error("error loading schedules: %v", err)
+		return false
+	}
+	runs := st.schedules.Due(now)
+	results := map[string]string{}
+	ok := true
+	for _, run := range runs {
+		if run.Skipped != "" {
+			aliyun.Info("schedule %s (%s %s) skipped: %s", run.Id, run.Action, run.Selector, run.Skipped)
+			results[run.Id] = run.Skipped
+			continue
+		}
+		aliyun.Info("schedule %s: %s %s", run.Id, run.Action, run.Selector)
+		if err := st.apply(ctx, c, cfg, run.Schedule, prog); err != nil && !errors.Is(err, aliyun.ErrDryRunOperation) {
+			aliyun.Error("schedule %s failed: %v", run.Id, err)
+			results[run.Id] = "failed: " + err.Error()
+			ok = false
+			continue
+		}
+		results[run.Id] = "ok"
+	}
+	if c.DryRun() {
+		return ok
+	}
+	if err := st.schedules.Ticked(now, results); err != nil {
+		aliyun.Error("error saving schedules: %v", err)
+		return false
+	}
+	return ok
+}
+
+func (st scheduler) apply(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, sc *aliyun.Schedule, prog *aliyun.Progress) error {
+	sel, err := aliyun.ParseSelector(sc.Selector)
+	if err != nil {
+		return err
+	}
+	instances := []ecs.Instance{}
+	for r := range st.regions {
+		results, err := c.DescribeInstances(ctx, r, "")
+		if err != nil {
+			return err
+		}
+		instances = append(instances, results...)
+	}
+	matches := sel.Filter(instances)
+
+	if sc.Action == aliyun.ScheduleDown {
+		for _, ins := range matches {
+			if ins.Status == string(aliyun.Stopped) {
+				continue
+			}
+			c, err := c.ForRegion(aliyun.ZoneId(ins.ZoneId))
+			if err != nil {
+				return err
+			}
+			if err := down(ctx, c, ins.RegionId, ins.InstanceId, ins.InstanceName, false, st.waiter, prog); err != nil {
+				return err
+			}
+			prog.Task(ins.InstanceName).Done("instance is stopped")
+		}
+		return nil
+	}
+
+	// a name with no instance yet is created in the default region, like
+	// ecs up does, matches are brought up where they are
+	type target struct {
+		c   *aliyun.EcsClient
+		cfg *aliyun.EcsCfg
+		sel aliyun.Selector
+	}
+	targets := []target{{c, cfg, sel}}
+	if len(matches) > 0 {
+		targets = nil
+		for _, ins := range matches {
+			ic, err := c.ForRegion(aliyun.ZoneId(ins.ZoneId))
+			if err != nil {
+				return err
+			}
+			s, _ := aliyun.ParseSelector(ins.InstanceId)
+			targets = append(targets, target{ic, ic.Config(), s})
+		}
+	}
+	for _, t := range targets {
+		ins, isCreated, err := up(ctx, t.c, t.cfg, t.sel, aliyun.CreateOptions{}, st.waiter, prog)
+		if err != nil {
+			return err
+		}
+		if ins == nil {
+			continue
+		}
+		if err := provision(ctx, t.c, t.cfg, ins, isCreated, st.waiter, st.provisionTimeout, st.steps, prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// console prints the tail of an instance's serial console output and saves
+// a screenshot of its screen.
+func console(ctx context.Context, c *aliyun.EcsClient, ins *ecs.Instance, lines int, path string) bool {
+	if !dumpConsole(ctx, c, ins, lines) {
+		return false
+	}
+	img, err := c.Screenshot(ctx, ins.InstanceId, true)
+	if err != nil {
+		aliyun.Error("error taking a screenshot of %s: %v", ins.InstanceName, err)
+		return false
+	}
+	if path == "" {
+		path = fmt.Sprintf("%s-%s.jpg", ins.InstanceName, time.Now().Format("20060102-150405"))
+	}
+	if err := ioutil.WriteFile(path, img, 0644); err != nil {
+		aliyun.Error("error saving screenshot: %v", err)
+		return false
+	}
+	aliyun.Info("saved a screenshot of %s to %s", ins.InstanceName, path)
+	return true
+}
+
+// dumpConsole prints the last lines of an instance's serial console
+// output, which tells why it doesn't boot or answer SSH.
+func dumpConsole(ctx context.Context, c *aliyun.EcsClient, ins *ecs.Instance, lines int) bool {
+	out, updated, err := c.ConsoleOutput(ctx, ins.InstanceId)
+	if err != nil {
+		aliyun.Error("error fetching the console output of %s: %v", ins.InstanceName, err)
+		return false
+	}
+	if strings.TrimSpace(out) == "" {
+		aliyun.Info("%s has no console output yet", ins.InstanceName)
+		return true
+	}
+	all := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	aliyun.Info("console output of %s as of %s:", ins.InstanceName, updated.Local().Format("2006-01-02 15:04:05"))
+	aliyun.Text("%s", strings.Join(all, "\n"))
+	return true
+}
+
+// top shows the latest metrics of the running instances.
+func top(ctx context.Context, c *aliyun.EcsClient, instances []ecs.Instance, creditWarn float64) bool {
+	m, err := c.MonitorClient()
+	if err != nil {
+		aliyun.Error("error creating monitor client: %v", err)
+		return false
+	}
+	ids := []string{}
+	burstable := false
+	for _, ins := range instances {
+		ids = append(ids, ins.InstanceId)
+		b, err := c.Burstable(ctx, aliyun.InstanceType(ins.InstanceType))
+		if err != nil {
+			aliyun.Error("error looking up instance type %s: %v", ins.InstanceType, err)
+			return false
+		}
+		burstable = burstable || b
+	}
+	// a few points in case the latest minute isn't in yet
+	all, err := m.Stats(ctx, ids, 10*time.Minute, burstable)
+	if err != nil {
+		aliyun.Error("error fetching metrics: %v", err)
+		return false
+	}
+
+	schema := "| %-22s | %-20s | %-6s | %-6s | %-6s | %-13s | %-13s | %-8s |"
+	rowSeparator := "+------------------------+----------------------+--------+--------+--------+---------------+---------------+----------+"
+	lines := []string{
+		rowSeparator,
+		fmt.Sprintf(schema, "InstanceName", "InstanceType", "CPU", "Mem", "Disk", "NetIn", "NetOut", "Credits"),
+		rowSeparator,
+	}
+	for _, ins := range instances {
+		st := all[ins.InstanceId]
+		lines = append(lines, fmt.Sprintf(schema, ins.InstanceName, ins.InstanceType,
+			lastValue(st.Series[aliyun.MetricCpu.Name], aliyun.MetricCpu),
+			lastValue(st.Series[aliyun.MetricMemory.Name], aliyun.MetricMemory),
+			lastValue(st.Series[aliyun.MetricDisk.Name], aliyun.MetricDisk),
+			lastValue(st.Series[aliyun.MetricNetIn.Name], aliyun.MetricNetIn),
+			lastValue(st.Series[aliyun.MetricNetOut.Name], aliyun.MetricNetOut),
+			lastValue(st.Series[aliyun.MetricCredits.Name], aliyun.MetricCredits)))
+	}
+	lines = append(lines, rowSeparator)
+	aliyun.Text(strings.Join(lines, "\n"))
+	for _, ins := range instances {
+		warnCredits(&ins, all[ins.InstanceId].Series[aliyun.MetricCredits.Name], creditWarn)
+	}
+	return true
+}
+
+// stats charts the metrics of an instance over the last since.
+func stats(ctx context.Context, c *aliyun.EcsClient, ins *ecs.Instance, since time.Duration, creditWarn float64) bool {
+	m, err := c.MonitorClient()
+	if err != nil {
+		aliyun.Error("error creating monitor client: %v", err)
+		return false
+	}
+	burstable, err := c.Burstable(ctx, aliyun.InstanceType(ins.InstanceType))
+	if err != nil {
+		aliyun.Error("error looking up instance type %s: %v", ins.InstanceType, err)
+		return false
+	}
+	all, err := m.Stats(ctx, []string{ins.InstanceId}, since, burstable)
+	if err != nil {
+		aliyun.Error("error fetching metrics: %v", err)
+		return false
+	}
+	st := all[ins.InstanceId]
+	aliyun.Text("%s (%s) over the last %v", ins.InstanceName, ins.InstanceType, since)
+	for _, metric := range aliyun.InstanceMetrics {
+		if metric == aliyun.MetricCredits && !burstable {
+			continue
+		}
+		series := st.Series[metric.Name]
+		if len(series) == 0 {
+			aliyun.Text("%-8s %-60s no data", metric.Name, "")
+			continue
+		}
+		aliyun.Text("%-8s %-60s now %-13s max %s", metric.Name, series.Sparkline(60),
+			lastValue(series, metric), formatMetric(series.Max(), metric))
+	}
+	if len(st.Series[aliyun.MetricMemory.Name]) == 0 {
+		aliyun.Info("memory and disk usage need the CloudMonitor agent on the instance")
+	}
+	warnCredits(ins, st.Series[aliyun.MetricCredits.Name], creditWarn)
+	return true
+}
+
+func lastValue(s aliyun.Series, metric aliyun.Metric) string {
+	v, ok := s.Last()
+	if !ok {
+		return "-"
+	}
+	return formatMetric(v, metric)
+}
+
+func formatMetric(v float64, metric aliyun.Metric) string {
+	switch metric.Unit {
+	case "%":
+		return fmt.Sprintf("%.1f%%", v)
+	case "bit/s":
+		const unit = 1000
+		if v < unit {
+			return fmt.Sprintf("%.0fbit/s", v)
+		}
+		div, exp := float64(unit), 0
+		for n := v / unit; n >= unit; n /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f%cbit/s", v/div, "kMGT"[exp])
+	}
+	return fmt.Sprintf("%.1f", v)
+}
+
+// warnCredits warns when a burstable instance is about to run out of CPU
+// credits, after which it is throttled or charged for the surplus.
+func warnCredits(ins *ecs.Instance, credits aliyun.Series, threshold float64) {
+	balance, ok := credits.Last()
+	if threshold <= 0 || !ok {
+		return
+	}
+	if balance < threshold {
+		aliyun.Warn("%s has %.1f CPU credits left", ins.InstanceName, balance)
+	} else if d := credits.RunOut(); d > 0 && d < time.Hour {
+		aliyun.Warn("%s will run out of CPU credits in about %v at the current rate", ins.InstanceName, d.Round(time.Minute))
+	}
+}
+
+// resize changes the type, bandwidth or a disk size of an instance, then
+// grows the file system on the disk over SSH.
+func resize(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, ins *ecs.Instance, opts aliyun.ResizeOptions, stepOpts aliyun.StepOptions, w aliyun.Waiter, prog *aliyun.Progress) bool {
+	task := prog.Task(ins.InstanceName)
+	task.State("Resizing", "resizing instance")
+	disk, err := c.Resize(ctx, ins, opts, w)
+	if dryRunDone(task, err) {
+		return true
+	}
+	if err != nil {
+		aliyun.Error("error resizing %s: %v", ins.InstanceName, err)
+		task.Fail(err)
+		return false
+	}
+	task.Done("instance is resized")
+	if disk == nil {
+		return true
+	}
+
+	// a type change may have stopped and started it
+	now, err := c.DescribeInstance(ctx, ins.InstanceId)
+	if err != nil || now == nil {
+		aliyun.Error("error querying %s: %v", ins.InstanceName, err)
+		return false
+	}
+	if now.Status != string(aliyun.Running) || len(now.PublicIpAddress.IpAddress) == 0 {
+		aliyun.Warn("%s is %s, grow the file system on %s once it runs", now.InstanceName, now.Status, disk.DiskId)
+		return true
+	}
+	if err := runCmds(ctx, now.PublicIpAddress.IpAddress[0], cfg.RootSSHConfig(), []string{aliyun.GrowFsCmd(*disk, opts.DiskSize)}, stepOpts); err != nil {
+		aliyun.Error("error growing the file system: %v", err)
+		return false
+	}
+	return true
+}
+
+// bake stops an instance and adds an image of it to the catalog.
+func bake(ctx context.Context, c *aliyun.EcsClient, ins *ecs.Instance, name string, w aliyun.Waiter, prog *aliyun.Progress) bool {
+	// a disk in use may not be consistent
+	err := down(ctx, c, ins.RegionId, ins.InstanceId, ins.InstanceName, false, w, prog)
+	if err != nil && !errors.Is(err, aliyun.ErrDryRunOperation) {
+		return false
+	}
+
+	task := prog.Task("image " + name)
+	task.State("Creating", "creating image from %s, this takes a while", ins.InstanceName)
+	// images take much longer than instances
+	w.Timeout = time.Hour
+	id, err := c.BakeImage(ctx, w, ins, name)
+	if dryRunDone(task, err) {
+		return true
+	}
+	if err != nil {
+		aliyun.Error("error baking %s: %v", name, err)
+		task.Fail(err)
+		return false
+	}
+	task.Done("image %s is available, %s is left stopped", id, ins.InstanceName)
+	return true
+}
+
+// imageCatalog manages the image catalog: ls, share <image> <account>...,
+// copy <image> <region>, rm <image> and prune <name>.
+func imageCatalog(ctx context.Context, c *aliyun.EcsClient, regions map[aliyun.RegionId]bool, args []string, keep int, yes bool) bool {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	usage := "usage: image ls | share <image> <account>... | copy <image> <region> | rm <image> | prune <name> -keep N"
+
+	// an image is a catalog name, for its newest version in the configured
+	// region, or an id
+	find := func(ref string) *aliyun.Resource {
+		if r := c.FindImage(c.Config().Derived.Region, aliyun.ImageId(ref)); r != nil {
+			return r
+		}
+		for region := range regions {
+			if r := c.FindImage(region, aliyun.ImageId(ref)); r != nil && r.Id == ref {
+				return r
+			}
+		}
+		aliyun.Error("no image %s in the catalog", ref)
+		return nil
+	}
+	done := func(err error, format string, a ...interface{}) bool {
+		if errors.Is(err, aliyun.ErrDryRunOperation) {
+			return true
+		}
+		if err != nil {
+			aliyun.Error("%v", err)
+			return false
+		}
+		aliyun.Info(format, a...)
+		return true
+	}
+
+	switch {
+	case args[0] == "ls":
+		images, err := c.ListImages(ctx)
+		if err != nil {
+			aliyun.Error("error listing images: %v", err)
+			return false
+		}
+		schema := "| %-16s | %-24s | %-14s | %-16s | %-6s | %-16s | %-20s |"
+		rowSeparator := "+------------------+--------------------------+----------------+------------------+--------+------------------+----------------------+"
+		lines := []string{
+			rowSeparator,
+			fmt.Sprintf(schema, "Name", "ImageId", "Region", "Status", "Size", "Created", "Shared with"),
+			rowSeparator,
+		}
+		for _, img := range images {
+			status := img.Status
+			if status == "" {
+				status = "missing"
+			} else if status != "Available" && img.Progress != "" {
+				status += " " + img.Progress
+			}
+			lines = append(lines, fmt.Sprintf(schema, img.Name, img.Id, img.Region, status, fmt.Sprintf("%dGB", img.Size), img.Created.Format("2006-01-02 15:04"), strings.Join(img.Shared, ",")))
+		}
+		lines = append(lines, rowSeparator)
+		aliyun.Text(strings.Join(lines, "\n"))
+		return true
+	case args[0] == "share" && len(args) >= 3:
+		img := find(args[1])
+		if img == nil {
+			return false
+		}
+		return done(c.ShareImage(ctx, img, args[2:]), "shared %s with %s", img.Id, strings.Join(args[2:], ", "))
+	case args[0] == "copy" && len(args) == 3:
+		img := find(args[1])
+		if img == nil {
+			return false
+		}
+		id, err := c.CopyImage(ctx, img, aliyun.RegionId(args[2]))
+		return done(err, "copying %s to %s as %s, see image ls for progress", img.Id, args[2], id)
+	case args[0] == "rm" && len(args) == 2:
+		img := find(args[1])
+		if img == nil {
+			return false
+		}
+		return done(c.DeleteImage(ctx, img), "deleted %s %s", img.Name, img.Id)
+	case args[0] == "prune" && len(args) == 2:
+		old, err := c.OldImages(args[1], keep)
+		if err != nil {
+			aliyun.Error("%v", err)
+			return false
+		}
+		if len(old) == 0 {
+			aliyun.Info("no old versions of %s, keeping %d", args[1], keep)
+			return true
+		}
+		for _, img := range old {
+			aliyun.Info("old version %s in %s, created %s", img.Id, img.Region, img.Created.Format("2006-01-02 15:04"))
+		}
+		if !yes && !c.DryRun() && !confirm(fmt.Sprintf("delete %d old version(s) of %s?", len(old), args[1])) {
+			aliyun.Info("nothing deleted")
+			return true
+		}
+		deleted := 0
+		for _, img := range old {
+			err := c.DeleteImage(ctx, img)
+			if errors.Is(err, aliyun.ErrDryRunOperation) {
+				continue
+			}
+			if err != nil {
+				aliyun.Error("error deleting %s %s in %s: %v", img.Name, img.Id, img.Region, err)
+				return false
+			}
+			aliyun.Info("deleted %s %s in %s", img.Name, img.Id, img.Region)
+			deleted++
+		}
+		if c.DryRun() {
+			return true
+		}
+		aliyun.Info("%d old version(s) of %s deleted, keeping %d", deleted, args[1], keep)
+		return true
+	}
+	aliyun.Error(usage)
+	return false
+}
+
+// provision attaches the configured data disks to an instance brought up
+// by up and, if it was just created, runs the configured provisioning after
+// mounting them. Disks newly attached to an existing instance are mounted.
+func provision(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, ins *ecs.Instance, isCreated bool, w aliyun.Waiter, timeout time.Duration, stepOpts aliyun.StepOptions, prog *aliyun.Progress) error {
+	mounts := []string{}
+	if len(cfg.DataDisks) > 0 {
+		disks, err := c.EnsureDataDisks(ctx, ins, cfg.DataDisks)
+		if err != nil {
+			aliyun.Error("error attaching data disks: %v", err)
+			return err
+		}
+		for _, d := range disks {
+			if (isCreated || d.New) && d.MountPoint != "" {
+				mounts = append(mounts, d.MountCmd())
+			}
+		}
+	}
+
+	cmds := mounts
+	if isCreated && cfg.Provisioner == aliyun.ProvisionCloudInit {
+		w.Timeout = timeout
+		if err := waitCloudInit(ctx, c, ins, w, prog); err != nil {
+			return err
+		}
+	} else if isCreated {
+		cmds = append(cmds, cfg.InitCmds...)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if err := runCmds(ctx, ins.PublicIpAddress.IpAddress[0], cfg.RootSSHConfig(), cmds, stepOpts); err != nil {
+		aliyun.Error("error initializing instance environment: %v", err)
+		if aliyun.SSHTimedOut(err) {
+			dumpConsole(ctx, c, ins, 40)
+		}
+		return err
+	}
+	return nil
+}
+
+// pickSpotZone moves cfg to the zone of its region where its instance type
+// is cheapest as a spot instance. It reports whether that went fine.
+func pickSpotZone(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg) bool {
+	if cfg.SpotStrategy == aliyun.NoSpot {
+		aliyun.Error("-cheapest-zone needs a spot strategy, set ECS_SPOT_STRATEGY")
+		return false
+	}
+	p, err := c.CheapestSpotZone(ctx, cfg.InstanceType)
+	if err != nil {
+		aliyun.Error("error looking up spot prices: %v", err)
+		return false
+	}
+	if cfg.SpotStrategy == aliyun.SpotWithPriceLimit && p.Price > cfg.SpotPriceLimit {
+		aliyun.Warn("cheapest spot price %.4f in %s is above the limit %.4f", p.Price, p.Zone, cfg.SpotPriceLimit)
+	}
+	aliyun.Info("using %s, spot price %.4f/hr", p.Zone, p.Price)
+	cfg.Zone = p.Zone
+	return true
+}
+
+type spotWatch struct {
+	Interval         time.Duration
+	Replace          bool
+	CheapestZone     bool
+	ProvisionTimeout time.Duration
+	Steps            aliyun.StepOptions
+}
+
+// watchSpot follows a spot instance until it is reclaimed. With Replace, it
+// then brings up a new one under the same name, from the latest image or
+// snapshot of the old one if there is any, and keeps watching that.
+func watchSpot(ctx context.Context, c *aliyun.EcsClient, cfg *aliyun.EcsCfg, ins *ecs.Instance, opts spotWatch, w aliyun.Waiter, prog *aliyun.Progress) error {
+	sshCfg := cfg.RootSSHConfig()
+	for {
+		name := ins.InstanceName
+		ip := ""
+		if len(ins.PublicIpAddress.IpAddress) > 0 {
+			ip = ins.PublicIpAddress.IpAddress[0]
+		}
+		aliyun.Info("watching spot instance %s (%s) every %v", name, ins.InstanceId, opts.Interval)
+		notice, err := c.WatchSpot(ctx, ins.InstanceId, ip, &sshCfg, opts.Interval)
+		if err != nil {
+			aliyun.Error("error watching %s: %v", name, err)
+			return err
+		}
+		if !opts.Replace {
+			return nil
+		}
+
+		task := prog.Task(name + " reclaim")
+		if notice.Source != "gone" {
+			task.State("Reclaiming", "%v", notice)
+			reclaimWaiter := w
+			if !notice.TerminationTime.IsZero() {
+				// the notice comes a few minutes ahead
+				reclaimWaiter.Timeout += time.Until(notice.TerminationTime)
+			}
+			if err := c.WaitReclaimed(ctx, reclaimWaiter, ins.InstanceId); err != nil {
+				task.Fail(err)
+				return err
+			}
+		}
+		image, err := c.ReplacementImage(ctx, name)
+		if err != nil && !errors.Is(err, aliyun.ErrDryRunOperation) {
+			task.Fail(err)
+			return err
+		}
+		task.Done("instance is gone")
+
+		replacement := *cfg
+		if image != "" {
+			aliyun.Info("re-creating %s from image %s", name, image)
+			replacement.Image = image
+			// the image already has everything the recipes would install
+			replacement.InitCmds = nil
+		} else {
+			aliyun.Info("no image or snapshot of %s, re-creating it from %s", name, cfg.Image)
+		}
+		if opts.CheapestZone && !pickSpotZone(ctx, c, &replacement) {
+			return fmt.Errorf("no zone to re-create %s in", name)
+		}
+		sel, err := aliyun.ParseSelector(name)
+		if err != nil {
+			return err
+		}
+		next, isCreated, err := up(ctx, c, &replacement, sel, aliyun.CreateOptions{}, w, prog)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			// dry run
+			return nil
+		}
+		if err := provision(ctx, c, &replacement, next, isCreated, w, opts.ProvisionTimeout, opts.Steps, prog); err != nil {
+			return err
+		}
+		ins = next
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
+
+// fleet prints the changes converging the instances to a fleet definition
+// and, for apply, makes them once confirmed. It reports whether everything
+// went fine.
+func fleet(ctx context.Context, c *aliyun.EcsClient, op, path string, regions []aliyun.RegionId, book *aliyun.RecipeBook, parallel int, stepOpts aliyun.StepOptions, w aliyun.Waiter, yes bool) bool {
+	f, err := aliyun.LoadFleet(path)
+	if err != nil {
+		aliyun.Error("error loading fleet: %v", err)
+		return false
+	}
+	p, err := c.PlanFleet(ctx, f, regions, book)
+	if err != nil {
+		aliyun.Error("error planning fleet %s: %v", f.Name, err)
+		return false
+	}
+	if len(p.Actions) == 0 {
+		aliyun.Info("fleet %s is up to date", f.Name)
+		return true
+	}
+
+	symbols := map[aliyun.FleetActionKind]string{aliyun.FleetCreate: "+", aliyun.FleetUpdate: "~", aliyun.FleetDelete: "-"}
+	for i, a := range p.Actions {
+		after := ""
+		if len(a.Deps) > 0 {
+			deps := []string{}
+			for _, d := range a.Deps {
+				deps = append(deps, strconv.Itoa(d+1))
+			}
+			after = " (after " + strings.Join(deps, ", ") + ")"
+		}
+		aliyun.Text("%3d. %s %-6s %-10s %-28s %-16s %s%s", i+1, symbols[a.Kind], a.Kind, a.Resource, a.Name, a.Zone, a.Detail, after)
+	}
+	aliyun.Info("fleet %s: %s", f.Name, p.Summary())
+	if op == "plan" {
+		return true
+	}
+
+	if !yes && !c.DryRun() && !confirm("apply these changes?") {
+		aliyun.Info("nothing changed")
+		return true
+	}
+	p.Steps = stepOpts
+	p.Waiter = w
+	results, err := p.Apply(ctx, parallel, func(r aliyun.FleetResult) {
+		a := r.Action
+		if r.Status == aliyun.StepFailed {
+			aliyun.Error("%s %s %s failed after %v: %v", a.Kind, a.Resource, a.Name, r.Duration.Round(time.Second), r.Err)
+		} else if r.Status == aliyun.StepOK {
+			aliyun.Info("%s %s %s done in %v", a.Kind, a.Resource, a.Name, r.Duration.Round(time.Second))
+		}
+	})
+	skipped := 0
+	for _, r := range results {
+		if r.Status == aliyun.StepSkipped && !errors.Is(r.Err, aliyun.ErrDryRunOperation) {
+			skipped++
+		}
+	}
+	if err != nil {
+		aliyun.Error("fleet %s not converged, %d change(s) skipped: %v", f.Name, skipped, err)
+		return false
+	}
+	aliyun.Info("fleet %s converged", f.Name)
+	return true
+}
+
+// gc lists orphaned resources and deletes them once confirmed. It reports
+// whether everything went fine.
+func gc(ctx context.Context, c *aliyun.EcsClient, regions []aliyun.RegionId, yes bool) bool {
+	orphans, err := c.FindOrphans(ctx, regions)
+	if err != nil {
+		aliyun.Error("error looking for orphaned resources: %v", err)
+		return false
+	}
+	if len(orphans) == 0 {
+		aliyun.Info("no orphaned resources")
+		return true
+	}
+
+	schema := "| %-9s | %-24s | %-16s | %-14s | %-32s | %-9s |"
+	rowSeparator := "+-----------+--------------------------+------------------+----------------+----------------------------------+-----------+"
+	lines := []string{
+		rowSeparator,
+		fmt.Sprintf(schema, "Kind", "Id", "Name", "Region", "Reason", "CNY/month"),
+		rowSeparator,
+	}
+	total := 0.0
+	for _, o := range orphans {
+		lines = append(lines, fmt.Sprintf(schema, o.Kind, o.Id, o.Name, o.Region, o.Reason, fmt.Sprintf("%.2f", o.MonthlyCost)))
+		total += o.MonthlyCost
+	}
+	lines = append(lines, rowSeparator)
+	aliyun.Text(strings.Join(lines, "\n"))
+	aliyun.Info("%d orphaned resource(s), about %.2f CNY a month", len(orphans), total)
+
+	if !yes && !c.DryRun() && !confirm(fmt.Sprintf("delete %d resource(s)?", len(orphans))) {
+		aliyun.Info("nothing deleted")
+		return true
+	}
+
+	ok := true
+	for _, o := range orphans {
+		err := c.DeleteOrphan(ctx, o)
+		if errors.Is(err, aliyun.ErrDryRunOperation) {
+			continue
+		}
+		if err != nil {
+			aliyun.Error("error deleting %s %s: %v", o.Kind, o.Id, err)
+			ok = false
+			continue
+		}
+		aliyun.Info("deleted %s %s", o.Kind, o.Id)
+	}
+	return ok
+}
+
+// confirm asks a yes/no question on the terminal, defaulting to no.
+func confirm(question string) bool {
+	aliyun.TextErr("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printPlan(plan *aliyun.Plan) {
+	steps := plan.Steps()
+	if len(steps) == 0 {
+		aliyun.Info("dry run, no changes needed")
+		return
+	}
+	aliyun.Text("dry run, the following changes were skipped:")
+	for i, st := range steps {
+		how := "simulated"
+		if st.Checked {
+			how = "validated"
+		}
+		aliyun.Text("  %2d. %-24s %s %s (%s)", i+1, st.Op, st.Detail, st.Target, how)
+	}
+}
+
+// printState prints the resources aliecs created that still exist.
+func printState(state *aliyun.State) {
+	schema := "| %-10s | %-24s | %-16s | %-11s | %-10s | %-17s |"
+	rowSeparator := "+------------+--------------------------+------------------+-------------+------------+-------------------+"
+	lines := []string{
+		rowSeparator,
+		fmt.Sprintf(schema, "Kind", "Id", "Name", "Region", "Profile", "Created"),
+		rowSeparator,
+	}
+	for _, r := range state.Live("") {
+		lines = append(lines, fmt.Sprintf(schema, r.Kind, r.Id, r.Name, r.Region, r.Profile, r.Created.Format("2006-01-02 15:04")))
+	}
+	lines = append(lines, rowSeparator)
+	aliyun.Text(strings.Join(lines, "\n"))
+}
+
+// runCmds runs provisioning steps on ip and prints a summary of how each
+// one went. The error is the first failed step.
+func runCmds(ctx context.Context, ip string, sshCfg aliyun.SSHConfig, cmds []string, opts aliyun.StepOptions) error {
+	if plan != nil {
+		for _, cmd := range cmds {
+			plan.Add(aliyun.PlanStep{Op: "ssh", Target: ip, Detail: "run step " + aliyun.StepName(cmd) + " on"})
+		}
+		return nil
+	}
+
+	s, err := aliyun.NewSSHSession(ctx, ip, sshCfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	out := aliyun.NewLineWriter(func(line string) {
+		aliyun.Text("%s", line)
+	})
+	opts.Output = out
+	results, err := s.RunSteps(ctx, cmds, opts)
+	out.Flush()
+
+	schema := "| %-3s | %-24s | %-7s | %-4s | %-10s |"
+	rowSeparator := "+-----+--------------------------+---------+------+------------+"
+	lines := []string{
+		rowSeparator,
+		fmt.Sprintf(schema, "#", "Step", "Status", "Exit", "Duration"),
+		rowSeparator,
+	}
+	for i, r := range results {
+		exit, dur := "", ""
+		if r.Status != aliyun.StepSkipped {
+			exit = strconv.Itoa(r.ExitCode)
+			dur = r.Duration.Round(time.Second).String()
+		}
+		lines = append(lines, fmt.Sprintf(schema, strconv.Itoa(i+1), r.Name, r.Status, exit, dur))
+	}
+	lines = append(lines, rowSeparator)
+	aliyun.Text(strings.Join(lines, "\n"))
+
+	return err
+}
+
+// exec runs args as a command on every target, streaming prefixed output
+// unless the results are wanted as JSON. It reports whether the command
+// succeeded everywhere.
+func exec(ctx context.Context, targets []ecs.Instance, args []string, opts aliyun.ExecOptions, jsonOut bool) bool {
+	if len(args) == 0 {
+		aliyun.Error("usage: exec <selector> -- <command>")
+		return false
+	}
+	cmd := strings.Join(args, " ")
+
+	execTargets := []aliyun.ExecTarget{}
+	for _, ins := range targets {
+		if len(ins.PublicIpAddress.IpAddress) == 0 {
+			aliyun.Warn("skipping %s, it has no public IP", ins.InstanceName)
+			continue
+		}
+		execTargets = append(execTargets, aliyun.ExecTarget{Name: ins.InstanceName, Host: ins.PublicIpAddress.IpAddress[0]})
+	}
+	if len(execTargets) == 0 {
+		aliyun.Error("no instance to run on")
+		return false
+	}
+
+	width := 0
+	for _, t := range execTargets {
+		if len(t.Name) > width {
+			width = len(t.Name)
+		}
+	}
+	if !jsonOut {
+		opts.Output = func(t aliyun.ExecTarget, stream, line string) {
+			if stream == "stderr" {
+				aliyun.TextErr("%-*s | %s", width, t.Name, line)
+			} else {
+				aliyun.Text("%-*s | %s", width, t.Name, line)
+			}
+		}
+	}
+
+	if plan != nil {
+		for _, t := range execTargets {
+			plan.Add(aliyun.PlanStep{Op: "ssh", Target: t.Name, Detail: "run `" + cmd + "` on"})
+		}
+		return true
+	}
+
+	results := aliyun.Exec(ctx, execTargets, cmd, opts)
+
+	ok := true
+	for _, r := range results {
+		ok = ok && r.OK()
+	}
+	if jsonOut {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			aliyun.Error("error encoding results: %v", err)
+			return false
+		}
+		aliyun.Text("%s", b)
+		return ok
+	}
+
+	if width < len("Instance") {
+		width = len("Instance")
+	}
+	schema := "%-*s  %-15s  %-4s  %-10s  %s"
+	aliyun.TextErr(schema, width, "Instance", "Public IP", "Exit", "Duration", "Error")
+	for _, r := range results {
+		aliyun.TextErr(schema, width, r.Name, r.Host, strconv.Itoa(r.ExitCode), r.Duration.Round(time.Millisecond).String(), r.Error)
+	}
+	return ok
+}
+
+// splitRemote splits "selector:path", where the selector itself may be a
+// "tag:key=value".
+func splitRemote(s string) (string, string, error) {
+	start := 0
+	if strings.HasPrefix(s, "tag:") {
+		start = len("tag:")
+	}
+	i := strings.Index(s[start:], ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("expecting <selector>:<path>, got %q", s)
+	}
+	return s[:start+i], s[start+i+1:], nil
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// transfer runs push or pull between a local path and an instance path.
+func transfer(ctx context.Context, op string, instances []ecs.Instance, sshCfg aliyun.SSHConfig, args []string, opts aliyun.TransferOptions, prog *aliyun.Progress) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <local> <selector>:<path> or pull <selector>:<path> <local>", op)
+	}
+	remoteArg, local := args[1], args[0]
+	if op == "pull" {
+		remoteArg, local = args[0], args[1]
+	}
+	selStr, remote, err := splitRemote(remoteArg)
+	if err != nil {
+		return err
+	}
+	sel, err := aliyun.ParseSelector(selStr)
+	if err != nil {
+		return err
+	}
+	ins, err := sel.One(instances)
+	if err != nil {
+		return err
+	}
+	if ins == nil || len(ins.PublicIpAddress.IpAddress) == 0 {
+		return fmt.Errorf("no running instance with a public IP matches %s", sel)
+	}
+
+	if plan != nil {
+		if op == "push" {
+			plan.Add(aliyun.PlanStep{Op: op, Target: ins.InstanceName + ":" + remote, Detail: "copy " + local + " to"})
+		} else {
+			plan.Add(aliyun.PlanStep{Op: op, Target: local, Detail: "copy " + ins.InstanceName + ":" + remote + " to"})
+		}
+		return nil
+	}
+
+	task := prog.Task(op + " " + ins.InstanceName)
+	opts.Progress = func(file string, done, total int64) {
+		pct := int64(100)
+		if total > 0 {
+			pct = done * 100 / total
+		}
+		task.Message("%s %d%% %s/%s", filepath.Base(file), pct, humanBytes(done), humanBytes(total))
+	}
+
+	s, err := aliyun.NewSSHSession(ctx, ins.PublicIpAddress.IpAddress[0], sshCfg)
+	if err != nil {
+		task.Fail(err)
+		return err
+	}
+	defer s.Close()
+
+	var stats *aliyun.TransferStats
+	if op == "push" {
+		stats, err = s.Push(ctx, local, remote, opts)
+	} else {
+		stats, err = s.Pull(ctx, remote, local, opts)
+	}
+	if err != nil {
+		task.Fail(err)
+		return err
+	}
+	task.Done("%d file(s) copied, %d unchanged, %s", stats.Files, stats.Skipped, humanBytes(stats.Bytes))
 	return nil
 }
@@ -1,19 +1,61 @@
 package aliyun
 
-func InstallShadowsocks() string {
-	return "apt-get -y install wget && wget https://bootstrap.pypa.io/get-pip.py && python get-pip.py && pip install shadowsocks && echo '{ \"server\": \"0.0.0.0\", \"server_port\": 80, \"password\": \"123456\", \"timeout\": 300, \"method\": \"aes-256-cfb\" }' > /etc/shadowsocks.json && ssserver -c /etc/shadowsocks.json -d start"
-}
-
-func InstallUnixDev() string {
-	return `
-	curl -sL https://raw.githubusercontent.com/iamjinlei/env/master/unix_dev.sh | bash;
-	echo -e "\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n";
-	echo -e "**********************************\n";
-	echo -e "*   Unix Dev Installation done   *\n";
-	echo -e "**********************************\n";
-	`
-}
+// shadowsocksConfig renders /etc/shadowsocks.json, its Check compares the
+// file's hash so the password never shows up in a command line.
+const shadowsocksConfig = `(json (object "server" "0.0.0.0" "server_port" (atoi .Params.port) "password" .Params.password "timeout" 300 "method" .Params.method))`
 
-func InstallEthDev() string {
-	return "curl -sL https://raw.githubusercontent.com/iamjinlei/env/master/unix_eth.sh | bash"
+// builtinRecipes are always available. Recipes with the same name in the
+// recipe dir replace them.
+var builtinRecipes = []Recipe{
+	{
+		Name:        "unix-dev",
+		Description: "unix development environment from github.com/iamjinlei/env",
+		OS:          []OS{Ubuntu, CentOS},
+		Check:       "test -f /var/lib/aliecs/unix-dev.done",
+		Downloads: []Download{
+			{URL: "https://raw.githubusercontent.com/iamjinlei/env/master/unix_dev.sh", Path: "/var/lib/aliecs/unix_dev.sh"},
+		},
+		Script: `
+bash /var/lib/aliecs/unix_dev.sh
+touch /var/lib/aliecs/unix-dev.done
+echo -e "**********************************\n";
+echo -e "*   Unix Dev Installation done   *\n";
+echo -e "**********************************\n";
+`,
+	},
+	{
+		Name:        "eth-dev",
+		Description: "ethereum development tools from github.com/iamjinlei/env",
+		Depends:     []string{"unix-dev"},
+		OS:          []OS{Ubuntu, CentOS},
+		Check:       "test -f /var/lib/aliecs/eth-dev.done",
+		Downloads: []Download{
+			{URL: "https://raw.githubusercontent.com/iamjinlei/env/master/unix_eth.sh", Path: "/var/lib/aliecs/unix_eth.sh"},
+		},
+		Script: `
+bash /var/lib/aliecs/unix_eth.sh
+touch /var/lib/aliecs/eth-dev.done
+`,
+	},
+	{
+		Name:        "shadowsocks",
+		Description: "shadowsocks server",
+		OS:          []OS{Ubuntu},
+		Params: []RecipeParam{
+			{Name: "password", Description: "server password", Required: true},
+			{Name: "port", Description: "server port", Default: "80"},
+			{Name: "method", Description: "cipher", Default: "aes-256-cfb"},
+		},
+		Check: "command -v ssserver && echo '{{ sha256 " + shadowsocksConfig + " }}  /etc/shadowsocks.json' | sha256sum -c --status && pgrep -f ssserver",
+		Downloads: []Download{
+			{URL: "https://bootstrap.pypa.io/get-pip.py", Path: "/var/lib/aliecs/get-pip.py"},
+		},
+		Script: `
+apt-get -y install python
+python /var/lib/aliecs/get-pip.py
+pip install shadowsocks
+(umask 077 && printf '%s' {{ quote ` + shadowsocksConfig + ` }} > /etc/shadowsocks.json)
+ssserver -c /etc/shadowsocks.json -d restart
+`,
+	},
 }
@@ -2,7 +2,11 @@ package aliyun
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 var (
@@ -10,8 +14,40 @@ var (
 	ErrBadAccessKeySecret = errors.New("bad access key secret")
 	ErrBadRootPwd         = errors.New("bad root pasword")
 	ErrNoMatchingRegion   = errors.New("no matching region found for zone")
+	ErrBadProvisioner     = errors.New("bad provisioner, expecting ssh or cloud-init")
+	ErrNoMatchingProfile  = errors.New("no matching profile found")
+	ErrBadSpotStrategy    = errors.New("bad spot strategy, expecting NoSpot, SpotWithPriceLimit or SpotAsPriceGo")
+	ErrBadSpotPriceLimit  = errors.New("bad spot price limit, expecting a positive hourly price")
+	ErrSpotNotPostPaid    = errors.New("spot instances must be PostPaid")
+	ErrBadStoppedMode     = errors.New("bad stopped mode, expecting KeepCharging or StopCharging")
+	ErrStopChargingPaid   = errors.New("only PostPaid instances can stop charging")
+	ErrBadForceStopAfter  = errors.New("bad force stop delay, expecting a duration like 3m")
+	ErrBadCreditMode      = errors.New("bad credit mode, expecting Standard or Unlimited")
 )
 
+// Profile is a named provisioning setup: which recipes run on new instances
+// and with which parameters.
+type Profile struct {
+	Recipes []string
+	Params  map[string]string
+}
+
+var Profiles = map[string]Profile{
+	"bare":  {},
+	"dev":   {Recipes: []string{"unix-dev"}},
+	"eth":   {Recipes: []string{"eth-dev"}},
+	"proxy": {Recipes: []string{"shadowsocks"}},
+}
+
+// HomeDir is where aliecs keeps local files, ~/.aliecs unless ALIECS_HOME
+// is set.
+func HomeDir() string {
+	if d := os.Getenv("ALIECS_HOME"); d != "" {
+		return d
+	}
+	return filepath.Join(os.Getenv("HOME"), ".aliecs")
+}
+
 type Derived struct {
 	Region RegionId
 }
@@ -34,9 +70,12 @@ type EcsCfg struct {
 	AccessKeySecret string
 	KeyPairName     string
 	RootPwd         string
+	// InstanceName is the logical name `up` reuses when no selector is given.
+	InstanceName string
 
-	Zone                    ZoneId
-	InstanceType            InstanceType
+	Zone         ZoneId
+	InstanceType InstanceType
+	// Image is a public image id or the name of a catalog image.
 	Image                   ImageId
 	InstanceChargeType      InstanceChargeType
 	InternetChargeType      InternetChargeType
@@ -44,8 +83,33 @@ type EcsCfg struct {
 	InternetMaxBandwidthOut int
 	SystemDiskCategory      SystemDiskCategory
 	SystemDiskSize          int
+	DataDisks               []DataDisk
+	SpotStrategy            SpotStrategy
+	// SpotPriceLimit is the highest hourly price paid for a spot instance
+	// with SpotWithPriceLimit.
+	SpotPriceLimit float64
+	// CreditMode only applies to burstable instance types.
+	CreditMode CreditMode
+	// StoppedMode is how pay-as-you-go instances are stopped, the account
+	// default if empty.
+	StoppedMode StoppedMode
+	// ForceStopAfter is how long a graceful stop gets before the instance is
+	// forced off.
+	ForceStopAfter time.Duration
 
+	// Profile names the entry of Profiles whose recipes provision new
+	// instances.
+	Profile      string
+	Recipes      []string
+	RecipeParams map[string]string
+	// InitCmds run after the recipes.
 	InitCmds []string
+	// Provisioner selects how InitCmds are run on new instances.
+	Provisioner Provisioner
+	// UserData is a text/template rendered with UserDataVars and passed to new
+	// instances, either a cloud-config document or a shell script. With the
+	// cloud-init provisioner it defaults to a cloud-config running InitCmds.
+	UserData string
 
 	Derived Derived
 }
@@ -57,6 +121,7 @@ func NewEcsConfig() (*EcsCfg, error) {
 		AccessKeySecret: os.Getenv("ECS_ACCESS_KEY_SECRET"),
 		KeyPairName:     os.Getenv("ECS_KEY_PAIR_NAME"),
 		RootPwd:         os.Getenv("ECS_ROOT_PWD"),
+		InstanceName:    os.Getenv("ECS_INSTANCE_NAME"),
 		Zone:            ZoneHkC,
 		InstanceType:    T5c1m1,
 		//Image:           CentOsV706,
@@ -67,10 +132,63 @@ func NewEcsConfig() (*EcsCfg, error) {
 		InternetMaxBandwidthOut: 5,
 		SystemDiskCategory:      CloudSsd,
 		SystemDiskSize:          20,
+		SpotStrategy:            NoSpot,
+		ForceStopAfter:          3 * time.Minute,
+
+		Profile:     os.Getenv("ECS_PROFILE"),
+		Provisioner: ProvisionSSH,
+	}
 
-		InitCmds: []string{
-			InstallUnixDev(),
-		},
+	if c.Profile == "" {
+		c.Profile = "dev"
+	}
+	profile, found := Profiles[c.Profile]
+	if !found {
+		return nil, ErrNoMatchingProfile
+	}
+	c.Recipes = profile.Recipes
+	c.RecipeParams = profile.Params
+
+	if p := os.Getenv("ECS_PROVISIONER"); p != "" {
+		c.Provisioner = Provisioner(p)
+	}
+	if i := os.Getenv("ECS_IMAGE"); i != "" {
+		c.Image = ImageId(i)
+	}
+	if d := os.Getenv("ECS_DATA_DISKS"); d != "" {
+		disks, err := ParseDataDisks(d)
+		if err != nil {
+			return nil, err
+		}
+		c.DataDisks = disks
+	}
+	if s := os.Getenv("ECS_SPOT_STRATEGY"); s != "" {
+		c.SpotStrategy = SpotStrategy(s)
+	}
+	if p := os.Getenv("ECS_SPOT_PRICE_LIMIT"); p != "" {
+		limit, err := strconv.ParseFloat(p, 64)
+		if err != nil || limit <= 0 {
+			return nil, ErrBadSpotPriceLimit
+		}
+		c.SpotPriceLimit = limit
+	}
+	c.CreditMode = CreditMode(os.Getenv("ECS_CREDIT_MODE"))
+	if m := os.Getenv("ECS_STOPPED_MODE"); m != "" {
+		c.StoppedMode = StoppedMode(m)
+	}
+	if d := os.Getenv("ECS_FORCE_STOP_AFTER"); d != "" {
+		after, err := time.ParseDuration(d)
+		if err != nil || after < 0 {
+			return nil, ErrBadForceStopAfter
+		}
+		c.ForceStopAfter = after
+	}
+	if p := os.Getenv("ECS_USER_DATA_FILE"); p != "" {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		c.UserData = string(b)
 	}
 
 	if len(c.AccessKeyId) == 0 {
@@ -82,6 +200,28 @@ func NewEcsConfig() (*EcsCfg, error) {
 	if len(c.RootPwd) == 0 {
 		return nil, ErrBadRootPwd
 	}
+	if c.Provisioner != ProvisionSSH && c.Provisioner != ProvisionCloudInit {
+		return nil, ErrBadProvisioner
+	}
+	switch c.SpotStrategy {
+	case NoSpot, SpotAsPriceGo:
+	case SpotWithPriceLimit:
+		if c.SpotPriceLimit <= 0 {
+			return nil, ErrBadSpotPriceLimit
+		}
+	default:
+		return nil, ErrBadSpotStrategy
+	}
+	if c.SpotStrategy != NoSpot && c.InstanceChargeType != PostPaid {
+		return nil, ErrSpotNotPostPaid
+	}
+
+	if c.CreditMode != "" && c.CreditMode != CreditStandard && c.CreditMode != CreditUnlimited {
+		return nil, ErrBadCreditMode
+	}
+	if err := c.StoppedMode.Validate(c.InstanceChargeType); err != nil {
+		return nil, err
+	}
 
 	region, found := ZoneToRegion[c.Zone]
 	if !found {
@@ -89,10 +229,45 @@ func NewEcsConfig() (*EcsCfg, error) {
 	}
 
 	c.Derived.Region = region
+	if c.InstanceName == "" {
+		c.InstanceName = RegionToBr[region] + "-dev"
+	}
 
 	return c, nil
 }
 
+// Validate checks that instances of charge type can be stopped in mode m.
+func (m StoppedMode) Validate(charge InstanceChargeType) error {
+	switch m {
+	case "", KeepCharging:
+		return nil
+	case StopCharging:
+		if charge != PostPaid {
+			return ErrStopChargingPaid
+		}
+		return nil
+	}
+	return ErrBadStoppedMode
+}
+
+// ProvisionCmds renders the configured recipes followed by InitCmds. Values
+// in set override the profile's recipe parameters.
+func (c *EcsCfg) ProvisionCmds(b *RecipeBook, set map[string]string) ([]string, error) {
+	params := map[string]string{}
+	for k, v := range c.RecipeParams {
+		params[k] = v
+	}
+	for k, v := range set {
+		params[k] = v
+	}
+
+	cmds, err := b.Render(c.Recipes, ImageOS(c.Image), params)
+	if err != nil {
+		return nil, err
+	}
+	return append(cmds, c.InitCmds...), nil
+}
+
 func (c *EcsCfg) ToDomainCfg() *DomainCfg {
 	return &DomainCfg{
 		DryRun:          c.DryRun,
@@ -0,0 +1,55 @@
+package aliyun
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// ConsoleOutput returns what an instance last wrote to its serial console,
+// kernel messages and boot logs mostly, and when it was captured.
+func (c *EcsClient) ConsoleOutput(ctx context.Context, instanceId string) (string, time.Time, error) {
+	req := ecs.CreateGetInstanceConsoleOutputRequest()
+	req.InstanceId = instanceId
+	var resp *ecs.GetInstanceConsoleOutputResponse
+	err := c.api.call(ctx, "GetInstanceConsoleOutput", func() (err error) {
+		resp, err = c.ecs.GetInstanceConsoleOutput(req)
+		return
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	out, err := base64.StdEncoding.DecodeString(resp.ConsoleOutput)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("console output of %s: %v", instanceId, err)
+	}
+	updated, _ := time.Parse("2006-01-02T15:04:05Z", resp.LastUpdateTime)
+	// the console speaks CRLF
+	return strings.Replace(string(out), "\r\n", "\n", -1), updated, nil
+}
+
+// Screenshot returns a JPEG of an instance's screen. wakeUp sends a key
+// press first, in case a screensaver blanked it.
+func (c *EcsClient) Screenshot(ctx context.Context, instanceId string, wakeUp bool) ([]byte, error) {
+	req := ecs.CreateGetInstanceScreenshotRequest()
+	req.InstanceId = instanceId
+	req.WakeUp = requests.NewBoolean(wakeUp)
+	var resp *ecs.GetInstanceScreenshotResponse
+	err := c.api.call(ctx, "GetInstanceScreenshot", func() (err error) {
+		resp, err = c.ecs.GetInstanceScreenshot(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	img, err := base64.StdEncoding.DecodeString(resp.Screenshot)
+	if err != nil {
+		return nil, fmt.Errorf("screenshot of %s: %v", instanceId, err)
+	}
+	return img, nil
+}
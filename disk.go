@@ -0,0 +1,305 @@
+package aliyun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// TagDisk holds the name of a persistent data disk, which is also tagged
+// with the name of the instance it belongs to.
+const TagDisk = "aliecs:disk"
+
+var (
+	ErrBadDataDisk   = errors.New("bad data disk")
+	ErrDiskElsewhere = errors.New("persistent disk is in another zone")
+	ErrDiskInUse     = errors.New("persistent disk is attached to another instance")
+)
+
+// DataDisk is a data disk of new instances.
+type DataDisk struct {
+	Name     string             `json:"name"`
+	Size     int                `json:"size"`
+	Category SystemDiskCategory `json:"category,omitempty"`
+	// PerformanceLevel only applies to cloud_essd.
+	PerformanceLevel   PerformanceLevel `json:"performance_level,omitempty"`
+	Encrypted          bool             `json:"encrypted,omitempty"`
+	DeleteWithInstance bool             `json:"delete_with_instance"`
+	// MountPoint is where provisioning formats and mounts the disk, it is
+	// left alone if empty.
+	MountPoint string `json:"mount,omitempty"`
+	FsType     string `json:"fs,omitempty"`
+	// Persistent disks are created apart from the instance, survive del
+	// and are attached again by the next up of an instance with the same
+	// name.
+	Persistent bool `json:"persistent,omitempty"`
+}
+
+// ParseDataDisks reads data disks from a JSON array. Disks are deleted with
+// their instance unless persistent or told otherwise.
+func ParseDataDisks(s string) ([]DataDisk, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadDataDisk, err)
+	}
+	disks := []DataDisk{}
+	names := map[string]bool{}
+	for _, r := range raw {
+		d := DataDisk{Category: CloudEfficiency, DeleteWithInstance: true, FsType: "ext4"}
+		if err := json.Unmarshal(r, &d); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadDataDisk, err)
+		}
+		if d.Persistent {
+			d.DeleteWithInstance = false
+		}
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("%w: duplicate name %s", ErrBadDataDisk, d.Name)
+		}
+		names[d.Name] = true
+		disks = append(disks, d)
+	}
+	return disks, nil
+}
+
+func (d DataDisk) validate() error {
+	if !imageNameRe.MatchString(d.Name) {
+		return fmt.Errorf("%w: bad name %q", ErrBadDataDisk, d.Name)
+	}
+	if d.Size < 20 || d.Size > 32768 {
+		return fmt.Errorf("%w: %s: size must be 20-32768GB", ErrBadDataDisk, d.Name)
+	}
+	if d.PerformanceLevel != "" && d.Category != CloudEssd {
+		return fmt.Errorf("%w: %s: performance level needs cloud_essd", ErrBadDataDisk, d.Name)
+	}
+	if d.MountPoint != "" && !strings.HasPrefix(d.MountPoint, "/") {
+		return fmt.Errorf("%w: %s: mount point must be absolute", ErrBadDataDisk, d.Name)
+	}
+	return nil
+}
+
+// createInstanceDataDisks returns the disks created along with an instance,
+// the persistent ones are not.
+func createInstanceDataDisks(disks []DataDisk) []ecs.CreateInstanceDataDisk {
+	req := []ecs.CreateInstanceDataDisk{}
+	for _, d := range disks {
+		if d.Persistent {
+			continue
+		}
+		req = append(req, ecs.CreateInstanceDataDisk{
+			DiskName:           d.Name,
+			Size:               strconv.Itoa(d.Size),
+			Category:           string(d.Category),
+			PerformanceLevel:   string(d.PerformanceLevel),
+			Encrypted:          strconv.FormatBool(d.Encrypted),
+			DeleteWithInstance: strconv.FormatBool(d.DeleteWithInstance),
+		})
+	}
+	return req
+}
+
+// AttachedDisk is a data disk attached to an instance.
+type AttachedDisk struct {
+	DataDisk
+	Id string
+	// New is set if the disk was attached just now.
+	New bool
+}
+
+func (c *EcsClient) findPersistentDisk(ctx context.Context, name, disk string) (*ecs.Disk, error) {
+	disks, err := c.describeDisks(ctx, c.region)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range disks {
+		if tagValue(d.Tags.Tag, TagName) == name && tagValue(d.Tags.Tag, TagDisk) == disk {
+			return &disks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *EcsClient) createDisk(ctx context.Context, zone ZoneId, name string, d DataDisk) (string, error) {
+	req := ecs.CreateCreateDiskRequest()
+	req.RegionId = string(c.region)
+	req.ZoneId = string(zone)
+	req.DiskName = d.Name
+	req.Size = requests.NewInteger(d.Size)
+	req.DiskCategory = string(d.Category)
+	req.PerformanceLevel = string(d.PerformanceLevel)
+	req.Encrypted = requests.NewBoolean(d.Encrypted)
+	req.ClientToken = NewClientToken()
+	tags := []ecs.CreateDiskTag{{Key: TagManaged, Value: "true"}, {Key: TagName, Value: name}}
+	if d.Persistent {
+		req.DiskName = name + "-" + d.Name
+		tags = append(tags, ecs.CreateDiskTag{Key: TagDisk, Value: d.Name})
+	}
+	req.Tag = &tags
+
+	c.log.With(F("op", "create-disk"), F("zone", zone)).Debug("creating disk %v, %dGB %v", req.DiskName, d.Size, d.Category)
+	var resp *ecs.CreateDiskResponse
+	err := c.mutate(ctx, "CreateDisk", false, req.DiskName, fmt.Sprintf("create %dGB %s disk", d.Size, d.Category), func() (err error) {
+		resp, err = c.ecs.CreateDisk(req)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	c.record(func(s *State) {
+		r := s.Add(ResourceDisk, resp.DiskId, c.region)
+		r.Name = req.DiskName
+		r.Params = map[string]string{
+			"zone":          string(zone),
+			"size":          strconv.Itoa(d.Size),
+			"category":      string(d.Category),
+			"instance-name": name,
+		}
+		r.Event("created", "")
+	})
+	return resp.DiskId, c.waitDisk(ctx, resp.DiskId, "Available")
+}
+
+func (c *EcsClient) waitDisk(ctx context.Context, diskId, status string) error {
+	return WaitFor(ctx, "disk "+diskId, func(ctx context.Context) (bool, error) {
+		req := ecs.CreateDescribeDisksRequest()
+		req.RegionId = string(c.region)
+		req.DiskIds = `["` + diskId + `"]`
+		var resp *ecs.DescribeDisksResponse
+		err := c.api.call(ctx, "DescribeDisks", func() (err error) {
+			resp, err = c.ecs.DescribeDisks(req)
+			return
+		})
+		if err != nil || len(resp.Disks.Disk) == 0 {
+			return false, err
+		}
+		RecordState(ctx, resp.Disks.Disk[0].Status)
+		return resp.Disks.Disk[0].Status == status, nil
+	})
+}
+
+// AttachDisk attaches a disk to an instance in the same zone and waits for
+// it to be in use.
+func (c *EcsClient) AttachDisk(ctx context.Context, instanceId, diskId string, deleteWithInstance bool) error {
+	req := ecs.CreateAttachDiskRequest()
+	req.InstanceId = instanceId
+	req.DiskId = diskId
+	req.DeleteWithInstance = requests.NewBoolean(deleteWithInstance)
+
+	c.log.With(F("op", "attach-disk"), F("instance", instanceId)).Debug("attaching disk %v", diskId)
+	err := c.mutate(ctx, "AttachDisk", false, instanceId, "attach disk "+diskId+" to", func() error {
+		_, err := c.ecs.AttachDisk(req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.recordEvent(ResourceDisk, diskId, "attached", map[string]string{"instance": instanceId})
+	return c.waitDisk(ctx, diskId, "In_use")
+}
+
+// DetachDisk detaches a data disk from an instance, keeping it.
+func (c *EcsClient) DetachDisk(ctx context.Context, instanceId, diskId string) error {
+	req := ecs.CreateDetachDiskRequest()
+	req.InstanceId = instanceId
+	req.DiskId = diskId
+	req.DeleteWithInstance = requests.NewBoolean(false)
+
+	c.log.With(F("op", "detach-disk"), F("instance", instanceId)).Debug("detaching disk %v", diskId)
+	err := c.mutate(ctx, "DetachDisk", false, instanceId, "detach disk "+diskId+" from", func() error {
+		_, err := c.ecs.DetachDisk(req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.recordEvent(ResourceDisk, diskId, "detached", map[string]string{"instance": ""})
+	return c.waitDisk(ctx, diskId, "Available")
+}
+
+// EnsureDataDisks makes sure every data disk in disks is attached to ins,
+// creating the missing ones. A persistent disk left by an earlier instance
+// with the same name is attached again instead.
+func (c *EcsClient) EnsureDataDisks(ctx context.Context, ins *ecs.Instance, disks []DataDisk) ([]AttachedDisk, error) {
+	current, err := c.InstanceDisks(ctx, ins.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]ecs.Disk{}
+	for _, d := range current {
+		name := tagValue(d.Tags.Tag, TagDisk)
+		if name == "" {
+			name = d.DiskName
+		}
+		byName[name] = d
+	}
+
+	attached := []AttachedDisk{}
+	for _, d := range disks {
+		if cur, ok := byName[d.Name]; ok {
+			attached = append(attached, AttachedDisk{DataDisk: d, Id: cur.DiskId})
+			continue
+		}
+
+		var disk *ecs.Disk
+		if d.Persistent {
+			if disk, err = c.findPersistentDisk(ctx, ins.InstanceName, d.Name); err != nil {
+				return attached, err
+			}
+		}
+		diskId := ""
+		if disk == nil {
+			diskId, err = c.createDisk(ctx, ZoneId(ins.ZoneId), ins.InstanceName, d)
+			if err != nil {
+				return attached, err
+			}
+		} else {
+			if disk.ZoneId != ins.ZoneId {
+				return attached, fmt.Errorf("%w: %s is in %s, %s in %s", ErrDiskElsewhere, d.Name, disk.ZoneId, ins.InstanceName, ins.ZoneId)
+			}
+			if disk.Status != "Available" {
+				return attached, fmt.Errorf("%w: %s is %s on %s", ErrDiskInUse, d.Name, disk.Status, disk.InstanceId)
+			}
+			diskId = disk.DiskId
+		}
+		if err := c.AttachDisk(ctx, ins.InstanceId, diskId, d.DeleteWithInstance); err != nil {
+			return attached, err
+		}
+		attached = append(attached, AttachedDisk{DataDisk: d, Id: diskId, New: true})
+	}
+	return attached, nil
+}
+
+// MountCmd is a provisioning step formatting the disk, unless it already
+// has a file system, and mounting it at boot.
+func (d AttachedDisk) MountCmd() string {
+	// virtio disks show up by their id, less the d- prefix
+	dev := "/dev/disk/by-id/virtio-" + strings.TrimPrefix(d.Id, "d-")
+	return fmt.Sprintf(`# mount disk %[1]s on %[2]s
+dev=%[3]s
+for i in $(seq 30); do [ -e "$dev" ] && break; sleep 2; done
+blkid "$dev" >/dev/null || mkfs -t %[4]s "$dev"
+uuid=$(blkid -s UUID -o value "$dev")
+mkdir -p %[2]s
+grep -q "UUID=$uuid" /etc/fstab || echo "UUID=$uuid %[2]s %[4]s defaults,nofail 0 2" >> /etc/fstab
+mountpoint -q %[2]s || mount %[2]s`, d.Name, d.MountPoint, dev, d.FsType)
+}
+
+// MountCmds returns the steps mounting disks that have a mount point.
+func MountCmds(disks []AttachedDisk) []string {
+	cmds := []string{}
+	for _, d := range disks {
+		if d.MountPoint != "" {
+			cmds = append(cmds, d.MountCmd())
+		}
+	}
+	return cmds
+}
@@ -0,0 +1,110 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/alidns"
+)
+
+// DnsClient manages records of domains hosted on Alibaba Cloud DNS.
+type DnsClient struct {
+	ecs *EcsClient
+	dns *alidns.Client
+}
+
+// DnsClient returns a DNS client sharing c's credentials, rate limiter and
+// dry run plan.
+func (c *EcsClient) DnsClient() (*DnsClient, error) {
+	d, err := alidns.NewClientWithAccessKey(string(c.region), c.config.AccessKeyId, c.config.AccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	return &DnsClient{ecs: c, dns: d}, nil
+}
+
+// FindRecord returns the record of type t for rr.domain, or nil if there is
+// none.
+func (c *DnsClient) FindRecord(ctx context.Context, domain, rr, t string) (*alidns.Record, error) {
+	req := alidns.CreateDescribeSubDomainRecordsRequest()
+	req.SubDomain = rr + "." + domain
+	req.Type = t
+
+	var resp *alidns.DescribeSubDomainRecordsResponse
+	err := c.ecs.api.call(ctx, "DescribeSubDomainRecords", func() (err error) {
+		resp, err = c.dns.DescribeSubDomainRecords(req)
+		return
+	})
+	if err != nil || len(resp.DomainRecords.Record) == 0 {
+		return nil, err
+	}
+	return &resp.DomainRecords.Record[0], nil
+}
+
+// Record returns the record with id, or nil if it no longer exists.
+func (c *DnsClient) Record(ctx context.Context, id string) (*alidns.DescribeDomainRecordInfoResponse, error) {
+	req := alidns.CreateDescribeDomainRecordInfoRequest()
+	req.RecordId = id
+
+	var resp *alidns.DescribeDomainRecordInfoResponse
+	err := c.ecs.api.call(ctx, "DescribeDomainRecordInfo", func() (err error) {
+		resp, err = c.dns.DescribeDomainRecordInfo(req)
+		return
+	})
+	if errors.Is(err, ErrResourceNotFound) {
+		return nil, nil
+	}
+	return resp, err
+}
+
+// SetARecord points rr.domain at ip, adding the record or updating it.
+func (c *DnsClient) SetARecord(ctx context.Context, domain, rr, ip string) error {
+	fqdn := rr + "." + domain
+	log := c.ecs.log.With(F("op", "dns"), F("record", fqdn))
+
+	r, err := c.FindRecord(ctx, domain, rr, "A")
+	if err != nil {
+		return err
+	}
+	if r != nil && r.Value == ip {
+		return nil
+	}
+
+	if r == nil {
+		req := alidns.CreateAddDomainRecordRequest()
+		req.DomainName = domain
+		req.RR = rr
+		req.Type = "A"
+		req.Value = ip
+		log.Debug("adding A record %v", ip)
+		var resp *alidns.AddDomainRecordResponse
+		err := c.ecs.mutate(ctx, "AddDomainRecord", false, fqdn, "set A record to "+ip+" for", func() (err error) {
+			resp, err = c.dns.AddDomainRecord(req)
+			return
+		})
+		if err == nil {
+			c.ecs.record(func(s *State) {
+				r := s.Add(ResourceDnsRecord, resp.RecordId, "")
+				r.Name = fqdn
+				r.setAttr("value", ip)
+				r.Event("created", "")
+			})
+		}
+		return err
+	}
+
+	req := alidns.CreateUpdateDomainRecordRequest()
+	req.RecordId = r.RecordId
+	req.RR = rr
+	req.Type = "A"
+	req.Value = ip
+	log.Debug("updating A record from %v to %v", r.Value, ip)
+	err = c.ecs.mutate(ctx, "UpdateDomainRecord", false, fqdn, "set A record to "+ip+" for", func() error {
+		_, err := c.dns.UpdateDomainRecord(req)
+		return err
+	})
+	if err == nil {
+		c.ecs.recordEvent(ResourceDnsRecord, r.RecordId, "updated", map[string]string{"value": ip})
+	}
+	return err
+}
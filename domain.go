@@ -1,6 +1,7 @@
 package aliyun
 
 import (
+	"context"
 	"strconv"
 
 	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
@@ -10,6 +11,8 @@ import (
 type DomainClient struct {
 	region RegionId
 	domain *domain.Client
+	api    *apiCaller
+	log    Logger
 }
 
 func NewDomainClient(config *DomainCfg) (*DomainClient, error) {
@@ -17,48 +20,144 @@ func NewDomainClient(config *DomainCfg) (*DomainClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DomainClient{region: config.Derived.Region, domain: c}, nil
+	log := DefaultLogger().With(F("region", config.Derived.Region))
+	return &DomainClient{
+		region: config.Derived.Region,
+		domain: c,
+		api:    newApiCaller(config.AccessKeyId, log),
+		log:    log,
+	}, nil
 }
 
-func (c *DomainClient) ListDomains() ([]domain.Domain, error) {
+func (c *DomainClient) ListDomains(ctx context.Context) ([]domain.Domain, error) {
 	req := domain.CreateQueryDomainListRequest()
 
 	req.PageNum = requests.NewInteger(0)
 	req.PageSize = requests.NewInteger(10)
 	req.OrderKeyType = "RegistrationDate"
 
-	resp, err := c.domain.QueryDomainList(req)
+	var resp *domain.QueryDomainListResponse
+	err := c.api.call(ctx, "QueryDomainList", func() (err error) {
+		resp, err = c.domain.QueryDomainList(req)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp.Data.Domain, nil
 }
 
-/*
- * 1：可注册；
- * 3：预登记；
- * 4：可删除预订；
- * 0：不可注册；
- * -1：异常；
- * -2：暂停注册；
- * -3：黑名单。
- */
-func (c *DomainClient) CheckDomain(d string) (string, int, string, int64, error) {
+// DomainPrice is the fee quoted for a single command/currency/period
+// combination.
+type DomainPrice struct {
+	Command  FeeCommand
+	Currency Currency
+	Period   int
+	Amount   int64
+}
+
+type DomainCheckResult struct {
+	DomainName   string
+	Status       DomainStatus
+	Reason       string
+	Premium      bool
+	DynamicCheck bool
+	Prices       []DomainPrice
+}
+
+// Price returns the quoted fee for the given combination, if it was requested.
+func (r *DomainCheckResult) Price(cmd FeeCommand, currency Currency, period int) (DomainPrice, bool) {
+	for _, p := range r.Prices {
+		if p.Command == cmd && p.Currency == currency && p.Period == period {
+			return p, true
+		}
+	}
+	return DomainPrice{}, false
+}
+
+// DomainCheckOptions selects which fees are quoted by CheckDomain. Every
+// combination of command, currency and period is queried. Empty fields
+// default to a one year registration fee in CNY.
+type DomainCheckOptions struct {
+	Commands   []FeeCommand
+	Currencies []Currency
+	Periods    []int
+}
+
+func (o *DomainCheckOptions) withDefaults() DomainCheckOptions {
+	r := DomainCheckOptions{
+		Commands:   []FeeCommand{FeeCreate},
+		Currencies: []Currency{CNY},
+		Periods:    []int{1},
+	}
+	if o == nil {
+		return r
+	}
+	if len(o.Commands) > 0 {
+		r.Commands = o.Commands
+	}
+	if len(o.Currencies) > 0 {
+		r.Currencies = o.Currencies
+	}
+	if len(o.Periods) > 0 {
+		r.Periods = o.Periods
+	}
+	return r
+}
+
+func (c *DomainClient) checkDomain(ctx context.Context, d string, cmd FeeCommand, currency Currency, period int) (*domain.CheckDomainResponse, error) {
 	req := domain.CreateCheckDomainRequest()
 
 	req.DomainName = d
-	req.FeeCurrency = "CNY"
-	req.FeeCommand = "create"
-	req.FeePeriod = requests.NewInteger(1)
+	req.FeeCurrency = string(currency)
+	req.FeeCommand = string(cmd)
+	req.FeePeriod = requests.NewInteger(period)
 
-	resp, err := c.domain.CheckDomain(req)
-	if err != nil {
-		return "", -1, "", 0, err
-	}
+	c.log.With(F("op", "check"), F("domain", d)).Debug("checking %v fee, %v %v year(s)", cmd, currency, period)
+	var resp *domain.CheckDomainResponse
+	err := c.api.call(ctx, "CheckDomain", func() (err error) {
+		resp, err = c.domain.CheckDomain(req)
+		return
+	})
+	return resp, err
+}
 
-	status, err := strconv.ParseInt(resp.Avail, 10, 64)
-	if err != nil {
-		return "", -1, "", 0, err
+func (c *DomainClient) CheckDomain(ctx context.Context, d string, opts *DomainCheckOptions) (*DomainCheckResult, error) {
+	o := opts.withDefaults()
+
+	var r *DomainCheckResult
+	for _, cmd := range o.Commands {
+		for _, currency := range o.Currencies {
+			for _, period := range o.Periods {
+				resp, err := c.checkDomain(ctx, d, cmd, currency, period)
+				if err != nil {
+					return nil, err
+				}
+
+				if r == nil {
+					status, err := strconv.ParseInt(resp.Avail, 10, 64)
+					if err != nil {
+						return nil, err
+					}
+					premium, _ := strconv.ParseBool(resp.Premium)
+					r = &DomainCheckResult{
+						DomainName:   resp.DomainName,
+						Status:       DomainStatus(status),
+						Reason:       resp.Reason,
+						Premium:      premium,
+						DynamicCheck: resp.DynamicCheck,
+					}
+				}
+
+				r.Prices = append(r.Prices, DomainPrice{
+					Command:  cmd,
+					Currency: currency,
+					Period:   period,
+					Amount:   resp.Price,
+				})
+			}
+		}
 	}
-	return resp.DomainName, int(status), resp.Reason, resp.Price, nil
+
+	return r, nil
 }
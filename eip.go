@@ -0,0 +1,103 @@
+package aliyun
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// Elastic IPs outlive instances, unlike the public IP BindPublicIp
+// allocates, so a fleet member keeps its address when it is re-created.
+
+// AllocateEip allocates an EIP in the client's region and returns its
+// allocation id and address.
+func (c *EcsClient) AllocateEip(ctx context.Context, bandwidth int) (string, string, error) {
+	req := ecs.CreateAllocateEipAddressRequest()
+	req.RegionId = string(c.region)
+	req.Bandwidth = strconv.Itoa(bandwidth)
+	req.InternetChargeType = "PayByTraffic"
+	req.ClientToken = NewClientToken()
+
+	c.log.With(F("op", "allocate-eip")).Debug("allocating eip, %dMbps", bandwidth)
+	var resp *ecs.AllocateEipAddressResponse
+	err := c.mutate(ctx, "AllocateEipAddress", false, "in "+string(c.region), "allocate eip", func() (err error) {
+		resp, err = c.ecs.AllocateEipAddress(req)
+		return
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	c.record(func(s *State) {
+		r := s.Add(ResourceEip, resp.AllocationId, c.region)
+		r.Name = resp.EipAddress
+		r.Params = map[string]string{"bandwidth": req.Bandwidth}
+		r.Event("allocated", "")
+	})
+	return resp.AllocationId, resp.EipAddress, nil
+}
+
+// waitEip waits for an EIP to settle in status, Available or InUse.
+func (c *EcsClient) waitEip(ctx context.Context, allocationId, status string) error {
+	return WaitFor(ctx, "eip "+allocationId, func(ctx context.Context) (bool, error) {
+		eip, err := c.describeEip(ctx, c.region, allocationId)
+		if err != nil || eip == nil {
+			return false, err
+		}
+		RecordState(ctx, eip.Status)
+		return eip.Status == status, nil
+	})
+}
+
+func (c *EcsClient) AssociateEip(ctx context.Context, allocationId, instanceId string) error {
+	if err := c.waitEip(ctx, allocationId, "Available"); err != nil {
+		return err
+	}
+	req := ecs.CreateAssociateEipAddressRequest()
+	req.AllocationId = allocationId
+	req.InstanceId = instanceId
+
+	c.log.With(F("op", "associate-eip"), F("instance", instanceId)).Debug("associating eip %v", allocationId)
+	err := c.mutate(ctx, "AssociateEipAddress", false, instanceId, "associate eip "+allocationId+" with", func() error {
+		_, err := c.ecs.AssociateEipAddress(req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.recordEvent(ResourceEip, allocationId, "associated", map[string]string{"instance": instanceId})
+	return c.waitEip(ctx, allocationId, "InUse")
+}
+
+func (c *EcsClient) UnassociateEip(ctx context.Context, allocationId, instanceId string) error {
+	req := ecs.CreateUnassociateEipAddressRequest()
+	req.AllocationId = allocationId
+	req.InstanceId = instanceId
+
+	c.log.With(F("op", "unassociate-eip"), F("instance", instanceId)).Debug("unassociating eip %v", allocationId)
+	err := c.mutate(ctx, "UnassociateEipAddress", false, instanceId, "unassociate eip "+allocationId+" from", func() error {
+		_, err := c.ecs.UnassociateEipAddress(req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.recordEvent(ResourceEip, allocationId, "unassociated", map[string]string{"instance": ""})
+	return c.waitEip(ctx, allocationId, "Available")
+}
+
+func (c *EcsClient) ReleaseEip(ctx context.Context, allocationId string) error {
+	req := ecs.CreateReleaseEipAddressRequest()
+	req.RegionId = string(c.region)
+	req.AllocationId = allocationId
+
+	err := c.mutate(ctx, "ReleaseEipAddress", false, allocationId, "release eip", func() error {
+		_, err := c.ecs.ReleaseEipAddress(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceEip, allocationId, "deleted", nil)
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package aliyun
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+)
+
+// Error classes for Alibaba Cloud API failures. APIError values match these
+// with errors.Is.
+var (
+	ErrThrottled               = errors.New("request throttled")
+	ErrServiceUnavailable      = errors.New("service unavailable")
+	ErrIncorrectStatus         = errors.New("resource in incorrect status")
+	ErrOperationConflict       = errors.New("conflicting operation in progress")
+	ErrResourceNotFound        = errors.New("resource not found")
+	ErrDryRunOperation         = errors.New("dry run succeeded")
+	ErrIdempotentParamMismatch = errors.New("client token reused with different parameters")
+	ErrNetwork                 = errors.New("network error")
+)
+
+// APIError is a classified Alibaba Cloud API failure.
+type APIError struct {
+	Op         string
+	Code       string
+	Message    string
+	RequestId  string
+	HttpStatus int
+
+	class error
+	err   error
+}
+
+func (e *APIError) Error() string {
+	if e.RequestId != "" {
+		return fmt.Sprintf("%s: %s: %s (request %s)", e.Op, e.Code, e.Message, e.RequestId)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Op, e.Code, e.Message)
+}
+
+// Is matches the error class, e.g. errors.Is(err, ErrThrottled).
+func (e *APIError) Is(target error) bool {
+	return e.class != nil && e.class == target
+}
+
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+var errorCodeClasses = []struct {
+	prefix string
+	class  error
+}{
+	{"Throttling", ErrThrottled},
+	{"ServiceUnavailable", ErrServiceUnavailable},
+	{"InternalError", ErrServiceUnavailable},
+	{"UnknownError", ErrServiceUnavailable},
+	{"IncorrectInstanceStatus", ErrIncorrectStatus},
+	{"IncorrectVpcStatus", ErrIncorrectStatus},
+	{"IncorrectVSwitchStatus", ErrIncorrectStatus},
+	{"IncorrectDiskStatus", ErrIncorrectStatus},
+	{"IncorrectStatus", ErrIncorrectStatus},
+	{"OperationConflict", ErrOperationConflict},
+	{"LastTokenProcessing", ErrOperationConflict},
+	{"InvalidInstanceId.NotFound", ErrResourceNotFound},
+	{"InvalidVpcId.NotFound", ErrResourceNotFound},
+	{"InvalidVSwitchId.NotFound", ErrResourceNotFound},
+	{"InvalidDiskId.NotFound", ErrResourceNotFound},
+	{"DomainRecordNotBelongToUser", ErrResourceNotFound},
+	{"DryRunOperation", ErrDryRunOperation},
+	{"IdempotentParameterMismatch", ErrIdempotentParamMismatch},
+}
+
+func classifyCode(code string) error {
+	for _, c := range errorCodeClasses {
+		if strings.HasPrefix(code, c.prefix) {
+			return c.class
+		}
+	}
+	return nil
+}
+
+// ClassifyError converts SDK errors into APIError. Other errors, including
+// context cancellation, are returned unchanged.
+func ClassifyError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var serr *sdkerrors.ServerError
+	if errors.As(err, &serr) {
+		return &APIError{
+			Op:         op,
+			Code:       serr.ErrorCode(),
+			Message:    serr.Message(),
+			RequestId:  serr.RequestId(),
+			HttpStatus: serr.HttpStatus(),
+			class:      classifyCode(serr.ErrorCode()),
+			err:        err,
+		}
+	}
+
+	var cerr *sdkerrors.ClientError
+	if errors.As(err, &cerr) {
+		e := &APIError{
+			Op:         op,
+			Code:       cerr.ErrorCode(),
+			Message:    cerr.Message(),
+			HttpStatus: cerr.HttpStatus(),
+			err:        err,
+		}
+		// client errors wrapping an origin error are transport failures
+		// (timeouts, resets), anything else is a local usage error
+		if cerr.ErrorCode() == sdkerrors.TimeoutErrorCode || cerr.OriginError() != nil {
+			e.class = ErrNetwork
+		}
+		return e
+	}
+
+	return err
+}
+
+// IsRetryable reports whether err is transient regardless of the operation.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrThrottled) ||
+		errors.Is(err, ErrServiceUnavailable) ||
+		errors.Is(err, ErrNetwork)
+}
@@ -0,0 +1,97 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+)
+
+func serverError(code string) error {
+	return sdkerrors.NewServerError(400, fmt.Sprintf(`{"Code": %q, "Message": "m", "RequestId": "r"}`, code), "")
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class error
+		retry bool
+	}{
+		{name: "throttled", err: serverError("Throttling.User"), class: ErrThrottled, retry: true},
+		{name: "internal", err: serverError("InternalError"), class: ErrServiceUnavailable, retry: true},
+		{name: "instance status", err: serverError("IncorrectInstanceStatus"), class: ErrIncorrectStatus},
+		{name: "not found", err: serverError("InvalidInstanceId.NotFound"), class: ErrResourceNotFound},
+		{name: "dry run", err: serverError("DryRunOperation"), class: ErrDryRunOperation},
+		{name: "token mismatch", err: serverError("IdempotentParameterMismatch"), class: ErrIdempotentParamMismatch},
+		{name: "unknown code", err: serverError("InvalidParameter")},
+		{name: "timeout", err: sdkerrors.NewClientError(sdkerrors.TimeoutErrorCode, "timed out", nil), class: ErrNetwork, retry: true},
+		{name: "connection reset", err: sdkerrors.NewClientError("SDK.ServerUnreachable", "reset", errors.New("connection reset by peer")), class: ErrNetwork, retry: true},
+		{name: "usage error", err: sdkerrors.NewClientError("SDK.InvalidParam", "bad", nil)},
+	}
+	classes := []error{ErrThrottled, ErrServiceUnavailable, ErrIncorrectStatus, ErrOperationConflict, ErrResourceNotFound, ErrDryRunOperation, ErrIdempotentParamMismatch, ErrNetwork}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ClassifyError("Op", tt.err)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %T, want *APIError", err)
+			}
+			for _, class := range classes {
+				if got, want := errors.Is(err, class), class == tt.class; got != want {
+					t.Errorf("errors.Is(err, %v) = %v, want %v", class, got, want)
+				}
+			}
+			if got := IsRetryable(err); got != tt.retry {
+				t.Errorf("IsRetryable = %v, want %v", got, tt.retry)
+			}
+		})
+	}
+}
+
+func TestClassifyErrorPassesThrough(t *testing.T) {
+	for _, err := range []error{nil, context.Canceled, context.DeadlineExceeded, errors.New("other")} {
+		if got := ClassifyError("Op", err); got != err {
+			t.Errorf("ClassifyError(%v) = %v", err, got)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	network := ClassifyError("Op", sdkerrors.NewClientError(sdkerrors.TimeoutErrorCode, "timed out", nil))
+	tests := []struct {
+		name   string
+		op     string
+		err    error
+		policy RetryPolicy
+		want   bool
+	}{
+		{name: "throttled mutation", op: "StartInstance", err: ClassifyError("Op", serverError("Throttling")), want: true},
+		{name: "lost read", op: "DescribeInstances", err: network, want: true},
+		{name: "lost create with token", op: "CreateInstance", err: network, want: true},
+		{name: "lost mutation without token", op: "StartInstance", err: network},
+		{name: "unavailable mutation without token", op: "DeleteInstance", err: ClassifyError("Op", serverError("ServiceUnavailable"))},
+		{name: "status not retried by default", op: "StartInstance", err: ClassifyError("Op", serverError("IncorrectInstanceStatus"))},
+		{name: "status retried by policy", op: "StartInstance", err: ClassifyError("Op", serverError("IncorrectInstanceStatus")), policy: RetryPolicy{RetryOn: []error{ErrIncorrectStatus}}, want: true},
+		{name: "cancelled", op: "DescribeInstances", err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.retryable(tt.op, tt.err); got != tt.want {
+				t.Errorf("retryable(%s, %v) = %v, want %v", tt.op, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	a, b := newApiCaller("key-a", DefaultLogger()), newApiCaller("key-a", DefaultLogger())
+	if a.limiter != b.limiter {
+		t.Error("clients of one account have their own rate limiters")
+	}
+	if c := newApiCaller("key-b", DefaultLogger()); c.limiter == a.limiter {
+		t.Error("clients of different accounts share a rate limiter")
+	}
+}
@@ -0,0 +1,124 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ExecTarget is a host a command is run on.
+type ExecTarget struct {
+	Name string
+	Host string
+}
+
+type ExecOptions struct {
+	SSH SSHConfig
+	// Timeout bounds the command on each host, not counting connecting.
+	Timeout time.Duration
+	// Concurrency is the number of hosts the command runs on at once, 10 by
+	// default.
+	Concurrency int
+	// Output is called for every line as it is printed, stream is "stdout"
+	// or "stderr".
+	Output func(target ExecTarget, stream, line string)
+}
+
+// ExecResult is the outcome of a command on one host. ExitCode is -1 if
+// the command didn't run to completion, Error tells why.
+type ExecResult struct {
+	Name     string        `json:"name"`
+	Host     string        `json:"host"`
+	ExitCode int           `json:"exit_code"`
+	Stdout   string        `json:"stdout"`
+	Stderr   string        `json:"stderr"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (r *ExecResult) OK() bool {
+	return r.Error == "" && r.ExitCode == 0
+}
+
+// Exec runs cmd on all targets concurrently. Results are in target order.
+func Exec(ctx context.Context, targets []ExecTarget, cmd string, opts ExecOptions) []ExecResult {
+	n := opts.Concurrency
+	if n <= 0 {
+		n = 10
+	}
+	sem := make(chan struct{}, n)
+	results := make([]ExecResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t ExecTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = execOne(ctx, t, cmd, opts)
+		}(i, t)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func execOne(ctx context.Context, t ExecTarget, cmd string, opts ExecOptions) (r ExecResult) {
+	r = ExecResult{Name: t.Name, Host: t.Host, ExitCode: -1, Started: time.Now()}
+	defer func() {
+		r.Duration = time.Since(r.Started)
+	}()
+
+	s, err := NewSSHSession(ctx, t.Host, opts.SSH)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer s.Close()
+
+	runCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	outW, errW := execWriter(t, "stdout", &stdout, opts.Output), execWriter(t, "stderr", &stderr, opts.Output)
+	err = s.Run(runCtx, cmd, nil, outW, errW)
+	outW.Flush()
+	errW.Flush()
+	r.Stdout = stdout.String()
+	r.Stderr = stderr.String()
+
+	switch e := err.(type) {
+	case nil:
+		r.ExitCode = 0
+	case *ssh.ExitError:
+		r.ExitCode = e.ExitStatus()
+	default:
+		if errors.Is(err, context.DeadlineExceeded) {
+			r.Error = "timed out after " + opts.Timeout.String()
+		} else {
+			r.Error = err.Error()
+		}
+	}
+	return r
+}
+
+// execWriter captures a stream while passing its lines on to fn.
+func execWriter(t ExecTarget, stream string, buf *bytes.Buffer, fn func(ExecTarget, string, string)) *LineWriter {
+	return NewLineWriter(func(line string) {
+		io.WriteString(buf, line+"\n")
+		if fn != nil {
+			fn(t, stream, line)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package aliyun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestExecOneRecordsDuration(t *testing.T) {
+	port := closedPort(t)
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		min     time.Duration
+	}{
+		{name: "connect retried until timeout", timeout: 300 * time.Millisecond, min: 300 * time.Millisecond},
+		{name: "connect gives up at once", timeout: time.Nanosecond, min: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := ExecOptions{SSH: SSHConfig{User: "root", Password: "x", Port: port, Timeout: tt.timeout}}
+			r := execOne(context.Background(), ExecTarget{Name: "dev", Host: "127.0.0.1"}, "true", opts)
+			if r.Error == "" || r.ExitCode != -1 {
+				t.Fatalf("got exit code %d, error %q, want a connect error", r.ExitCode, r.Error)
+			}
+			if r.Duration <= 0 || r.Duration < tt.min {
+				t.Errorf("duration %v, want at least %v and more than 0", r.Duration, tt.min)
+			}
+			if r.Name != "dev" || r.Host != "127.0.0.1" {
+				t.Errorf("got target %s/%s", r.Name, r.Host)
+			}
+		})
+	}
+}
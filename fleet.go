@@ -0,0 +1,655 @@
+package aliyun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// A fleet is a declarative set of instances, e.g. two build boxes in one
+// zone and a proxy with an EIP and DNS record in another. PlanFleet diffs it
+// against the instances tagged as its members and Apply converges them.
+
+const TagFleet = "aliecs:fleet"
+
+var (
+	ErrBadFleet = errors.New("bad fleet definition")
+)
+
+type FleetDNS struct {
+	Domain string `json:"domain"`
+	// RR is the host record, e.g. "proxy". Members of groups with more than
+	// one instance get "<rr>-<n>".
+	RR string `json:"rr"`
+}
+
+// FleetGroup is Count identical instances. Empty fields default to the
+// EcsCfg the fleet is applied with.
+type FleetGroup struct {
+	Name         string            `json:"name"`
+	Count        int               `json:"count"`
+	Zone         ZoneId            `json:"zone,omitempty"`
+	Profile      string            `json:"profile,omitempty"`
+	InstanceType InstanceType      `json:"instance_type,omitempty"`
+	Image        ImageId           `json:"image,omitempty"`
+	Params       map[string]string `json:"params,omitempty"`
+	Eip          bool              `json:"eip,omitempty"`
+	DNS          *FleetDNS         `json:"dns,omitempty"`
+}
+
+type Fleet struct {
+	Name   string       `json:"name"`
+	Groups []FleetGroup `json:"groups"`
+}
+
+// LoadFleet reads a JSON fleet definition.
+func LoadFleet(path string) (*Fleet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	fleet := &Fleet{}
+	if err := dec.Decode(fleet); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadFleet, path, err)
+	}
+	if err := fleet.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fleet, nil
+}
+
+func (f *Fleet) validate() error {
+	if f.Name == "" {
+		return fmt.Errorf("%w: missing name", ErrBadFleet)
+	}
+	names := map[string]bool{}
+	for _, g := range f.Groups {
+		if g.Count < 0 {
+			return fmt.Errorf("%w: group %s: negative count", ErrBadFleet, g.Name)
+		}
+		if g.Zone != "" {
+			if _, found := ZoneToRegion[g.Zone]; !found {
+				return fmt.Errorf("%w: group %s: %v %s", ErrBadFleet, g.Name, ErrNoMatchingRegion, g.Zone)
+			}
+		}
+		if g.Profile != "" {
+			if _, found := Profiles[g.Profile]; !found {
+				return fmt.Errorf("%w: group %s: %v %s", ErrBadFleet, g.Name, ErrNoMatchingProfile, g.Profile)
+			}
+		}
+		if g.DNS != nil && (g.DNS.Domain == "" || g.DNS.RR == "") {
+			return fmt.Errorf("%w: group %s: dns needs domain and rr", ErrBadFleet, g.Name)
+		}
+		for _, m := range g.members() {
+			sel, err := ParseSelector(m.name)
+			if err != nil {
+				return fmt.Errorf("%w: group %s: %v", ErrBadFleet, g.Name, err)
+			}
+			if _, err := sel.Name(); err != nil {
+				return fmt.Errorf("%w: group %s: %v", ErrBadFleet, g.Name, err)
+			}
+			if names[m.name] {
+				return fmt.Errorf("%w: instance name %s used twice", ErrBadFleet, m.name)
+			}
+			names[m.name] = true
+		}
+	}
+	return nil
+}
+
+type fleetMember struct {
+	group *FleetGroup
+	name  string
+	rr    string
+}
+
+func (g *FleetGroup) members() []fleetMember {
+	if g.Count == 1 {
+		m := fleetMember{group: g, name: g.Name}
+		if g.DNS != nil {
+			m.rr = g.DNS.RR
+		}
+		return []fleetMember{m}
+	}
+	members := []fleetMember{}
+	for i := 1; i <= g.Count; i++ {
+		m := fleetMember{group: g, name: fmt.Sprintf("%s-%d", g.Name, i)}
+		if g.DNS != nil {
+			m.rr = fmt.Sprintf("%s-%d", g.DNS.RR, i)
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+type FleetActionKind string
+
+const (
+	FleetCreate FleetActionKind = "create"
+	FleetUpdate FleetActionKind = "update"
+	FleetDelete FleetActionKind = "delete"
+)
+
+// FleetAction is one change of a fleet plan. It runs once all the actions
+// in Deps, indexes into the plan, succeeded.
+type FleetAction struct {
+	Kind     FleetActionKind
+	Resource ResourceKind
+	Name     string
+	Zone     ZoneId
+	Detail   string
+	Deps     []int
+
+	apply func(ctx context.Context) error
+}
+
+type FleetPlan struct {
+	Fleet   *Fleet
+	Actions []*FleetAction
+	// Steps is how members provisioned over SSH run their recipes.
+	Steps StepOptions
+	// Waiter bounds how long an action waits for an instance to change
+	// state, DefaultWaiter unless set.
+	Waiter Waiter
+}
+
+// fleetInstance tracks a member while the plan is applied, later actions
+// pick up the id and address of the instance an earlier one created.
+type fleetInstance struct {
+	plan   *FleetPlan
+	fleet  string
+	client *EcsClient
+	config *EcsCfg
+	member fleetMember
+	id     string
+	ip     string
+}
+
+type fleetPlanner struct {
+	c       *EcsClient
+	book    *RecipeBook
+	clients map[ZoneId]*EcsClient
+	plan    *FleetPlan
+}
+
+func (p *fleetPlanner) client(zone ZoneId) (*EcsClient, error) {
+	if c, found := p.clients[zone]; found {
+		return c, nil
+	}
+	c, err := p.c.ForRegion(zone)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[zone] = c
+	return c, nil
+}
+
+func (p *fleetPlanner) add(a *FleetAction) int {
+	p.plan.Actions = append(p.plan.Actions, a)
+	return len(p.plan.Actions) - 1
+}
+
+func instanceIp(ins *ecs.Instance) string {
+	if ins.EipAddress.IpAddress != "" {
+		return ins.EipAddress.IpAddress
+	}
+	if len(ins.PublicIpAddress.IpAddress) > 0 {
+		return ins.PublicIpAddress.IpAddress[0]
+	}
+	return ""
+}
+
+// PlanFleet diffs f against the instances tagged as its members, or managed
+// instances of the same name, across regions and returns the changes that
+// converge them. book renders the members' provisioning.
+func (c *EcsClient) PlanFleet(ctx context.Context, f *Fleet, regions []RegionId, book *RecipeBook) (*FleetPlan, error) {
+	all := []ecs.Instance{}
+	for _, region := range regions {
+		instances, err := c.DescribeInstances(ctx, region, "")
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, instances...)
+	}
+	p := &fleetPlanner{c: c, book: book, clients: map[ZoneId]*EcsClient{}, plan: &FleetPlan{Fleet: f, Waiter: DefaultWaiter}}
+	return p.diff(ctx, all)
+}
+
+// diff plans the changes converging instances to the fleet.
+func (p *fleetPlanner) diff(ctx context.Context, instances []ecs.Instance) (*FleetPlan, error) {
+	f := p.plan.Fleet
+	actual := map[string]*ecs.Instance{}
+	tagged := []*ecs.Instance{}
+	for i := range instances {
+		ins := &instances[i]
+		fleet, name := InstanceTag(ins, TagFleet), InstanceTag(ins, TagName)
+		if fleet == f.Name || (fleet == "" && InstanceTag(ins, TagManaged) == "true") {
+			actual[name] = ins
+		}
+		if fleet == f.Name {
+			tagged = append(tagged, ins)
+		}
+	}
+
+	desired := map[string]bool{}
+	for i := range f.Groups {
+		for _, m := range f.Groups[i].members() {
+			desired[m.name] = true
+			if err := p.planMember(ctx, m, actual[m.name]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, ins := range tagged {
+		if desired[InstanceTag(ins, TagName)] {
+			continue
+		}
+		client, err := p.client(ZoneId(ins.ZoneId))
+		if err != nil {
+			return nil, err
+		}
+		p.add(p.deleteAction(client, ins, "no longer in the fleet"))
+	}
+
+	return p.plan, nil
+}
+
+func (p *fleetPlanner) memberConfig(client *EcsClient, m fleetMember) (*EcsCfg, error) {
+	config := *client.config
+	g := m.group
+	if g.InstanceType != "" {
+		config.InstanceType = g.InstanceType
+	}
+	if g.Image != "" {
+		config.Image = g.Image
+	}
+	if g.Profile != "" {
+		profile := Profiles[g.Profile]
+		config.Profile = g.Profile
+		config.Recipes = profile.Recipes
+		config.RecipeParams = profile.Params
+	}
+	if client.FindImage(client.region, config.Image) != nil {
+		// baked images come provisioned
+		return &config, nil
+	}
+	cmds, err := config.ProvisionCmds(p.book, g.Params)
+	if err != nil {
+		return nil, fmt.Errorf("group %s: %v", g.Name, err)
+	}
+	config.InitCmds = cmds
+	return &config, nil
+}
+
+func (p *fleetPlanner) planMember(ctx context.Context, m fleetMember, ins *ecs.Instance) error {
+	zone := m.group.Zone
+	if zone == "" {
+		zone = p.c.config.Zone
+	}
+	client, err := p.client(zone)
+	if err != nil {
+		return err
+	}
+	config, err := p.memberConfig(client, m)
+	if err != nil {
+		return err
+	}
+	fi := &fleetInstance{plan: p.plan, fleet: p.plan.Fleet.Name, client: client, config: config, member: m}
+
+	// the action the member's eip and dns record wait for, if any
+	instanceAction := -1
+	var deps []int
+	if ins != nil && ZoneId(ins.ZoneId) != zone {
+		// instances can't move between zones, it is replaced from the zone
+		// it is in now
+		old, err := p.client(ZoneId(ins.ZoneId))
+		if err != nil {
+			return err
+		}
+		deps = append(deps, p.add(p.deleteAction(old, ins, "moving to "+string(zone))))
+		ins = nil
+	}
+
+	ip := ""
+	hasEip := false
+	switch {
+	case ins == nil:
+		instanceAction = p.add(&FleetAction{
+			Kind: FleetCreate, Resource: ResourceInstance, Name: m.name, Zone: zone, Deps: deps,
+			Detail: fmt.Sprintf("%s, %s, profile %s", config.InstanceType, config.Image, config.Profile),
+			apply:  fi.create,
+		})
+	default:
+		fi.id = ins.InstanceId
+		ip = instanceIp(ins)
+		fi.ip = ip
+		hasEip = ins.EipAddress.AllocationId != ""
+		if InstanceType(ins.InstanceType) != config.InstanceType {
+			instanceAction = p.add(&FleetAction{
+				Kind: FleetUpdate, Resource: ResourceInstance, Name: m.name, Zone: zone,
+				Detail: fmt.Sprintf("change type from %s to %s", ins.InstanceType, config.InstanceType),
+				apply:  fi.changeType,
+			})
+		} else if ins.Status != string(Running) {
+			instanceAction = p.add(&FleetAction{
+				Kind: FleetUpdate, Resource: ResourceInstance, Name: m.name, Zone: zone,
+				Detail: "start, it is " + ins.Status,
+				apply:  fi.start,
+			})
+		}
+	}
+
+	addressAction := instanceAction
+	if m.group.Eip && !hasEip {
+		var eipDeps []int
+		if instanceAction >= 0 {
+			eipDeps = []int{instanceAction}
+		}
+		addressAction = p.add(&FleetAction{
+			Kind: FleetCreate, Resource: ResourceEip, Name: m.name, Zone: zone, Deps: eipDeps,
+			Detail: fmt.Sprintf("%dMbps", config.InternetMaxBandwidthOut),
+			apply:  fi.attachEip,
+		})
+	}
+
+	if m.group.DNS == nil {
+		return nil
+	}
+	dns, err := client.DnsClient()
+	if err != nil {
+		return err
+	}
+	fqdn := m.rr + "." + m.group.DNS.Domain
+	record, err := dns.FindRecord(ctx, m.group.DNS.Domain, m.rr, "A")
+	if err != nil {
+		return err
+	}
+	kind := FleetCreate
+	if record != nil {
+		kind = FleetUpdate
+	}
+	apply := func(ctx context.Context) error {
+		if fi.ip == "" {
+			return fmt.Errorf("%s has no public address for %s", m.name, fqdn)
+		}
+		return dns.SetARecord(ctx, m.group.DNS.Domain, m.rr, fi.ip)
+	}
+	if addressAction >= 0 {
+		detail := "to the new address"
+		if record != nil {
+			detail = "from " + record.Value + " to the new address"
+		}
+		p.add(&FleetAction{Kind: kind, Resource: ResourceDnsRecord, Name: fqdn, Zone: zone, Deps: []int{addressAction}, Detail: detail, apply: apply})
+	} else if record == nil || record.Value != ip {
+		detail := "to " + ip
+		if record != nil {
+			detail = "from " + record.Value + " to " + ip
+		}
+		p.add(&FleetAction{Kind: kind, Resource: ResourceDnsRecord, Name: fqdn, Zone: zone, Detail: detail, apply: apply})
+	}
+	return nil
+}
+
+func (p *fleetPlanner) deleteAction(client *EcsClient, ins *ecs.Instance, reason string) *FleetAction {
+	id, eip := ins.InstanceId, ins.EipAddress.AllocationId
+	plan := p.plan
+	return &FleetAction{
+		Kind: FleetDelete, Resource: ResourceInstance, Name: InstanceTag(ins, TagName), Zone: ZoneId(ins.ZoneId),
+		Detail: id + ", " + reason,
+		apply: func(ctx context.Context) error {
+			if eip != "" {
+				if err := client.UnassociateEip(ctx, eip, id); err != nil {
+					return err
+				}
+				if err := client.ReleaseEip(ctx, eip); err != nil {
+					return err
+				}
+			}
+			if err := client.ensureStatus(ctx, plan.Waiter, id, Stopped); err != nil {
+				return err
+			}
+			return client.DeleteInstance(ctx, client.region, id)
+		},
+	}
+}
+
+// ensureStatus starts or stops an instance and waits with w for it to be
+// Running or Stopped.
+func (c *EcsClient) ensureStatus(ctx context.Context, w Waiter, id string, want InstanceStatus) error {
+	var requested time.Time
+	forced := false
+	return w.WaitFor(ctx, "instance "+id, func(ctx context.Context) (bool, error) {
+		ins, err := c.DescribeInstance(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if ins == nil {
+			return false, fmt.Errorf("instance %s: %w", id, ErrInstanceNotAvailable)
+		}
+		RecordState(ctx, ins.Status)
+		if ins.Status == string(want) {
+			return true, nil
+		}
+		if !requested.IsZero() {
+			// a graceful stop the OS ignores is followed by a forced one
+			if want == Stopped && !forced && time.Since(requested) > c.config.ForceStopAfter {
+				forced = true
+				opts := c.DefaultStopOptions(ins)
+				opts.Force = true
+				c.log.With(F("instance", id)).Warn("instance did not stop in %v, forcing it", c.config.ForceStopAfter)
+				return false, c.StopInstance(ctx, id, opts)
+			}
+			return false, nil
+		}
+		if ins.Status != string(Running) && ins.Status != string(Stopped) {
+			return false, nil
+		}
+		requested = time.Now()
+		if want == Running {
+			return false, c.StartInstance(ctx, id)
+		}
+		return false, c.StopInstance(ctx, id, c.DefaultStopOptions(ins))
+	})
+}
+
+func (fi *fleetInstance) create(ctx context.Context) error {
+	c, name := fi.client, fi.member.name
+	id, err := c.CreateInstance(ctx, fi.config, CreateOptions{
+		Name:        name,
+		ClientToken: c.InstanceClientToken(name),
+		Tags:        map[string]string{TagFleet: fi.fleet},
+	})
+	if err != nil {
+		return err
+	}
+	fi.id = id
+
+	if err := fi.plan.Waiter.WaitFor(ctx, "instance "+name, func(ctx context.Context) (bool, error) {
+		ins, err := c.DescribeInstance(ctx, id)
+		if err != nil || ins == nil {
+			return false, err
+		}
+		RecordState(ctx, ins.Status)
+		return ins.Status == string(Stopped), nil
+	}); err != nil {
+		return err
+	}
+	if !fi.member.group.Eip && fi.config.InternetMaxBandwidthOut > 0 {
+		if fi.ip, err = c.BindPublicIp(ctx, id); err != nil {
+			return err
+		}
+	}
+	if err := c.ensureStatus(ctx, fi.plan.Waiter, id, Running); err != nil {
+		return err
+	}
+	return fi.provision(ctx)
+}
+
+// provision runs the member's recipes over SSH, cloud-init gets them with
+// the user data instead.
+func (fi *fleetInstance) provision(ctx context.Context) error {
+	if fi.config.Provisioner != ProvisionSSH || len(fi.config.InitCmds) == 0 {
+		return nil
+	}
+	if fi.ip == "" {
+		return fmt.Errorf("%s has no public address to provision over", fi.member.name)
+	}
+	s, err := NewSSHSession(ctx, fi.ip, fi.config.RootSSHConfig())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	out := NewLineWriter(func(line string) {
+		Text("%s | %s", fi.member.name, line)
+	})
+	defer out.Flush()
+	opts := fi.plan.Steps
+	opts.Output = out
+	_, err = s.RunSteps(ctx, fi.config.InitCmds, opts)
+	return err
+}
+
+func (fi *fleetInstance) start(ctx context.Context) error {
+	return fi.client.ensureStatus(ctx, fi.plan.Waiter, fi.id, Running)
+}
+
+func (fi *fleetInstance) changeType(ctx context.Context) error {
+	c := fi.client
+	if err := c.ensureStatus(ctx, fi.plan.Waiter, fi.id, Stopped); err != nil {
+		return err
+	}
+	if err := c.ModifyInstanceType(ctx, fi.id, fi.config.InstanceType); err != nil {
+		return err
+	}
+	return c.ensureStatus(ctx, fi.plan.Waiter, fi.id, Running)
+}
+
+func (fi *fleetInstance) attachEip(ctx context.Context) error {
+	c := fi.client
+	allocationId, ip, err := c.AllocateEip(ctx, fi.config.InternetMaxBandwidthOut)
+	if err != nil {
+		return err
+	}
+	if err := c.AssociateEip(ctx, allocationId, fi.id); err != nil {
+		return err
+	}
+	fi.ip = ip
+	return nil
+}
+
+// FleetResult is how an action went. Actions skipped in dry run mode have
+// Err set to ErrDryRunOperation.
+type FleetResult struct {
+	Action   *FleetAction
+	Status   StepStatus
+	Duration time.Duration
+	Err      error
+}
+
+// Apply runs the plan, up to parallel actions at a time, each once its
+// dependencies succeeded. After a failure no new action is started, the
+// running ones finish and the rest is skipped. The error is the first
+// failure.
+func (p *FleetPlan) Apply(ctx context.Context, parallel int, progress func(r FleetResult)) ([]FleetResult, error) {
+	if parallel <= 0 {
+		parallel = 1
+	}
+	n := len(p.Actions)
+	results := make([]FleetResult, n)
+	for i, a := range p.Actions {
+		results[i].Action = a
+	}
+	started := make([]bool, n)
+	finished := make([]bool, n)
+
+	type done struct {
+		i   int
+		err error
+		d   time.Duration
+	}
+	doneCh := make(chan done)
+	running := 0
+	var firstErr error
+
+	for {
+		for i, a := range p.Actions {
+			if started[i] || running >= parallel || firstErr != nil || ctx.Err() != nil {
+				continue
+			}
+			ready := true
+			for _, d := range a.Deps {
+				if !finished[d] || results[d].Status != StepOK {
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+			started[i] = true
+			running++
+			go func(i int, a *FleetAction) {
+				start := time.Now()
+				err := a.apply(ctx)
+				doneCh <- done{i: i, err: err, d: time.Since(start)}
+			}(i, a)
+		}
+		if running == 0 {
+			break
+		}
+
+		d := <-doneCh
+		running--
+		finished[d.i] = true
+		r := &results[d.i]
+		r.Duration, r.Err = d.d, d.err
+		switch {
+		case d.err == nil:
+			r.Status = StepOK
+		case errors.Is(d.err, ErrDryRunOperation):
+			r.Status = StepSkipped
+		default:
+			r.Status = StepFailed
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s %s %s: %w", r.Action.Kind, r.Action.Resource, r.Action.Name, d.err)
+			}
+		}
+		if progress != nil {
+			progress(*r)
+		}
+	}
+
+	for i := range results {
+		if !started[i] {
+			results[i].Status = StepSkipped
+		}
+	}
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return results, firstErr
+}
+
+// Summary counts the actions of each kind, e.g. "2 to create, 1 to delete".
+func (p *FleetPlan) Summary() string {
+	counts := map[FleetActionKind]int{}
+	for _, a := range p.Actions {
+		counts[a.Kind]++
+	}
+	parts := []string{}
+	for _, k := range []FleetActionKind{FleetCreate, FleetUpdate, FleetDelete} {
+		parts = append(parts, fmt.Sprintf("%d to %s", counts[k], k))
+	}
+	return strings.Join(parts, ", ")
+}
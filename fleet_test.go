@@ -0,0 +1,126 @@
+package aliyun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+func fleetTestInstance(name, fleet string, zone ZoneId, t InstanceType, status InstanceStatus) ecs.Instance {
+	ins := ecs.Instance{
+		InstanceId:   "i-" + name,
+		InstanceName: name,
+		ZoneId:       string(zone),
+		InstanceType: string(t),
+		Status:       string(status),
+	}
+	ins.Tags.Tag = []ecs.Tag{{TagKey: TagManaged, TagValue: "true"}, {TagKey: TagName, TagValue: name}}
+	if fleet != "" {
+		ins.Tags.Tag = append(ins.Tags.Tag, ecs.Tag{TagKey: TagFleet, TagValue: fleet})
+	}
+	return ins
+}
+
+// describe renders actions as "kind resource name zone deps", one per line.
+func describe(actions []*FleetAction) string {
+	lines := []string{}
+	for _, a := range actions {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s %v", a.Kind, a.Resource, a.Name, a.Zone, a.Deps))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestFleetDiff(t *testing.T) {
+	config := &EcsCfg{AccessKeyId: "id", AccessKeySecret: "secret", Zone: ZoneHkB, InstanceType: T5c1m1, Image: UbuntuV1604}
+	config.Derived.Region = RegionHk
+	c, err := NewEcsClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		groups    []FleetGroup
+		instances []ecs.Instance
+		want      []string
+	}{
+		{
+			name:   "nothing exists",
+			groups: []FleetGroup{{Name: "build", Count: 2}},
+			want: []string{
+				"create instance build-1 cn-hongkong-b []",
+				"create instance build-2 cn-hongkong-b []",
+			},
+		},
+		{
+			name:      "up to date",
+			groups:    []FleetGroup{{Name: "proxy", Count: 1}},
+			instances: []ecs.Instance{fleetTestInstance("proxy", "f", ZoneHkB, T5c1m1, Running)},
+		},
+		{
+			name:      "adopts a managed instance of the same name",
+			groups:    []FleetGroup{{Name: "proxy", Count: 1}},
+			instances: []ecs.Instance{fleetTestInstance("proxy", "", ZoneHkB, T5c1m1, Running)},
+		},
+		{
+			name:      "type changed",
+			groups:    []FleetGroup{{Name: "proxy", Count: 1, InstanceType: T5c1m2}},
+			instances: []ecs.Instance{fleetTestInstance("proxy", "f", ZoneHkB, T5c1m1, Running)},
+			want:      []string{"update instance proxy cn-hongkong-b []"},
+		},
+		{
+			name:      "stopped",
+			groups:    []FleetGroup{{Name: "proxy", Count: 1}},
+			instances: []ecs.Instance{fleetTestInstance("proxy", "f", ZoneHkB, T5c1m1, Stopped)},
+			want:      []string{"update instance proxy cn-hongkong-b []"},
+		},
+		{
+			name:      "moved to another zone",
+			groups:    []FleetGroup{{Name: "proxy", Count: 1, Zone: ZoneSgA}},
+			instances: []ecs.Instance{fleetTestInstance("proxy", "f", ZoneHkB, T5c1m1, Running)},
+			want: []string{
+				"delete instance proxy cn-hongkong-b []",
+				"create instance proxy ap-southeast-1c [0]",
+			},
+		},
+		{
+			name:   "scaled down",
+			groups: []FleetGroup{{Name: "build", Count: 1}},
+			instances: []ecs.Instance{
+				fleetTestInstance("build", "f", ZoneHkB, T5c1m1, Running),
+				fleetTestInstance("build-2", "f", ZoneHkB, T5c1m1, Running),
+				fleetTestInstance("other", "", ZoneHkB, T5c1m1, Running),
+			},
+			want: []string{"delete instance build-2 cn-hongkong-b []"},
+		},
+		{
+			name:   "eip waits for its instance",
+			groups: []FleetGroup{{Name: "proxy", Count: 1, Eip: true}},
+			want: []string{
+				"create instance proxy cn-hongkong-b []",
+				"create eip proxy cn-hongkong-b [0]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Fleet{Name: "f", Groups: tt.groups}
+			p := &fleetPlanner{c: c, book: NewRecipeBook(), clients: map[ZoneId]*EcsClient{}, plan: &FleetPlan{Fleet: f, Waiter: DefaultWaiter}}
+			plan, err := p.diff(context.Background(), tt.instances)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := describe(plan.Actions), strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("got actions\n%s\nwant\n%s", got, want)
+			}
+			for _, a := range plan.Actions {
+				if a.Kind == FleetDelete && p.clients[a.Zone] == nil {
+					t.Errorf("%s is deleted without a client for %s", a.Name, a.Zone)
+				}
+			}
+		})
+	}
+}
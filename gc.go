@@ -0,0 +1,286 @@
+package aliyun
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// Rough monthly list prices in CNY, good enough to tell which leftovers are
+// worth cleaning up, not to predict a bill.
+var (
+	diskMonthlyPricePerGB = map[string]float64{
+		"cloud":            0.3,
+		"cloud_efficiency": 0.35,
+		"cloud_ssd":        1.0,
+		"cloud_essd":       1.0,
+	}
+	snapshotMonthlyPricePerGB = 0.12
+	idleEipMonthlyPrice       = 14.4
+)
+
+// Orphan is a resource created by aliecs that no instance uses anymore.
+type Orphan struct {
+	Kind   ResourceKind
+	Id     string
+	Name   string
+	Region RegionId
+	Reason string
+	// MonthlyCost is an estimate in CNY, 0 for free resources that only
+	// count against quotas.
+	MonthlyCost float64
+}
+
+// gcOrder deletes dependents first, a vpc can't go before its vswitches.
+var gcOrder = map[ResourceKind]int{
+	ResourceSnapshot: 0,
+	ResourceDisk:     1,
+	ResourceEip:      2,
+	ResourceVSwitch:  3,
+	ResourceVpc:      4,
+}
+
+func (c *EcsClient) describeDisks(ctx context.Context, region RegionId) ([]ecs.Disk, error) {
+	disks := []ecs.Disk{}
+	for page := 1; ; page++ {
+		req := ecs.CreateDescribeDisksRequest()
+		req.RegionId = string(region)
+		req.PageSize = requests.NewInteger(100)
+		req.PageNumber = requests.NewInteger(page)
+		var resp *ecs.DescribeDisksResponse
+		err := c.api.call(ctx, "DescribeDisks", func() (err error) {
+			resp, err = c.ecs.DescribeDisks(req)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, resp.Disks.Disk...)
+		if len(disks) >= resp.TotalCount || len(resp.Disks.Disk) == 0 {
+			return disks, nil
+		}
+	}
+}
+
+func (c *EcsClient) describeSnapshots(ctx context.Context, region RegionId) ([]ecs.Snapshot, error) {
+	snapshots := []ecs.Snapshot{}
+	for page := 1; ; page++ {
+		req := ecs.CreateDescribeSnapshotsRequest()
+		req.RegionId = string(region)
+		req.PageSize = requests.NewInteger(100)
+		req.PageNumber = requests.NewInteger(page)
+		req.Tag = &[]ecs.DescribeSnapshotsTag{{Key: TagManaged, Value: "true"}}
+		var resp *ecs.DescribeSnapshotsResponse
+		err := c.api.call(ctx, "DescribeSnapshots", func() (err error) {
+			resp, err = c.ecs.DescribeSnapshots(req)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, resp.Snapshots.Snapshot...)
+		if len(snapshots) >= resp.TotalCount || len(resp.Snapshots.Snapshot) == 0 {
+			return snapshots, nil
+		}
+	}
+}
+
+func (c *EcsClient) describeEip(ctx context.Context, region RegionId, allocationId string) (*ecs.EipAddress, error) {
+	req := ecs.CreateDescribeEipAddressesRequest()
+	req.RegionId = string(region)
+	req.AllocationId = allocationId
+	var resp *ecs.DescribeEipAddressesResponse
+	err := c.api.call(ctx, "DescribeEipAddresses", func() (err error) {
+		resp, err = c.ecs.DescribeEipAddresses(req)
+		return
+	})
+	if err != nil || len(resp.EipAddresses.EipAddress) == 0 {
+		return nil, err
+	}
+	return &resp.EipAddresses.EipAddress[0], nil
+}
+
+func (c *EcsClient) describeEips(ctx context.Context, region RegionId) ([]ecs.EipAddress, error) {
+	eips := []ecs.EipAddress{}
+	for page := 1; ; page++ {
+		req := ecs.CreateDescribeEipAddressesRequest()
+		req.RegionId = string(region)
+		req.PageSize = requests.NewInteger(100)
+		req.PageNumber = requests.NewInteger(page)
+		var resp *ecs.DescribeEipAddressesResponse
+		err := c.api.call(ctx, "DescribeEipAddresses", func() (err error) {
+			resp, err = c.ecs.DescribeEipAddresses(req)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		eips = append(eips, resp.EipAddresses.EipAddress...)
+		if len(eips) >= resp.TotalCount || len(resp.EipAddresses.EipAddress) == 0 {
+			return eips, nil
+		}
+	}
+}
+
+func tagValue(tags []ecs.Tag, key string) string {
+	for _, t := range tags {
+		if t.TagKey == key {
+			return t.TagValue
+		}
+	}
+	return ""
+}
+
+// FindOrphans lists resources in regions that were created by aliecs, by
+// tag or according to the state, and are no longer attached to any
+// instance. They are ordered so they can be deleted one after another.
+func (c *EcsClient) FindOrphans(ctx context.Context, regions []RegionId) ([]Orphan, error) {
+	orphans := []Orphan{}
+	for _, region := range regions {
+		found, err := c.findOrphans(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, found...)
+	}
+	sortOrphans(orphans)
+	return orphans, nil
+}
+
+// sortOrphans puts orphans in gcOrder, keeping the order within a kind.
+func sortOrphans(orphans []Orphan) {
+	sort.SliceStable(orphans, func(i, j int) bool {
+		return gcOrder[orphans[i].Kind] < gcOrder[orphans[j].Kind]
+	})
+}
+
+func (c *EcsClient) findOrphans(ctx context.Context, region RegionId) ([]Orphan, error) {
+	instances, err := c.DescribeInstances(ctx, region, "")
+	if err != nil {
+		return nil, err
+	}
+	usedVpcs, usedVSwitches := map[string]bool{}, map[string]bool{}
+	for _, ins := range instances {
+		usedVpcs[ins.VpcAttributes.VpcId] = true
+		usedVSwitches[ins.VpcAttributes.VSwitchId] = true
+	}
+
+	orphans := []Orphan{}
+
+	disks, err := c.describeDisks(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	diskIds := map[string]bool{}
+	for _, d := range disks {
+		diskIds[d.DiskId] = true
+		// persistent disks wait for their instance to come back
+		if tagValue(d.Tags.Tag, TagManaged) != "true" || d.Status != "Available" || tagValue(d.Tags.Tag, TagDisk) != "" {
+			continue
+		}
+		orphans = append(orphans, Orphan{
+			Kind: ResourceDisk, Id: d.DiskId, Name: d.DiskName, Region: region,
+			Reason:      "not attached to any instance",
+			MonthlyCost: float64(d.Size) * diskMonthlyPricePerGB[d.Category],
+		})
+	}
+
+	snapshots, err := c.describeSnapshots(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		// snapshots backing an image go away with the image, and snapshot
+		// sets are backups kept until removed
+		if diskIds[s.SourceDiskId] || (s.Usage != "" && s.Usage != "none") || tagValue(s.Tags.Tag, TagSnapshotSet) != "" {
+			continue
+		}
+		size, _ := strconv.Atoi(s.SourceDiskSize)
+		orphans = append(orphans, Orphan{
+			Kind: ResourceSnapshot, Id: s.SnapshotId, Name: s.SnapshotName, Region: region,
+			Reason:      "source disk " + s.SourceDiskId + " is gone",
+			MonthlyCost: float64(size) * snapshotMonthlyPricePerGB,
+		})
+	}
+
+	if c.state == nil {
+		return orphans, nil
+	}
+
+	vSwitches, err := c.describeVSwitches(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	for _, sw := range vSwitches {
+		if usedVSwitches[sw.VSwitchId] {
+			// a vpc is in use as long as any of its vswitches is
+			usedVpcs[sw.VpcId] = true
+		}
+	}
+	for _, r := range c.state.Live("") {
+		if r.Region != region {
+			continue
+		}
+		switch r.Kind {
+		case ResourceVSwitch:
+			if !usedVSwitches[r.Id] {
+				orphans = append(orphans, Orphan{Kind: r.Kind, Id: r.Id, Name: r.Name, Region: region, Reason: "no instance in it"})
+			}
+		case ResourceVpc:
+			if !usedVpcs[r.Id] {
+				orphans = append(orphans, Orphan{Kind: r.Kind, Id: r.Id, Name: r.Name, Region: region, Reason: "no instance in it"})
+			}
+		case ResourceEip:
+			eip, err := c.describeEip(ctx, region, r.Id)
+			if err != nil {
+				return nil, err
+			}
+			if eip != nil && eip.Status == "Available" {
+				orphans = append(orphans, Orphan{
+					Kind: r.Kind, Id: r.Id, Name: eip.IpAddress, Region: region,
+					Reason:      "not associated with any instance",
+					MonthlyCost: idleEipMonthlyPrice,
+				})
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// DeleteOrphan deletes a resource found by FindOrphans.
+func (c *EcsClient) DeleteOrphan(ctx context.Context, o Orphan) error {
+	var err error
+	switch o.Kind {
+	case ResourceVSwitch:
+		return c.deleteVSwitch(ctx, o.Id)
+	case ResourceVpc:
+		return c.deleteVpc(ctx, o.Region, o.Id)
+	case ResourceDisk:
+		req := ecs.CreateDeleteDiskRequest()
+		req.DiskId = o.Id
+		err = c.mutate(ctx, "DeleteDisk", false, o.Id, "delete disk", func() error {
+			_, err := c.ecs.DeleteDisk(req)
+			return err
+		})
+	case ResourceSnapshot:
+		return c.DeleteSnapshot(ctx, o.Id)
+	case ResourceEip:
+		req := ecs.CreateReleaseEipAddressRequest()
+		req.RegionId = string(o.Region)
+		req.AllocationId = o.Id
+		err = c.mutate(ctx, "ReleaseEipAddress", false, o.Id, "delete eip", func() error {
+			_, err := c.ecs.ReleaseEipAddress(req)
+			return err
+		})
+	default:
+		return fmt.Errorf("can't delete %s %s", o.Kind, o.Id)
+	}
+	if err == nil {
+		c.recordEvent(o.Kind, o.Id, "deleted", nil)
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package aliyun
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortOrphans(t *testing.T) {
+	tests := []struct {
+		name    string
+		orphans []Orphan
+		want    string
+	}{
+		{
+			name: "vpc after its vswitch",
+			orphans: []Orphan{
+				{Kind: ResourceVpc, Id: "vpc-1"},
+				{Kind: ResourceVSwitch, Id: "vsw-1"},
+			},
+			want: "vsw-1 vpc-1",
+		},
+		{
+			name: "every kind",
+			orphans: []Orphan{
+				{Kind: ResourceVpc, Id: "vpc-1"},
+				{Kind: ResourceEip, Id: "eip-1"},
+				{Kind: ResourceVSwitch, Id: "vsw-1"},
+				{Kind: ResourceDisk, Id: "d-1"},
+				{Kind: ResourceSnapshot, Id: "s-1"},
+			},
+			want: "s-1 d-1 eip-1 vsw-1 vpc-1",
+		},
+		{
+			name: "regions keep their order within a kind",
+			orphans: []Orphan{
+				{Kind: ResourceVpc, Id: "vpc-hk", Region: RegionHk},
+				{Kind: ResourceVSwitch, Id: "vsw-hk", Region: RegionHk},
+				{Kind: ResourceVpc, Id: "vpc-sg", Region: RegionSg},
+				{Kind: ResourceVSwitch, Id: "vsw-sg", Region: RegionSg},
+			},
+			want: "vsw-hk vsw-sg vpc-hk vpc-sg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortOrphans(tt.orphans)
+			ids := []string{}
+			for _, o := range tt.orphans {
+				ids = append(ids, o.Id)
+			}
+			if got := strings.Join(ids, " "); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
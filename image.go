@@ -0,0 +1,385 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// The image catalog is the images aliecs created, as recorded in the state.
+// Images are grouped by a friendly name, every bake under the same name
+// adding a newer version, and EcsCfg.Image may be set to such a name to use
+// its newest version in the instance's region.
+
+// TagImage holds the friendly name of a catalog image.
+const TagImage = "aliecs:image"
+
+var (
+	ErrBadImageName = errors.New("bad image name, expecting 2-100 letters, digits, '.', '_' or '-' starting with a letter")
+	ErrNoSuchImage  = errors.New("no such image in the catalog")
+	ErrBadKeep      = errors.New("bad number of versions to keep, expecting at least 1")
+)
+
+var imageNameRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]{1,99}$`)
+
+// CatalogImage is a version of a catalog image and what it looks like in the
+// cloud.
+type CatalogImage struct {
+	Name    string
+	Id      ImageId
+	Region  RegionId
+	Created time.Time
+	// Status is empty if the image is gone.
+	Status   string
+	Progress string
+	Size     int
+	Shared   []string
+}
+
+// FindImage returns the catalog image in region with id image, or the
+// newest one called image, or nil if there is none.
+func (c *EcsClient) FindImage(region RegionId, image ImageId) *Resource {
+	if c.state == nil || image == "" {
+		return nil
+	}
+	var found *Resource
+	for _, r := range c.state.Live(ResourceImage) {
+		if r.Region != region {
+			continue
+		}
+		if r.Id == string(image) {
+			return r
+		}
+		if r.Name == string(image) {
+			// Live is ordered by creation, the last match is the newest
+			found = r
+		}
+	}
+	return found
+}
+
+// ImageOS is the OS of image, which may be a catalog image.
+func (c *EcsClient) ImageOS(region RegionId, image ImageId) OS {
+	if r := c.FindImage(region, image); r != nil {
+		return OS(r.Params["os"])
+	}
+	return ImageOS(image)
+}
+
+// clientFor returns a client for region, c itself if it is c's region.
+func (c *EcsClient) clientFor(region RegionId) (*EcsClient, error) {
+	if region == c.region {
+		return c, nil
+	}
+	for zone, r := range ZoneToRegion {
+		if r == region {
+			return c.ForRegion(zone)
+		}
+	}
+	return nil, ErrNoMatchingRegion
+}
+
+func (c *EcsClient) describeImages(ctx context.Context, ids []string) ([]ecs.Image, error) {
+	req := ecs.CreateDescribeImagesRequest()
+	req.RegionId = string(c.region)
+	req.ImageOwnerAlias = "self"
+	req.ImageId = strings.Join(ids, ",")
+	req.PageSize = requests.NewInteger(100)
+	var resp *ecs.DescribeImagesResponse
+	err := c.api.call(ctx, "DescribeImages", func() (err error) {
+		resp, err = c.ecs.DescribeImages(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Images.Image, nil
+}
+
+// describeOwnImages lists the account's images in region, whatever their
+// status.
+func (c *EcsClient) describeOwnImages(ctx context.Context, region RegionId) ([]ecs.Image, error) {
+	images := []ecs.Image{}
+	for page := 1; ; page++ {
+		req := ecs.CreateDescribeImagesRequest()
+		req.RegionId = string(region)
+		req.ImageOwnerAlias = "self"
+		req.Status = "Creating,Waiting,Available,UnAvailable,CreateFailed,Deprecated"
+		req.PageSize = requests.NewInteger(100)
+		req.PageNumber = requests.NewInteger(page)
+		var resp *ecs.DescribeImagesResponse
+		err := c.api.call(ctx, "DescribeImages", func() (err error) {
+			resp, err = c.ecs.DescribeImages(req)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, resp.Images.Image...)
+		if len(images) >= resp.TotalCount || len(resp.Images.Image) == 0 {
+			return images, nil
+		}
+	}
+}
+
+func (c *EcsClient) waitImage(ctx context.Context, w Waiter, id string) error {
+	return w.WaitFor(ctx, "image "+id, func(ctx context.Context) (bool, error) {
+		images, err := c.describeImages(ctx, []string{id})
+		if err != nil || len(images) == 0 {
+			return false, err
+		}
+		img := images[0]
+		RecordState(ctx, img.Status+" "+img.Progress)
+		switch img.Status {
+		case "Available":
+			return true, nil
+		case "CreateFailed", "UnAvailable":
+			return false, fmt.Errorf("image %s is %s", id, img.Status)
+		}
+		return false, nil
+	})
+}
+
+// createImage sends req, records the image under name with params and
+// waits for it to be available.
+func (c *EcsClient) createImage(ctx context.Context, w Waiter, req *ecs.CreateImageRequest, name, from string, params map[string]string) (ImageId, error) {
+	req.RegionId = string(c.region)
+	req.ImageName = name + "-" + time.Now().Format("20060102-1504")
+	req.ClientToken = NewClientToken()
+	tags := []ecs.CreateImageTag{{Key: TagManaged, Value: "true"}, {Key: TagImage, Value: name}}
+	if params["instance-name"] != "" {
+		tags = append(tags, ecs.CreateImageTag{Key: TagName, Value: params["instance-name"]})
+	}
+	req.Tag = &tags
+
+	c.log.With(F("op", "create-image")).Debug("creating image %v from %v", req.ImageName, from)
+	var resp *ecs.CreateImageResponse
+	err := c.mutate(ctx, "CreateImage", false, from, "create image "+req.ImageName+" from", func() (err error) {
+		resp, err = c.ecs.CreateImage(req)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	c.record(func(s *State) {
+		r := s.Add(ResourceImage, resp.ImageId, c.region)
+		r.Name = name
+		r.Params = params
+		r.setAttr("image-name", req.ImageName)
+		r.Event("created", "from %s", from)
+	})
+	return ImageId(resp.ImageId), c.waitImage(ctx, w, resp.ImageId)
+}
+
+// BakeImage creates a new version of the catalog image name from the system
+// disk of a stopped instance and waits for it to be available.
+func (c *EcsClient) BakeImage(ctx context.Context, w Waiter, ins *ecs.Instance, name string) (ImageId, error) {
+	if !imageNameRe.MatchString(name) {
+		return "", ErrBadImageName
+	}
+	req := ecs.CreateCreateImageRequest()
+	req.InstanceId = ins.InstanceId
+	req.Description = "baked by aliecs from " + ins.InstanceName
+	params := map[string]string{
+		"instance":      ins.InstanceId,
+		"instance-name": ins.InstanceName,
+		"base-image":    ins.ImageId,
+		"os":            string(c.ImageOS(c.region, ImageId(ins.ImageId))),
+	}
+	if c.state != nil {
+		if r := c.state.Get(ResourceInstance, ins.InstanceId); r != nil {
+			params["recipes"] = r.Params["recipes"]
+		}
+	}
+	return c.createImage(ctx, w, req, name, ins.InstanceId, params)
+}
+
+// ListImages returns every version of the catalog images, newest first
+// within a name.
+func (c *EcsClient) ListImages(ctx context.Context) ([]CatalogImage, error) {
+	if c.state == nil {
+		return nil, nil
+	}
+	byRegion := map[RegionId][]string{}
+	for _, r := range c.state.Live(ResourceImage) {
+		byRegion[r.Region] = append(byRegion[r.Region], r.Id)
+	}
+	found := map[string]ecs.Image{}
+	for region, ids := range byRegion {
+		rc, err := c.clientFor(region)
+		if err != nil {
+			return nil, err
+		}
+		// DescribeImages takes up to 100 ids at once
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > 100 {
+				n = 100
+			}
+			images, err := rc.describeImages(ctx, ids[:n])
+			if err != nil {
+				return nil, err
+			}
+			for _, img := range images {
+				found[img.ImageId] = img
+			}
+			ids = ids[n:]
+		}
+	}
+
+	list := []CatalogImage{}
+	for _, r := range c.state.Live(ResourceImage) {
+		ci := CatalogImage{Name: r.Name, Id: ImageId(r.Id), Region: r.Region, Created: r.Created}
+		if s := r.Attrs["shared"]; s != "" {
+			ci.Shared = strings.Split(s, ",")
+		}
+		if img, ok := found[r.Id]; ok {
+			ci.Status, ci.Progress, ci.Size = img.Status, img.Progress, img.Size
+		}
+		list = append(list, ci)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Created.After(list[j].Created)
+	})
+	return list, nil
+}
+
+// ShareImage lets other Alibaba Cloud accounts create instances from a
+// catalog image.
+func (c *EcsClient) ShareImage(ctx context.Context, image *Resource, accounts []string) error {
+	rc, err := c.clientFor(image.Region)
+	if err != nil {
+		return err
+	}
+	req := ecs.CreateModifyImageSharePermissionRequest()
+	req.RegionId = string(image.Region)
+	req.ImageId = image.Id
+	req.AddAccount = &accounts
+
+	err = rc.mutate(ctx, "ModifyImageSharePermission", false, image.Id, "share with "+strings.Join(accounts, ", ")+" image", func() error {
+		_, err := rc.ecs.ModifyImageSharePermission(req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.record(func(s *State) {
+		r := s.Get(ResourceImage, image.Id)
+		if r == nil {
+			return
+		}
+		shared := map[string]bool{}
+		for _, a := range strings.Split(r.Attrs["shared"], ",") {
+			shared[a] = a != ""
+		}
+		for _, a := range accounts {
+			shared[a] = true
+		}
+		all := []string{}
+		for a, ok := range shared {
+			if ok {
+				all = append(all, a)
+			}
+		}
+		sort.Strings(all)
+		r.setAttr("shared", strings.Join(all, ","))
+		r.Event("shared", "with %s", strings.Join(accounts, ", "))
+	})
+	return nil
+}
+
+// CopyImage copies a catalog image to another region, where it becomes a
+// version of the same name. The copy takes a while to become available.
+func (c *EcsClient) CopyImage(ctx context.Context, image *Resource, dest RegionId) (ImageId, error) {
+	rc, err := c.clientFor(image.Region)
+	if err != nil {
+		return "", err
+	}
+	req := ecs.CreateCopyImageRequest()
+	req.RegionId = string(image.Region)
+	req.ImageId = image.Id
+	req.DestinationRegionId = string(dest)
+	req.DestinationImageName = image.Attrs["image-name"]
+	req.Tag = &[]ecs.CopyImageTag{{Key: TagManaged, Value: "true"}, {Key: TagImage, Value: image.Name}}
+
+	var resp *ecs.CopyImageResponse
+	err = rc.mutate(ctx, "CopyImage", false, image.Id, "copy to "+string(dest)+" image", func() (err error) {
+		resp, err = rc.ecs.CopyImage(req)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	c.record(func(s *State) {
+		r := s.Add(ResourceImage, resp.ImageId, dest)
+		r.Name = image.Name
+		r.Params = map[string]string{}
+		for k, v := range image.Params {
+			r.Params[k] = v
+		}
+		r.Params["copied-from"] = image.Id
+		r.setAttr("image-name", image.Attrs["image-name"])
+		r.Event("created", "copied from %s in %s", image.Id, image.Region)
+	})
+	return ImageId(resp.ImageId), nil
+}
+
+// DeleteImage deletes a catalog image. Instances created from it keep
+// running.
+func (c *EcsClient) DeleteImage(ctx context.Context, image *Resource) error {
+	rc, err := c.clientFor(image.Region)
+	if err != nil {
+		return err
+	}
+	req := ecs.CreateDeleteImageRequest()
+	req.RegionId = string(image.Region)
+	req.ImageId = image.Id
+
+	err = rc.mutate(ctx, "DeleteImage", false, image.Id, "delete image", func() error {
+		_, err := rc.ecs.DeleteImage(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceImage, image.Id, "deleted", nil)
+	}
+	return err
+}
+
+// OldImages returns all but the keep newest versions of the catalog image
+// name in each region, oldest first, for DeleteImage to prune.
+func (c *EcsClient) OldImages(name string, keep int) ([]*Resource, error) {
+	if keep < 1 {
+		return nil, ErrBadKeep
+	}
+	if c.state == nil {
+		return nil, nil
+	}
+	byRegion := map[RegionId][]*Resource{}
+	for _, r := range c.state.Live(ResourceImage) {
+		if r.Name == name {
+			byRegion[r.Region] = append(byRegion[r.Region], r)
+		}
+	}
+	if len(byRegion) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchImage, name)
+	}
+
+	old := []*Resource{}
+	for _, versions := range byRegion {
+		// oldest first, as Live orders them
+		if len(versions) > keep {
+			old = append(old, versions[:len(versions)-keep]...)
+		}
+	}
+	return old, nil
+}
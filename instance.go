@@ -1,16 +1,27 @@
 package aliyun
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
-	"time"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
 )
 
 type EcsClient struct {
+	config *EcsCfg
 	region RegionId
 	ecs    *ecs.Client
+	api    *apiCaller
+	log    Logger
+	state  *State
+	types  *typeCatalog
+	dryRun bool
+	plan   *Plan
 }
 
 func NewEcsClient(config *EcsCfg) (*EcsClient, error) {
@@ -18,7 +29,45 @@ func NewEcsClient(config *EcsCfg) (*EcsClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &EcsClient{region: config.Derived.Region, ecs: c}, nil
+	log := DefaultLogger().With(F("region", config.Derived.Region))
+	return &EcsClient{
+		config: config,
+		region: config.Derived.Region,
+		ecs:    c,
+		api:    newApiCaller(config.AccessKeyId, log),
+		log:    log,
+		types:  &typeCatalog{},
+		dryRun: config.DryRun,
+		plan:   &Plan{},
+	}, nil
+}
+
+// ForRegion returns a client for the region of zone, sharing the rate
+// limiter, state and dry run plan with c. Its config uses zone.
+func (c *EcsClient) ForRegion(zone ZoneId) (*EcsClient, error) {
+	region, found := ZoneToRegion[zone]
+	if !found {
+		return nil, ErrNoMatchingRegion
+	}
+	config := *c.config
+	config.Zone = zone
+	config.Derived.Region = region
+
+	e, err := ecs.NewClientWithAccessKey(string(region), config.AccessKeyId, config.AccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	r := *c
+	r.config = &config
+	r.region = region
+	r.ecs = e
+	r.log = DefaultLogger().With(F("region", region))
+	return &r, nil
+}
+
+// Config is the configuration the client was created with.
+func (c *EcsClient) Config() *EcsCfg {
+	return c.config
 }
 
 const (
@@ -32,42 +81,65 @@ var (
 	ErrVSwitchCreation      = errors.New("unknown vswitch creation error")
 )
 
-func (c *EcsClient) describeVpcs(region RegionId) ([]ecs.Vpc, error) {
+func (c *EcsClient) describeVpcs(ctx context.Context, region RegionId) ([]ecs.Vpc, error) {
 	req := ecs.CreateDescribeVpcsRequest()
 	req.RegionId = string(region)
-	resp, err := c.ecs.DescribeVpcs(req)
+	var resp *ecs.DescribeVpcsResponse
+	err := c.api.call(ctx, "DescribeVpcs", func() (err error) {
+		resp, err = c.ecs.DescribeVpcs(req)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp.Vpcs.Vpc, err
 }
 
-func (c *EcsClient) createVpc(region RegionId) (string, error) {
+func (c *EcsClient) createVpc(ctx context.Context, region RegionId) (string, error) {
 	req := ecs.CreateCreateVpcRequest()
 	req.RegionId = string(region)
 	req.CidrBlock = vpcCidrBlock
-	resp, err := c.ecs.CreateVpc(req)
+	req.ClientToken = NewClientToken()
+	c.log.Debug("creating vpc %v", vpcCidrBlock)
+	var resp *ecs.CreateVpcResponse
+	err := c.mutate(ctx, "CreateVpc", false, vpcCidrBlock+" in "+string(region), "create vpc", func() (err error) {
+		resp, err = c.ecs.CreateVpc(req)
+		return
+	})
 	if err != nil {
 		return "", err
 	}
 
+	c.record(func(s *State) {
+		r := s.Add(ResourceVpc, resp.VpcId, region)
+		r.Params = map[string]string{"cidr": vpcCidrBlock}
+		r.Event("created", "")
+	})
 	return resp.VpcId, nil
 }
 
-func (c *EcsClient) deleteVpc(region RegionId, vpcId string) error {
+func (c *EcsClient) deleteVpc(ctx context.Context, region RegionId, vpcId string) error {
 	req := ecs.CreateDeleteVpcRequest()
 	req.RegionId = string(region)
 	req.VpcId = vpcId
-	_, err := c.ecs.DeleteVpc(req)
+	err := c.mutate(ctx, "DeleteVpc", false, vpcId, "delete vpc", func() error {
+		_, err := c.ecs.DeleteVpc(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceVpc, vpcId, "deleted", nil)
+	}
 	return err
 }
 
-func (c *EcsClient) ensureVpc(region RegionId) (string, error) {
-	ticker := time.NewTicker(time.Second)
-	for range ticker.C {
-		vpcs, err := c.describeVpcs(region)
+// ensureVpc waits for pending VPCs to settle and returns the first available
+// one, or "" if there is none.
+func (c *EcsClient) ensureVpc(ctx context.Context, region RegionId) (string, error) {
+	vpcId := ""
+	err := WaitFor(ctx, "vpc in "+string(region), func(ctx context.Context) (bool, error) {
+		vpcs, err := c.describeVpcs(ctx, region)
 		if err != nil {
-			return "", err
+			return false, err
 		}
 
 		hasPending := false
@@ -75,55 +147,79 @@ func (c *EcsClient) ensureVpc(region RegionId) (string, error) {
 			if v.Status == "Pending" {
 				hasPending = true
 			} else if v.Status == "Available" {
-				return v.VpcId, nil
+				vpcId = v.VpcId
+				return true, nil
 			}
 		}
-
-		if !hasPending {
-			break
+		if hasPending {
+			RecordState(ctx, "Pending")
 		}
-	}
+		return !hasPending, nil
+	})
 
-	return "", nil
+	return vpcId, err
 }
 
-func (c *EcsClient) describeVSwitches(region RegionId) ([]ecs.VSwitch, error) {
+func (c *EcsClient) describeVSwitches(ctx context.Context, region RegionId) ([]ecs.VSwitch, error) {
 	req := ecs.CreateDescribeVSwitchesRequest()
 	req.RegionId = string(region)
-	resp, err := c.ecs.DescribeVSwitches(req)
+	var resp *ecs.DescribeVSwitchesResponse
+	err := c.api.call(ctx, "DescribeVSwitches", func() (err error) {
+		resp, err = c.ecs.DescribeVSwitches(req)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp.VSwitches.VSwitch, nil
 }
 
-func (c *EcsClient) createVSwitch(region RegionId, zone ZoneId, vpcId string) (string, error) {
+func (c *EcsClient) createVSwitch(ctx context.Context, region RegionId, zone ZoneId, vpcId string) (string, error) {
 	req := ecs.CreateCreateVSwitchRequest()
 	req.CidrBlock = vSwitchCidrBlock
+	req.ClientToken = NewClientToken()
 	req.VpcId = vpcId
 	req.ZoneId = string(zone)
 	req.RegionId = string(region)
-	resp, err := c.ecs.CreateVSwitch(req)
+	c.log.With(F("zone", zone)).Debug("creating vswitch %v in vpc %v", vSwitchCidrBlock, vpcId)
+	var resp *ecs.CreateVSwitchResponse
+	err := c.mutate(ctx, "CreateVSwitch", false, vSwitchCidrBlock+" in "+string(zone), "create vswitch", func() (err error) {
+		resp, err = c.ecs.CreateVSwitch(req)
+		return
+	})
 	if err != nil {
 		return "", err
 	}
 
+	c.record(func(s *State) {
+		r := s.Add(ResourceVSwitch, resp.VSwitchId, region)
+		r.Params = map[string]string{"cidr": vSwitchCidrBlock, "zone": string(zone), "vpc": vpcId}
+		r.Event("created", "")
+	})
 	return resp.VSwitchId, nil
 }
 
-func (c *EcsClient) deleteVSwitch(vSwitchId string) error {
+func (c *EcsClient) deleteVSwitch(ctx context.Context, vSwitchId string) error {
 	req := ecs.CreateDeleteVSwitchRequest()
 	req.VSwitchId = vSwitchId
-	_, err := c.ecs.DeleteVSwitch(req)
+	err := c.mutate(ctx, "DeleteVSwitch", false, vSwitchId, "delete vswitch", func() error {
+		_, err := c.ecs.DeleteVSwitch(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceVSwitch, vSwitchId, "deleted", nil)
+	}
 	return err
 }
 
-func (c *EcsClient) ensureVSwitch(region RegionId, zone ZoneId) (string, string, error) {
-	ticker := time.NewTicker(time.Second)
-	for range ticker.C {
-		vSwitches, err := c.describeVSwitches(region)
+// ensureVSwitch waits for pending vswitches to settle and returns the first
+// available one in zone, or "" if there is none.
+func (c *EcsClient) ensureVSwitch(ctx context.Context, region RegionId, zone ZoneId) (string, string, error) {
+	vpcId, vSwitchId := "", ""
+	err := WaitFor(ctx, "vswitch in "+string(zone), func(ctx context.Context) (bool, error) {
+		vSwitches, err := c.describeVSwitches(ctx, region)
 		if err != nil {
-			return "", "", err
+			return false, err
 		}
 
 		hasPending := false
@@ -131,29 +227,37 @@ func (c *EcsClient) ensureVSwitch(region RegionId, zone ZoneId) (string, string,
 			if s.Status == "Pending" {
 				hasPending = true
 			} else if s.Status == "Available" && s.ZoneId == string(zone) {
-				return s.VpcId, s.VSwitchId, nil
+				vpcId, vSwitchId = s.VpcId, s.VSwitchId
+				return true, nil
 			}
 		}
-
-		if !hasPending {
-			break
+		if hasPending {
+			RecordState(ctx, "Pending")
 		}
-	}
+		return !hasPending, nil
+	})
 
-	return "", "", nil
+	return vpcId, vSwitchId, err
 }
 
-func (c *EcsClient) ensureNetwork(region RegionId, zone ZoneId) (string, string, error) {
-	vpcId, err := c.ensureVpc(region)
+func (c *EcsClient) ensureNetwork(ctx context.Context, region RegionId, zone ZoneId) (string, string, error) {
+	vpcId, err := c.ensureVpc(ctx, region)
 	if err != nil {
 		return "", "", err
 	}
 	if vpcId == "" {
-		if _, err := c.createVpc(region); err != nil {
+		if _, err := c.createVpc(ctx, region); errors.Is(err, ErrDryRunOperation) {
+			// the vswitch would go into the new vpc, which has no id yet;
+			// unchecked creates only add to the plan, so none is sent
+			if _, err := c.createVSwitch(ctx, region, zone, ""); err != nil && !errors.Is(err, ErrDryRunOperation) {
+				return "", "", err
+			}
+			return "", "", ErrDryRunOperation
+		} else if err != nil {
 			return "", "", err
 		}
 	}
-	vpcId, err = c.ensureVpc(region)
+	vpcId, err = c.ensureVpc(ctx, region)
 	if err != nil {
 		return "", "", err
 	}
@@ -161,16 +265,16 @@ func (c *EcsClient) ensureNetwork(region RegionId, zone ZoneId) (string, string,
 		return "", "", ErrVpcCreation
 	}
 
-	vpcId2, vSwitchId, err := c.ensureVSwitch(region, zone)
+	vpcId2, vSwitchId, err := c.ensureVSwitch(ctx, region, zone)
 	if err != nil {
 		return "", "", err
 	}
 	if vSwitchId == "" {
-		if _, err := c.createVSwitch(region, zone, vpcId); err != nil {
+		if _, err := c.createVSwitch(ctx, region, zone, vpcId); err != nil {
 			return "", "", err
 		}
 	}
-	vpcId2, vSwitchId, err = c.ensureVSwitch(region, zone)
+	vpcId2, vSwitchId, err = c.ensureVSwitch(ctx, region, zone)
 	if err != nil {
 		return "", "", err
 	}
@@ -181,15 +285,54 @@ func (c *EcsClient) ensureNetwork(region RegionId, zone ZoneId) (string, string,
 	return vpcId, vSwitchId, nil
 }
 
-func (c *EcsClient) CreateInstance(config *EcsCfg, name string) (string, error) {
-	_, vSwitchId, err := c.ensureNetwork(config.Derived.Region, config.Zone)
+// CreateOptions holds per instance creation parameters that are not part of
+// the shared EcsCfg.
+type CreateOptions struct {
+	Name string
+	// ClientToken makes the call idempotent. A random token is used if empty.
+	ClientToken string
+	// Tags are added to the ones every aliecs instance gets.
+	Tags map[string]string
+	// DataDisks are created along with the instance instead of the
+	// configured ones.
+	DataDisks []ecs.CreateInstanceDataDisk
+}
+
+// InstanceClientToken is the ClientToken instances named name are created
+// with in c's region.
+func (c *EcsClient) InstanceClientToken(name string) string {
+	generation := 0
+	if c.state != nil {
+		var err error
+		if generation, err = c.state.Generation(c.region, name); err != nil {
+			c.log.Warn("error loading state: %v", err)
+		}
+	}
+	return InstanceClientToken(c.region, name, generation)
+}
+
+// InstanceGone records that the instance named name no longer exists, so
+// the next one gets a fresh ClientToken.
+func (c *EcsClient) InstanceGone(name string) {
+	c.record(func(s *State) {
+		s.nextGeneration(c.region, name)
+	})
+}
+
+func (c *EcsClient) CreateInstance(ctx context.Context, config *EcsCfg, opts CreateOptions) (string, error) {
+	name := opts.Name
+
+	_, vSwitchId, err := c.ensureNetwork(ctx, config.Derived.Region, config.Zone)
 	if err != nil {
-		return "", err
+		if !errors.Is(err, ErrDryRunOperation) {
+			return "", err
+		}
 	}
 
 	req := ecs.CreateCreateInstanceRequest()
 
 	// https://help.aliyun.com/document_detail/25499.html
+	req.RegionId = string(config.Derived.Region)
 	req.ZoneId = string(config.Zone)
 
 	req.InstanceType = string(config.InstanceType)
@@ -199,6 +342,9 @@ func (c *EcsClient) CreateInstance(config *EcsCfg, name string) (string, error)
 	req.Password = config.RootPwd
 
 	req.ImageId = string(config.Image)
+	if r := c.FindImage(config.Derived.Region, config.Image); r != nil {
+		req.ImageId = r.Id
+	}
 
 	req.KeyPairName = config.KeyPairName
 	req.InternetChargeType = string(config.InternetChargeType)
@@ -207,70 +353,235 @@ func (c *EcsClient) CreateInstance(config *EcsCfg, name string) (string, error)
 	req.VSwitchId = vSwitchId
 	req.SystemDiskCategory = string(config.SystemDiskCategory)
 	req.SystemDiskSize = requests.NewInteger(config.SystemDiskSize)
+	dataDisks := opts.DataDisks
+	if dataDisks == nil {
+		dataDisks = createInstanceDataDisks(config.DataDisks)
+	}
+	if len(dataDisks) > 0 {
+		req.DataDisk = &dataDisks
+	}
+	if config.SpotStrategy != "" && config.SpotStrategy != NoSpot {
+		req.SpotStrategy = string(config.SpotStrategy)
+		if config.SpotStrategy == SpotWithPriceLimit {
+			req.SpotPriceLimit = requests.NewFloat(config.SpotPriceLimit)
+		}
+	}
 
-	req.CreditSpecification = "Unlimited"
-	req.DryRun = requests.NewBoolean(config.DryRun)
+	userData, err := config.userData(name)
+	if err != nil {
+		return "", err
+	}
+	if userData != "" {
+		req.UserData = base64.StdEncoding.EncodeToString([]byte(userData))
+	}
 
-	resp, err := c.ecs.CreateInstance(req)
+	// non-burstable types reject it
+	burstable, err := c.Burstable(ctx, config.InstanceType)
 	if err != nil {
 		return "", err
 	}
+	if burstable {
+		req.CreditSpecification = string(config.CreditMode)
+	}
+	req.DryRun = requests.NewBoolean(c.dryRun)
+	tags := []ecs.CreateInstanceTag{
+		{Key: TagManaged, Value: "true"},
+		{Key: TagName, Value: name},
+	}
+	for k, v := range opts.Tags {
+		tags = append(tags, ecs.CreateInstanceTag{Key: k, Value: v})
+	}
+	req.Tag = &tags
+
+	// the token stays the same across retries so a request that timed out
+	// but succeeded server side is not turned into a second instance
+	req.ClientToken = opts.ClientToken
+	if req.ClientToken == "" {
+		req.ClientToken = NewClientToken()
+	}
 
+	c.log.With(F("op", "create"), F("zone", config.Zone)).Debug("creating instance %v", name)
+	var resp *ecs.CreateInstanceResponse
+	// without its network the request can't be validated, only simulated
+	checked := vSwitchId != ""
+	err = c.mutate(ctx, "CreateInstance", checked, name, "create "+string(config.InstanceType)+" instance", func() (err error) {
+		resp, err = c.ecs.CreateInstance(req)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	c.record(func(s *State) {
+		r := s.Add(ResourceInstance, resp.InstanceId, config.Derived.Region)
+		r.Name = name
+		r.Profile = config.Profile
+		r.Params = map[string]string{
+			"zone":          string(config.Zone),
+			"type":          string(config.InstanceType),
+			"image":         string(config.Image),
+			"charge-type":   string(config.InstanceChargeType),
+			"spot":          string(config.SpotStrategy),
+			"credit-mode":   req.CreditSpecification,
+			"bandwidth-out": strconv.Itoa(config.InternetMaxBandwidthOut),
+			"disk":          fmt.Sprintf("%s %dGB", config.SystemDiskCategory, config.SystemDiskSize),
+			"recipes":       strings.Join(config.Recipes, ","),
+			"provisioner":   string(config.Provisioner),
+			"client-token":  req.ClientToken,
+		}
+		r.setAttr("name", name)
+		r.setAttr("type", string(config.InstanceType))
+		r.Event("created", "")
+	})
 	return resp.InstanceId, nil
 }
 
-func (c *EcsClient) BindPublicIp(instanceId string) (string, error) {
+func (c *EcsClient) BindPublicIp(ctx context.Context, instanceId string) (string, error) {
 	if false {
 		return "", nil
 	}
 	req := ecs.CreateAllocatePublicIpAddressRequest()
 	req.InstanceId = instanceId
 
-	resp, err := c.ecs.AllocatePublicIpAddress(req)
+	c.log.With(F("op", "bind-ip"), F("instance", instanceId)).Debug("calling AllocatePublicIpAddress")
+	var resp *ecs.AllocatePublicIpAddressResponse
+	err := c.mutate(ctx, "AllocatePublicIpAddress", false, instanceId, "allocate public ip for", func() (err error) {
+		resp, err = c.ecs.AllocatePublicIpAddress(req)
+		return
+	})
 	if err != nil {
 		return "", err
 	}
+
+	c.record(func(s *State) {
+		region := RegionId("")
+		if ins := s.Get(ResourceInstance, instanceId); ins != nil {
+			region = ins.Region
+			ins.setAttr("public-ip", resp.IpAddress)
+		}
+		r := s.Add(ResourcePublicIp, resp.IpAddress, region)
+		r.setAttr("instance", instanceId)
+		r.Event("allocated", "for %s", instanceId)
+	})
 	return resp.IpAddress, nil
 }
 
-func (c *EcsClient) StartInstance(instanceId string) error {
+func (c *EcsClient) StartInstance(ctx context.Context, instanceId string) error {
 	req := ecs.CreateStartInstanceRequest()
 	req.InstanceId = instanceId
-
-	_, err := c.ecs.StartInstance(req)
+	req.DryRun = requests.NewBoolean(c.dryRun)
+
+	c.log.With(F("op", "start"), F("instance", instanceId)).Debug("calling StartInstance")
+	err := c.mutate(ctx, "StartInstance", true, instanceId, "start instance", func() error {
+		_, err := c.ecs.StartInstance(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, instanceId, "started", map[string]string{"status": "Running"})
+	}
 	return err
 }
 
-func (c *EcsClient) RebootInstance(instanceId string) error {
+func (c *EcsClient) RebootInstance(ctx context.Context, instanceId string) error {
 	req := ecs.CreateRebootInstanceRequest()
 	req.InstanceId = instanceId
-
-	_, err := c.ecs.RebootInstance(req)
+	req.DryRun = requests.NewBoolean(c.dryRun)
+
+	c.log.With(F("op", "reboot"), F("instance", instanceId)).Debug("calling RebootInstance")
+	err := c.mutate(ctx, "RebootInstance", true, instanceId, "reboot instance", func() error {
+		_, err := c.ecs.RebootInstance(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, instanceId, "rebooted", map[string]string{"status": "Running"})
+	}
 	return err
 }
 
-func (c *EcsClient) StopInstance(instanceId string) error {
+// StopOptions is how an instance is stopped.
+type StopOptions struct {
+	// Force cuts the power rather than shutting the OS down, which may leave
+	// file systems inconsistent.
+	Force bool
+	// Mode only applies to pay-as-you-go instances, the account's default
+	// is used if empty.
+	Mode StoppedMode
+}
+
+func (c *EcsClient) StopInstance(ctx context.Context, instanceId string, opts StopOptions) error {
 	req := ecs.CreateStopInstanceRequest()
 	req.InstanceId = instanceId
-	req.ForceStop = requests.NewBoolean(true)
+	req.DryRun = requests.NewBoolean(c.dryRun)
+	req.ForceStop = requests.NewBoolean(opts.Force)
+	req.StoppedMode = string(opts.Mode)
 
-	_, err := c.ecs.StopInstance(req)
+	detail := "stop instance"
+	if opts.Force {
+		detail = "force stop instance"
+	}
+	c.log.With(F("op", "stop"), F("instance", instanceId)).Debug("calling StopInstance, force %v, mode %v", opts.Force, opts.Mode)
+	err := c.mutate(ctx, "StopInstance", true, instanceId, detail, func() error {
+		_, err := c.ecs.StopInstance(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, instanceId, "stopped", map[string]string{"status": "Stopped", "stopped-mode": string(opts.Mode)})
+	}
 	return err
 }
 
-func (c *EcsClient) DeleteInstance(region RegionId, instanceId string) error {
+// DefaultStopOptions returns how ins is stopped: gracefully, in the
+// configured mode if it is pay-as-you-go.
+func (c *EcsClient) DefaultStopOptions(ins *ecs.Instance) StopOptions {
+	opts := StopOptions{}
+	if ins.InstanceChargeType == string(PostPaid) {
+		opts.Mode = c.config.StoppedMode
+	}
+	return opts
+}
+
+// StillCharging reports whether a stopped instance is still paying for its
+// vCPUs and memory.
+func StillCharging(ins *ecs.Instance) bool {
+	return ins.InstanceChargeType != string(PostPaid) || ins.StoppedMode != string(StopCharging)
+}
+
+func (c *EcsClient) DeleteInstance(ctx context.Context, region RegionId, instanceId string) error {
 	req := ecs.CreateDeleteInstanceRequest()
 	req.InstanceId = instanceId
 
-	_, err := c.ecs.DeleteInstance(req)
+	c.log.With(F("op", "delete"), F("instance", instanceId)).Debug("calling DeleteInstance")
+	err := c.mutate(ctx, "DeleteInstance", false, instanceId, "delete instance", func() error {
+		_, err := c.ecs.DeleteInstance(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, instanceId, "deleted", nil)
+		c.record(func(s *State) {
+			if r := s.Get(ResourceInstance, instanceId); r != nil && r.Name != "" {
+				s.nextGeneration(r.Region, r.Name)
+			}
+			for _, r := range s.Live(ResourcePublicIp) {
+				if r.Attrs["instance"] == instanceId {
+					r.Deleted = true
+					r.Event("released", "with %s", instanceId)
+				}
+			}
+		})
+	}
 	return err
 }
 
-func (c *EcsClient) DescribeInstances(region RegionId, ip string) ([]ecs.Instance, error) {
+func (c *EcsClient) DescribeInstances(ctx context.Context, region RegionId, ip string) ([]ecs.Instance, error) {
 	req := ecs.CreateDescribeInstancesRequest()
 	req.RegionId = string(region)
+	req.PageSize = requests.NewInteger(100)
 
-	resp, err := c.ecs.DescribeInstances(req)
+	var resp *ecs.DescribeInstancesResponse
+	err := c.api.call(ctx, "DescribeInstances", func() (err error) {
+		resp, err = c.ecs.DescribeInstances(req)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -288,3 +599,39 @@ func (c *EcsClient) DescribeInstances(region RegionId, ip string) ([]ecs.Instanc
 	}
 	return []ecs.Instance{}, nil
 }
+
+// DescribeInstance returns the instance with id in the client's region, or
+// nil if there is none.
+func (c *EcsClient) DescribeInstance(ctx context.Context, id string) (*ecs.Instance, error) {
+	req := ecs.CreateDescribeInstancesRequest()
+	req.RegionId = string(c.region)
+	req.InstanceIds = `["` + id + `"]`
+
+	var resp *ecs.DescribeInstancesResponse
+	err := c.api.call(ctx, "DescribeInstances", func() (err error) {
+		resp, err = c.ecs.DescribeInstances(req)
+		return
+	})
+	if err != nil || len(resp.Instances.Instance) == 0 {
+		return nil, err
+	}
+	return &resp.Instances.Instance[0], nil
+}
+
+// ModifyInstanceType changes the type of a stopped pay-as-you-go instance.
+func (c *EcsClient) ModifyInstanceType(ctx context.Context, instanceId string, t InstanceType) error {
+	req := ecs.CreateModifyInstanceSpecRequest()
+	req.InstanceId = instanceId
+	req.InstanceType = string(t)
+	req.ClientToken = NewClientToken()
+
+	c.log.With(F("op", "modify-spec"), F("instance", instanceId)).Debug("changing type to %v", t)
+	err := c.mutate(ctx, "ModifyInstanceSpec", false, instanceId, "change type to "+string(t)+" of", func() error {
+		_, err := c.ecs.ModifyInstanceSpec(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, instanceId, "modified", map[string]string{"type": string(t)})
+	}
+	return err
+}
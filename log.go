@@ -1,67 +1,391 @@
 package aliyun
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 )
 
 var (
 	green  = color.New(color.FgGreen).SprintFunc()
 	yellow = color.New(color.FgYellow).SprintFunc()
 	red    = color.New(color.FgRed).SprintFunc()
+	cyan   = color.New(color.FgCyan).SprintFunc()
 )
 
-type ProgressTracker struct {
-	state int
+func init() {
+	// color decides from stdout, but everything colored goes to stderr
+	color.NoColor = os.Getenv("TERM") == "dumb" || !IsTerminal(os.Stderr)
 }
 
-func NewProgressTracker() *ProgressTracker {
-	return &ProgressTracker{state: 0}
+var (
+	ErrBadLogLevel  = errors.New("bad log level")
+	ErrBadLogFormat = errors.New("bad log format")
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, ErrBadLogLevel
+}
+
+// Field is a structured key/value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+type Encoder interface {
+	Encode(e *Entry) []byte
+}
+
+// TextEncoder renders entries as "[LEVEL] message key=value ...".
+type TextEncoder struct {
+	Color bool
+}
+
+func (enc *TextEncoder) Encode(e *Entry) []byte {
+	lvl := e.Level.String()
+	if enc.Color {
+		switch e.Level {
+		case LevelDebug:
+			lvl = cyan(lvl)
+		case LevelInfo:
+			lvl = green(lvl)
+		case LevelWarn:
+			lvl = yellow(lvl)
+		case LevelError:
+			lvl = red(lvl)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("[")
+	b.WriteString(lvl)
+	b.WriteString(strings.Repeat(" ", 5-len(e.Level.String())))
+	b.WriteString("] ")
+	b.WriteString(e.Message)
+	for _, f := range e.Fields {
+		v := fmt.Sprint(fieldValue(f.Value))
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(v)
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// JSONEncoder renders each entry as a single line JSON object.
+type JSONEncoder struct{}
+
+func (enc *JSONEncoder) Encode(e *Entry) []byte {
+	m := map[string]interface{}{
+		"time":  e.Time.Format(time.RFC3339Nano),
+		"level": strings.ToLower(e.Level.String()),
+		"msg":   e.Message,
+	}
+	for _, f := range e.Fields {
+		m[f.Key] = fieldValue(f.Value)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  m["time"],
+			"level": m["level"],
+			"msg":   e.Message,
+			"error": err.Error(),
+		})
+	}
+	return append(b, '\n')
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+// Sink is a log destination with its own encoder and minimum level.
+type Sink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	enc   Encoder
+	level Level
+}
+
+func NewSink(w io.Writer, enc Encoder, level Level) *Sink {
+	return &Sink{w: w, enc: enc, level: level}
+}
+
+func (s *Sink) write(e *Entry) {
+	if e.Level < s.level {
+		return
+	}
+	b := s.enc.Encode(e)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(b)
+}
+
+// IsTerminal reports whether w is attached to a terminal.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// NewTextEncoder returns a text encoder which colors output only when w is
+// a terminal.
+func NewTextEncoder(w io.Writer) *TextEncoder {
+	return &TextEncoder{Color: IsTerminal(w)}
+}
+
+type Logger interface {
+	Debug(format string, a ...interface{})
+	Info(format string, a ...interface{})
+	Warn(format string, a ...interface{})
+	Error(format string, a ...interface{})
+	// With returns a logger that attaches the given fields to every entry.
+	With(fields ...Field) Logger
+}
+
+type logger struct {
+	level  Level
+	sinks  []*Sink
+	fields []Field
+}
+
+func NewLogger(level Level, sinks ...*Sink) Logger {
+	return &logger{level: level, sinks: sinks}
+}
+
+func (l *logger) log(level Level, format string, a ...interface{}) {
+	if level < l.level {
+		return
+	}
+	e := &Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: fmt.Sprintf(format, a...),
+		Fields:  l.fields,
+	}
+
+	writeOutput(func() {
+		for _, s := range l.sinks {
+			s.write(e)
+		}
+	})
+}
+
+func (l *logger) Debug(format string, a ...interface{}) { l.log(LevelDebug, format, a...) }
+func (l *logger) Info(format string, a ...interface{})  { l.log(LevelInfo, format, a...) }
+func (l *logger) Warn(format string, a ...interface{})  { l.log(LevelWarn, format, a...) }
+func (l *logger) Error(format string, a ...interface{}) { l.log(LevelError, format, a...) }
+
+func (l *logger) With(fields ...Field) Logger {
+	fs := make([]Field, 0, len(l.fields)+len(fields))
+	fs = append(fs, l.fields...)
+	fs = append(fs, fields...)
+	return &logger{level: l.level, sinks: l.sinks, fields: fs}
+}
+
+var (
+	// outputMu serializes everything written to the terminal so log lines
+	// never interleave with each other or with Text output.
+	outputMu sync.Mutex
+
+	stdLogger Logger = NewLogger(LevelInfo, NewSink(os.Stderr, NewTextEncoder(os.Stderr), LevelDebug))
+)
+
+func SetLogger(l Logger) {
+	stdLogger = l
+}
+
+func DefaultLogger() Logger {
+	return stdLogger
 }
 
-func (p *ProgressTracker) Info(format string, a ...interface{}) {
-	b := []interface{}{green("INFO")}
-	b = append(b, a...)
+// LogOptions describes how the default logger is set up.
+type LogOptions struct {
+	Level  Level
+	Format string // text or json
+	File   string // optional, logs are also appended to this file
+}
+
+func newEncoder(format string, w io.Writer) (Encoder, error) {
+	switch format {
+	case "", "text":
+		return NewTextEncoder(w), nil
+	case "json":
+		return &JSONEncoder{}, nil
+	}
+	return nil, ErrBadLogFormat
+}
+
+// SetupLogging replaces the default logger according to o. The returned
+// closer releases the log file, if any.
+func SetupLogging(o LogOptions) (io.Closer, error) {
+	enc, err := newEncoder(o.Format, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	sinks := []*Sink{NewSink(os.Stderr, enc, o.Level)}
 
-	if p.state > 0 {
-		fmt.Printf("\033[1A\033[100D")
+	var f *os.File
+	if o.File != "" {
+		f, err = os.OpenFile(o.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fenc, err := newEncoder(o.Format, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// files always capture everything down to debug
+		sinks = append(sinks, NewSink(f, fenc, LevelDebug))
 	}
 
-	var v string
-	switch p.state % 4 {
-	case 0:
-		v = "|"
-	case 1:
-		v = "/"
-	case 2:
-		v = "-"
-	case 3:
-		v = "\\"
+	min := o.Level
+	if f != nil {
+		min = LevelDebug
 	}
+	SetLogger(NewLogger(min, sinks...))
 
-	fmt.Printf("[%s ] "+format+" "+v+"\n", b...)
-	p.state++
+	if f == nil {
+		return nopCloser{}, nil
+	}
+	return f, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// LogFlags holds the logging related command line flags shared by the
+// commands.
+type LogFlags struct {
+	verbose *bool
+	quiet   *bool
+	format  *string
+	file    *string
 }
 
+func RegisterLogFlags(fs *flag.FlagSet) *LogFlags {
+	return &LogFlags{
+		verbose: fs.Bool("v", false, "verbose output, including debug logs"),
+		quiet:   fs.Bool("q", false, "quiet output, errors only"),
+		format:  fs.String("log-format", "text", "log format: text, json"),
+		file:    fs.String("log-file", "", "also append logs to this file"),
+	}
+}
+
+func (f *LogFlags) Options() LogOptions {
+	o := LogOptions{Level: LevelInfo, Format: *f.format, File: *f.file}
+	if *f.verbose {
+		o.Level = LevelDebug
+	} else if *f.quiet {
+		o.Level = LevelError
+	}
+	return o
+}
+
+// Setup configures the default logger from the parsed flags.
+func (f *LogFlags) Setup() (io.Closer, error) {
+	return SetupLogging(f.Options())
+}
+
+// Text writes plain, unleveled output such as tables to stdout.
 func Text(format string, a ...interface{}) {
-	fmt.Printf(format+"\n", a...)
+	writeOutput(func() {
+		fmt.Printf(format+"\n", a...)
+	})
+}
+
+// TextErr is Text written to stderr.
+func TextErr(format string, a ...interface{}) {
+	writeOutput(func() {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	})
+}
+
+func Debug(format string, a ...interface{}) {
+	stdLogger.Debug(format, a...)
 }
 
 func Info(format string, a ...interface{}) {
-	b := []interface{}{green("INFO")}
-	b = append(b, a...)
-	fmt.Printf("[%s ] "+format+"\n", b...)
+	stdLogger.Info(format, a...)
 }
 
 func Warn(format string, a ...interface{}) {
-	b := []interface{}{yellow("WARN")}
-	b = append(b, a...)
-	fmt.Printf("[%s ] "+format+"\n", b...)
+	stdLogger.Warn(format, a...)
 }
 
 func Error(format string, a ...interface{}) {
-	b := []interface{}{yellow("ERROR")}
-	b = append(b, a...)
-	fmt.Printf("[%s] "+format+"\n", b...)
+	stdLogger.Error(format, a...)
 }
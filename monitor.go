@@ -0,0 +1,253 @@
+package aliyun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+)
+
+// Metrics come from CloudMonitor. CPU, network and CPU credits are measured
+// by the hypervisor; memory and disk usage need the CloudMonitor agent on
+// the instance and are missing without it.
+
+const metricNamespace = "acs_ecs_dashboard"
+
+// Metric is an instance metric in CloudMonitor.
+type Metric struct {
+	Name   string
+	metric string
+	// Unit is %, bit/s or credits.
+	Unit string
+}
+
+var (
+	MetricCpu     = Metric{"cpu", "CPUUtilization", "%"}
+	MetricMemory  = Metric{"mem", "memory_usedutilization", "%"}
+	MetricDisk    = Metric{"disk", "diskusage_utilization", "%"}
+	MetricNetIn   = Metric{"net-in", "VPC_PublicIP_InternetInRate", "bit/s"}
+	MetricNetOut  = Metric{"net-out", "VPC_PublicIP_InternetOutRate", "bit/s"}
+	MetricCredits = Metric{"credits", "CPUCreditBalance", "credits"}
+
+	InstanceMetrics = []Metric{MetricCpu, MetricMemory, MetricDisk, MetricNetIn, MetricNetOut, MetricCredits}
+)
+
+// MetricPoint is a metric's value over the period starting at Time.
+type MetricPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series is the values of a metric, oldest first.
+type Series []MetricPoint
+
+// Last returns the latest value, false if there is none.
+func (s Series) Last() (float64, bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	return s[len(s)-1].Value, true
+}
+
+func (s Series) Max() float64 {
+	max := 0.0
+	for _, p := range s {
+		if p.Value > max {
+			max = p.Value
+		}
+	}
+	return max
+}
+
+// Sparkline draws the series in at most width block characters, averaging
+// neighbouring points if there are more.
+func (s Series) Sparkline(width int) string {
+	if len(s) == 0 || width <= 0 {
+		return ""
+	}
+	values := []float64{}
+	per := (len(s) + width - 1) / width
+	for i := 0; i < len(s); i += per {
+		sum, n := 0.0, 0
+		for j := i; j < i+per && j < len(s); j++ {
+			sum += s[j].Value
+			n++
+		}
+		values = append(values, sum/float64(n))
+	}
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	blocks := []rune("▁▂▃▄▅▆▇█")
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > min {
+			i = int((v - min) / (max - min) * float64(len(blocks)-1))
+		}
+		b.WriteRune(blocks[i])
+	}
+	return b.String()
+}
+
+// RunOut estimates when a draining balance reaches zero from its trend over
+// the series. It returns 0 if the balance isn't going down.
+func (s Series) RunOut() time.Duration {
+	if len(s) < 2 {
+		return 0
+	}
+	first, last := s[0], s[len(s)-1]
+	elapsed := last.Time.Sub(first.Time)
+	drained := first.Value - last.Value
+	if elapsed <= 0 || drained <= 0 {
+		return 0
+	}
+	return time.Duration(last.Value / drained * float64(elapsed))
+}
+
+// InstanceStats is the recent metrics of an instance by metric name.
+type InstanceStats struct {
+	InstanceId string
+	Series     map[string]Series
+}
+
+// MonitorClient reads instance metrics from CloudMonitor.
+type MonitorClient struct {
+	ecs *EcsClient
+	cms *cms.Client
+}
+
+// MonitorClient returns a CloudMonitor client sharing c's credentials and
+// rate limiter.
+func (c *EcsClient) MonitorClient() (*MonitorClient, error) {
+	m, err := cms.NewClientWithAccessKey(string(c.region), c.config.AccessKeyId, c.config.AccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	return &MonitorClient{ecs: c, cms: m}, nil
+}
+
+// Series returns metric for each of instanceIds over the last since, one
+// point per period. Metrics with several values per instance, like the
+// usage of each disk, are reduced to the highest.
+func (c *MonitorClient) Series(ctx context.Context, metric Metric, instanceIds []string, since, period time.Duration) (map[string]Series, error) {
+	dims := []map[string]string{}
+	for _, id := range instanceIds {
+		dims = append(dims, map[string]string{"instanceId": id})
+	}
+	b, _ := json.Marshal(dims)
+	now := time.Now()
+
+	byTime := map[string]map[int64]float64{}
+	next := ""
+	for {
+		req := cms.CreateDescribeMetricListRequest()
+		req.Namespace = metricNamespace
+		req.MetricName = metric.metric
+		req.Dimensions = string(b)
+		req.Period = strconv.Itoa(int(period.Seconds()))
+		req.StartTime = strconv.FormatInt(now.Add(-since).UnixNano()/int64(time.Millisecond), 10)
+		req.EndTime = strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+		req.Length = "1000"
+		req.NextToken = next
+
+		var resp *cms.DescribeMetricListResponse
+		err := c.ecs.api.call(ctx, "DescribeMetricList", func() (err error) {
+			resp, err = c.cms.DescribeMetricList(req)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success {
+			return nil, fmt.Errorf("DescribeMetricList %s: %s: %s", metric.metric, resp.Code, resp.Message)
+		}
+		points := []map[string]interface{}{}
+		if resp.Datapoints != "" {
+			if err := json.Unmarshal([]byte(resp.Datapoints), &points); err != nil {
+				return nil, fmt.Errorf("DescribeMetricList %s: %v", metric.metric, err)
+			}
+		}
+		for _, p := range points {
+			id, _ := p["instanceId"].(string)
+			ts, _ := p["timestamp"].(float64)
+			v, ok := p["Average"].(float64)
+			if !ok {
+				if v, ok = p["Value"].(float64); !ok {
+					v, ok = p["Maximum"].(float64)
+				}
+			}
+			if id == "" || !ok {
+				continue
+			}
+			if byTime[id] == nil {
+				byTime[id] = map[int64]float64{}
+			}
+			if prev, found := byTime[id][int64(ts)]; !found || v > prev {
+				byTime[id][int64(ts)] = v
+			}
+		}
+		if resp.NextToken == "" || resp.NextToken == next {
+			break
+		}
+		next = resp.NextToken
+	}
+
+	all := map[string]Series{}
+	for id, values := range byTime {
+		s := Series{}
+		for ts, v := range values {
+			s = append(s, MetricPoint{Time: time.Unix(0, ts*int64(time.Millisecond)), Value: v})
+		}
+		sort.Slice(s, func(i, j int) bool { return s[i].Time.Before(s[j].Time) })
+		all[id] = s
+	}
+	return all, nil
+}
+
+// Stats returns every instance metric of instanceIds over the last since.
+// Credits are only asked for when burstable is set.
+func (c *MonitorClient) Stats(ctx context.Context, instanceIds []string, since time.Duration, burstable bool) (map[string]*InstanceStats, error) {
+	stats := map[string]*InstanceStats{}
+	for _, id := range instanceIds {
+		stats[id] = &InstanceStats{InstanceId: id, Series: map[string]Series{}}
+	}
+	if len(instanceIds) == 0 {
+		return stats, nil
+	}
+	// a point a minute, but no more than a few hundred of them, in one of
+	// the periods CloudMonitor keeps
+	period := time.Minute
+	for _, p := range []time.Duration{5 * time.Minute, 15 * time.Minute, time.Hour} {
+		if since/period <= 360 {
+			break
+		}
+		period = p
+	}
+	for _, m := range InstanceMetrics {
+		if m == MetricCredits && !burstable {
+			continue
+		}
+		series, err := c.Series(ctx, m, instanceIds, since, period)
+		if err != nil {
+			return nil, err
+		}
+		for id, s := range series {
+			if st := stats[id]; st != nil {
+				st.Series[m.Name] = s
+			}
+		}
+	}
+	return stats, nil
+}
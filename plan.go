@@ -0,0 +1,68 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// PlanStep is a change a dry run would have made. Checked steps were
+// validated by the API's own DryRun, the others only simulated.
+type PlanStep struct {
+	Op      string
+	Target  string
+	Detail  string
+	Checked bool
+}
+
+// Plan collects the changes skipped in dry run mode.
+type Plan struct {
+	mu    sync.Mutex
+	steps []PlanStep
+}
+
+func (p *Plan) Add(s PlanStep) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, s)
+}
+
+func (p *Plan) Steps() []PlanStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PlanStep{}, p.steps...)
+}
+
+// Plan returns the changes skipped so far in dry run mode.
+func (c *EcsClient) Plan() *Plan {
+	return c.plan
+}
+
+func (c *EcsClient) DryRun() bool {
+	return c.dryRun
+}
+
+// mutate runs an API call that changes something. In dry run mode it is
+// only sent if the API supports DryRun (checked), in which case fn must set
+// the request's DryRun flag, and is skipped otherwise. Either way the change
+// is added to the plan and ErrDryRunOperation returned.
+func (c *EcsClient) mutate(ctx context.Context, op string, checked bool, target, detail string, fn func() error) error {
+	if !c.dryRun {
+		return c.api.call(ctx, op, fn)
+	}
+	if checked {
+		// the API answers DryRunOperation if the request would have gone
+		// through, anything else is a real error
+		err := c.api.call(ctx, op, fn)
+		if err == nil {
+			err = fmt.Errorf("%s: dry run request was not rejected", op)
+		}
+		if !errors.Is(err, ErrDryRunOperation) {
+			return err
+		}
+	}
+	c.plan.Add(PlanStep{Op: op, Target: target, Detail: detail, Checked: checked})
+	c.log.With(F("op", op)).Info("dry run: would %s %s", detail, target)
+	return ErrDryRunOperation
+}
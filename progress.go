@@ -0,0 +1,274 @@
+package aliyun
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressRefreshInterval = 200 * time.Millisecond
+
+var (
+	// activeProgress is the progress display currently owning the bottom
+	// of the terminal, if any. Other output clears and redraws around it.
+	activeProgress *Progress
+
+	spinnerFrames = []string{"|", "/", "-", "\\"}
+)
+
+// writeOutput runs fn with exclusive access to the terminal, keeping an
+// active progress display intact.
+func writeOutput(fn func()) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	p := activeProgress
+	if p != nil {
+		p.clear()
+	}
+	fn()
+	if p != nil {
+		p.draw()
+	}
+}
+
+// ProgressEvent is reported by long running operations for a single task,
+// usually one instance or cloud resource.
+type ProgressEvent struct {
+	Task    string
+	State   string
+	Message string
+	Done    bool
+	Err     error
+}
+
+type taskStatus struct {
+	name      string
+	state     string
+	prevState string
+	message   string
+	start     time.Time
+	end       time.Time
+	done      bool
+	err       error
+}
+
+func (t *taskStatus) elapsed() time.Duration {
+	end := t.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(t.start).Truncate(time.Second)
+}
+
+// Progress renders the state of multiple concurrent tasks. On a terminal
+// the tasks are kept in a live block at the bottom of the output, otherwise
+// every state transition is logged as a plain line.
+type Progress struct {
+	w     io.Writer
+	tty   bool
+	log   Logger
+	tasks []*taskStatus
+	index map[string]*taskStatus
+	lines int
+	frame int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewProgress(w io.Writer) *Progress {
+	p := &Progress{
+		w:     w,
+		tty:   IsTerminal(w),
+		log:   DefaultLogger(),
+		index: map[string]*taskStatus{},
+		stop:  make(chan struct{}),
+	}
+
+	if p.tty {
+		outputMu.Lock()
+		activeProgress = p
+		outputMu.Unlock()
+
+		p.wg.Add(1)
+		go p.refresh()
+	}
+	return p
+}
+
+func (p *Progress) refresh() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(progressRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			outputMu.Lock()
+			p.clear()
+			p.frame++
+			p.draw()
+			outputMu.Unlock()
+		}
+	}
+}
+
+// Stop renders the final state of every task and releases the terminal.
+func (p *Progress) Stop() {
+	if !p.tty {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	p.clear()
+	p.draw()
+	// leave the final block in place
+	p.lines = 0
+	if activeProgress == p {
+		activeProgress = nil
+	}
+}
+
+// Report records an event for a task, creating the task on first use.
+func (p *Progress) Report(e ProgressEvent) {
+	if line, changed := p.update(e); changed && !p.tty {
+		if e.Err != nil {
+			p.log.Error("%s", line)
+		} else {
+			p.log.Info("%s", line)
+		}
+	}
+}
+
+func (p *Progress) update(e ProgressEvent) (string, bool) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	t, found := p.index[e.Task]
+	if !found {
+		t = &taskStatus{name: e.Task, start: time.Now()}
+		p.index[e.Task] = t
+		p.tasks = append(p.tasks, t)
+	}
+
+	changed := !found || (e.State != "" && e.State != t.state) || e.Done
+	if e.State != "" && e.State != t.state {
+		t.prevState = t.state
+		t.state = e.State
+	}
+	if e.Message != "" {
+		t.message = e.Message
+	}
+	if e.Done && !t.done {
+		t.done = true
+		t.err = e.Err
+		t.end = time.Now()
+	}
+
+	if p.tty {
+		p.clear()
+		p.draw()
+		return "", changed
+	}
+	return p.plainLine(t), changed
+}
+
+// Task returns a handle reporting events for the named task.
+func (p *Progress) Task(name string) *Task {
+	p.Report(ProgressEvent{Task: name})
+	return &Task{p: p, name: name}
+}
+
+func (p *Progress) plainLine(t *taskStatus) string {
+	var b strings.Builder
+	b.WriteString(t.name)
+	b.WriteString(": ")
+	switch {
+	case t.done && t.err != nil:
+		b.WriteString("failed")
+	case t.done:
+		b.WriteString("done")
+	case t.prevState != "":
+		b.WriteString(t.prevState + " -> " + t.state)
+	case t.state != "":
+		b.WriteString(t.state)
+	default:
+		b.WriteString("pending")
+	}
+	if t.err != nil {
+		b.WriteString(", " + t.err.Error())
+	} else if t.message != "" {
+		b.WriteString(", " + t.message)
+	}
+	b.WriteString(fmt.Sprintf(" (%v)", t.elapsed()))
+	return b.String()
+}
+
+func (p *Progress) taskLine(t *taskStatus) string {
+	var marker string
+	switch {
+	case t.done && t.err != nil:
+		marker = red("x")
+	case t.done:
+		marker = green("+")
+	default:
+		marker = yellow(spinnerFrames[p.frame%len(spinnerFrames)])
+	}
+
+	state := t.state
+	if t.prevState != "" {
+		state = t.prevState + " -> " + t.state
+	}
+	msg := t.message
+	if t.err != nil {
+		msg = red(t.err.Error())
+	}
+	return fmt.Sprintf("[%s] %-24s %-22s %6v  %s", marker, t.name, state, t.elapsed(), msg)
+}
+
+// clear erases the previously drawn block. Must be called with outputMu held.
+func (p *Progress) clear() {
+	for ; p.lines > 0; p.lines-- {
+		fmt.Fprint(p.w, "\033[1A\033[2K\r")
+	}
+}
+
+// draw renders the block of tasks. Must be called with outputMu held.
+func (p *Progress) draw() {
+	for _, t := range p.tasks {
+		fmt.Fprintln(p.w, p.taskLine(t))
+	}
+	p.lines = len(p.tasks)
+}
+
+// Task reports progress for a single tracked task.
+type Task struct {
+	p    *Progress
+	name string
+}
+
+// State records a state transition along with a short description.
+func (t *Task) State(state, format string, a ...interface{}) {
+	t.p.Report(ProgressEvent{Task: t.name, State: state, Message: fmt.Sprintf(format, a...)})
+}
+
+// Message updates the description without changing the state.
+func (t *Task) Message(format string, a ...interface{}) {
+	t.p.Report(ProgressEvent{Task: t.name, Message: fmt.Sprintf(format, a...)})
+}
+
+func (t *Task) Done(format string, a ...interface{}) {
+	t.p.Report(ProgressEvent{Task: t.name, Message: fmt.Sprintf(format, a...), Done: true})
+}
+
+func (t *Task) Fail(err error) {
+	t.p.Report(ProgressEvent{Task: t.name, Done: true, Err: err})
+}
@@ -0,0 +1,322 @@
+package aliyun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	ErrRecipeNotFound     = errors.New("recipe not found")
+	ErrRecipeCycle        = errors.New("recipe dependency cycle")
+	ErrRecipeOS           = errors.New("recipe does not support the image OS")
+	ErrMissingRecipeParam = errors.New("missing required recipe parameter")
+)
+
+type OS string
+
+const (
+	Ubuntu OS = "ubuntu"
+	CentOS OS = "centos"
+)
+
+// ImageOS guesses the distribution from an image ID.
+func ImageOS(image ImageId) OS {
+	switch {
+	case strings.HasPrefix(string(image), "ubuntu"):
+		return Ubuntu
+	case strings.HasPrefix(string(image), "centos"):
+		return CentOS
+	}
+	return ""
+}
+
+type RecipeParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// Download is a file fetched before the recipe script runs. When SHA256 is
+// set the file is verified and the recipe fails on mismatch.
+type Download struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Recipe is a named, parameterized provisioning step. Script and Check are
+// text/templates rendered with the parameters as .Params.
+type Recipe struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Params      []RecipeParam `json:"params,omitempty"`
+	Depends     []string      `json:"depends,omitempty"`
+	// OS lists the supported distributions, any if empty.
+	OS []OS `json:"os,omitempty"`
+	// Check exits 0 when the recipe has already been applied, in which
+	// case the script is skipped.
+	Check     string     `json:"check,omitempty"`
+	Downloads []Download `json:"downloads,omitempty"`
+	Script    string     `json:"script"`
+}
+
+func (r *Recipe) supports(os OS) bool {
+	if len(r.OS) == 0 || os == "" {
+		return true
+	}
+	for _, o := range r.OS {
+		if o == os {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recipe) params(set map[string]string) (map[string]string, error) {
+	p := map[string]string{}
+	for _, rp := range r.Params {
+		v, found := set[rp.Name]
+		if !found {
+			// parameters can be scoped to a recipe as recipe.name=value
+			v, found = set[r.Name+"."+rp.Name]
+		}
+		if !found {
+			v = rp.Default
+		}
+		if v == "" && rp.Required {
+			return nil, fmt.Errorf("%w %s for recipe %s", ErrMissingRecipeParam, rp.Name, r.Name)
+		}
+		p[rp.Name] = v
+	}
+	return p, nil
+}
+
+// shellQuote makes a value safe to embed in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+var recipeFuncs = template.FuncMap{
+	"quote": shellQuote,
+	"atoi":  strconv.Atoi,
+	// object builds a JSON object from key/value pairs for json
+	"object": func(kvs ...interface{}) (map[string]interface{}, error) {
+		if len(kvs)%2 != 0 {
+			return nil, errors.New("object needs key/value pairs")
+		}
+		m := map[string]interface{}{}
+		for i := 0; i < len(kvs); i += 2 {
+			k, ok := kvs[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("object key %v is not a string", kvs[i])
+			}
+			m[k] = kvs[i+1]
+		}
+		return m, nil
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// sha256 lets a Check compare content without embedding it, e.g. a
+	// config holding a password
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+}
+
+func renderRecipeTemplate(name, tmpl string, params map[string]string) (string, error) {
+	t, err := template.New(name).Funcs(recipeFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, map[string]interface{}{"Params": params}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// recipeBanner starts the first line a rendered recipe prints.
+const recipeBanner = "==> recipe "
+
+// Render produces a self contained shell command applying the recipe. It
+// runs in a subshell so a failure or skip doesn't affect other commands.
+func (r *Recipe) Render(os OS, set map[string]string) (string, error) {
+	if !r.supports(os) {
+		return "", fmt.Errorf("%w: %s on %s", ErrRecipeOS, r.Name, os)
+	}
+	params, err := r.params(set)
+	if err != nil {
+		return "", err
+	}
+
+	script, err := renderRecipeTemplate(r.Name, r.Script, params)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "(\nset -e\necho '%s%s'\n", recipeBanner, r.Name)
+	if r.Check != "" {
+		check, err := renderRecipeTemplate(r.Name+" check", r.Check, params)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "if ( %s ) >/dev/null 2>&1; then echo 'recipe %s already applied, skipping'; exit 0; fi\n", strings.TrimSpace(check), r.Name)
+	}
+	for _, d := range r.Downloads {
+		fmt.Fprintf(&b, "mkdir -p %s\n", shellQuote(filepath.Dir(d.Path)))
+		fmt.Fprintf(&b, "curl -fsSL -o %s %s\n", shellQuote(d.Path), shellQuote(d.URL))
+		if d.SHA256 != "" {
+			fmt.Fprintf(&b, "echo %s | sha256sum -c -\n", shellQuote(d.SHA256+"  "+d.Path))
+		}
+	}
+	b.WriteString(script)
+	if !strings.HasSuffix(script, "\n") {
+		b.WriteString("\n")
+	}
+	b.WriteString(")")
+	return b.String(), nil
+}
+
+// RecipeBook is the set of known recipes, the built-in ones plus any
+// loaded from disk.
+type RecipeBook struct {
+	recipes map[string]*Recipe
+}
+
+func NewRecipeBook() *RecipeBook {
+	b := &RecipeBook{recipes: map[string]*Recipe{}}
+	for i := range builtinRecipes {
+		b.Add(&builtinRecipes[i])
+	}
+	return b
+}
+
+// Add registers r, replacing any recipe with the same name.
+func (b *RecipeBook) Add(r *Recipe) {
+	b.recipes[r.Name] = r
+}
+
+// LoadDir adds every *.json recipe in dir. A missing dir is not an error.
+func (b *RecipeBook) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		r := &Recipe{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+		if r.Name == "" {
+			r.Name = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+		b.Add(r)
+	}
+	return nil
+}
+
+func (b *RecipeBook) Get(name string) (*Recipe, error) {
+	r, found := b.recipes[name]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrRecipeNotFound, name)
+	}
+	return r, nil
+}
+
+func (b *RecipeBook) Names() []string {
+	names := []string{}
+	for n := range b.recipes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve returns the named recipes and their dependencies, dependencies
+// first, each recipe once.
+func (b *RecipeBook) Resolve(names []string) ([]*Recipe, error) {
+	var order []*Recipe
+	done := map[string]bool{}
+	visiting := map[string]bool{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("%w at %s", ErrRecipeCycle, name)
+		}
+		r, err := b.Get(name)
+		if err != nil {
+			return err
+		}
+		visiting[name] = true
+		for _, d := range r.Depends {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		done[name] = true
+		order = append(order, r)
+		return nil
+	}
+
+	for _, n := range names {
+		if err := visit(n); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Render resolves the named recipes and renders them into commands.
+func (b *RecipeBook) Render(names []string, os OS, set map[string]string) ([]string, error) {
+	recipes, err := b.Resolve(names)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []string{}
+	for _, r := range recipes {
+		cmd, err := r.Render(os, set)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// LoadRecipeBook returns the built-in recipes plus those in the recipe dir.
+func LoadRecipeBook() (*RecipeBook, error) {
+	b := NewRecipeBook()
+	dir := os.Getenv("ECS_RECIPE_DIR")
+	if dir == "" {
+		dir = filepath.Join(HomeDir(), "recipes")
+	}
+	if err := b.LoadDir(dir); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
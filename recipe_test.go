@@ -0,0 +1,50 @@
+package aliyun
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestShadowsocksConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+	}{
+		{name: "plain", password: "secret"},
+		{name: "quotes", password: `it's "quoted"`},
+		{name: "unicode and backslash", password: `密码\n`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds, err := NewRecipeBook().Render([]string{"shadowsocks"}, Ubuntu, map[string]string{"password": tt.password, "port": "8388"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := cmds[0]
+
+			want, _ := json.Marshal(map[string]interface{}{
+				"server": "0.0.0.0", "server_port": 8388, "password": tt.password, "timeout": 300, "method": "aes-256-cfb",
+			})
+			if !strings.Contains(cmd, "printf '%s' "+shellQuote(string(want))+" > /etc/shadowsocks.json") {
+				t.Errorf("config is not written as %s:\n%s", want, cmd)
+			}
+			sum := sha256.Sum256(want)
+			check := cmd[:strings.Index(cmd, "; then")]
+			if !strings.Contains(check, hex.EncodeToString(sum[:])) {
+				t.Errorf("check does not compare the config hash:\n%s", check)
+			}
+			if strings.Contains(check, tt.password) {
+				t.Errorf("check contains the password:\n%s", check)
+			}
+		})
+	}
+}
+
+func TestShadowsocksBadPort(t *testing.T) {
+	if _, err := NewRecipeBook().Render([]string{"shadowsocks"}, Ubuntu, map[string]string{"password": "x", "port": "http"}); err == nil {
+		t.Error("rendered with a non-numeric port")
+	}
+}
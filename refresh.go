@@ -0,0 +1,259 @@
+package aliyun
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/alidns"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+type DriftKind string
+
+const (
+	// DriftDeleted is a resource in the state that no longer exists.
+	DriftDeleted DriftKind = "deleted"
+	// DriftChanged is a resource whose attributes were changed outside
+	// aliecs.
+	DriftChanged DriftKind = "changed"
+	// DriftUntracked is an instance tagged as managed by aliecs that the
+	// state doesn't know about, e.g. created from another machine.
+	DriftUntracked DriftKind = "untracked"
+)
+
+type Drift struct {
+	Kind     DriftKind
+	Resource *Resource
+	Field    string
+	Old      string
+	New      string
+}
+
+func (d Drift) String() string {
+	if d.Kind == DriftChanged {
+		return fmt.Sprintf("%s %s %s: %s changed from %q to %q", d.Resource.Kind, d.Resource.Id, d.Resource.Name, d.Field, d.Old, d.New)
+	}
+	return fmt.Sprintf("%s %s %s: %s", d.Resource.Kind, d.Resource.Id, d.Resource.Name, d.Kind)
+}
+
+// UseState makes the client record the resources it creates and changes in
+// s.
+func (c *EcsClient) UseState(s *State) {
+	c.state = s
+}
+
+// record applies fn to the state, if any. Failing to save the state
+// doesn't fail the operation that was recorded.
+func (c *EcsClient) record(fn func(s *State)) {
+	if c.state == nil {
+		return
+	}
+	if err := c.state.Update(fn); err != nil {
+		c.log.Warn("error saving state: %v", err)
+	}
+}
+
+// recordEvent adds an event to a known resource and sets attrs on it.
+func (c *EcsClient) recordEvent(kind ResourceKind, id, event string, attrs map[string]string) {
+	c.record(func(s *State) {
+		r := s.Get(kind, id)
+		if r == nil {
+			return
+		}
+		for k, v := range attrs {
+			r.setAttr(k, v)
+		}
+		if event == "deleted" {
+			r.Deleted = true
+		}
+		r.Event(event, "")
+	})
+}
+
+func instanceAttrs(ins *ecs.Instance) map[string]string {
+	return map[string]string{
+		"status":    ins.Status,
+		"name":      ins.InstanceName,
+		"type":      ins.InstanceType,
+		"public-ip": strings.Join(ins.PublicIpAddress.IpAddress, ","),
+	}
+}
+
+// Refresh reconciles the state with what exists in regions and returns the
+// differences found. The state is updated to match.
+func (c *EcsClient) Refresh(ctx context.Context, regions []RegionId) ([]Drift, error) {
+	if c.state == nil {
+		return nil, nil
+	}
+
+	instances := map[string]*ecs.Instance{}
+	vpcs := map[string]*ecs.Vpc{}
+	vSwitches := map[string]*ecs.VSwitch{}
+	disks := map[string]*ecs.Disk{}
+	snapshots := map[string]*ecs.Snapshot{}
+	images := map[string]*ecs.Image{}
+	eips := map[string]*ecs.EipAddress{}
+	observed := map[RegionId]bool{}
+	for _, region := range regions {
+		ins, err := c.DescribeInstances(ctx, region, "")
+		if err != nil {
+			return nil, err
+		}
+		for i := range ins {
+			instances[ins[i].InstanceId] = &ins[i]
+		}
+		vs, err := c.describeVpcs(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for i := range vs {
+			vpcs[vs[i].VpcId] = &vs[i]
+		}
+		sws, err := c.describeVSwitches(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sws {
+			vSwitches[sws[i].VSwitchId] = &sws[i]
+		}
+		ds, err := c.describeDisks(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ds {
+			disks[ds[i].DiskId] = &ds[i]
+		}
+		sns, err := c.describeSnapshots(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sns {
+			snapshots[sns[i].SnapshotId] = &sns[i]
+		}
+		ims, err := c.describeOwnImages(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ims {
+			images[ims[i].ImageId] = &ims[i]
+		}
+		es, err := c.describeEips(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for i := range es {
+			eips[es[i].AllocationId] = &es[i]
+		}
+		observed[region] = true
+	}
+
+	// DNS records aren't regional, they are looked up one by one
+	records := map[string]*alidns.DescribeDomainRecordInfoResponse{}
+	if live := c.state.Live(ResourceDnsRecord); len(live) > 0 {
+		dns, err := c.DnsClient()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range live {
+			if records[r.Id], err = dns.Record(ctx, r.Id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	drifts := []Drift{}
+	err := c.state.Update(func(s *State) {
+		compare := func(r *Resource, attrs map[string]string) {
+			for k, v := range attrs {
+				if old, found := r.Attrs[k]; found && old != v {
+					drifts = append(drifts, Drift{Kind: DriftChanged, Resource: r, Field: k, Old: old, New: v})
+					r.Event("changed", "%s changed from %q to %q", k, old, v)
+				}
+				r.setAttr(k, v)
+			}
+		}
+		gone := func(r *Resource) {
+			drifts = append(drifts, Drift{Kind: DriftDeleted, Resource: r})
+			r.Deleted = true
+			r.Event("deleted", "deleted outside aliecs")
+			if r.Kind == ResourceInstance && r.Name != "" {
+				s.nextGeneration(r.Region, r.Name)
+			}
+		}
+
+		for _, r := range s.Live("") {
+			if r.Kind == ResourceDnsRecord {
+				if rec, checked := records[r.Id]; !checked {
+					continue
+				} else if rec == nil {
+					gone(r)
+				} else {
+					compare(r, map[string]string{"value": rec.Value})
+				}
+				continue
+			}
+			if !observed[r.Region] {
+				continue
+			}
+			switch r.Kind {
+			case ResourceInstance:
+				if ins, found := instances[r.Id]; found {
+					compare(r, instanceAttrs(ins))
+				} else {
+					gone(r)
+				}
+			case ResourceVpc:
+				if v, found := vpcs[r.Id]; found {
+					compare(r, map[string]string{"cidr": v.CidrBlock})
+				} else {
+					gone(r)
+				}
+			case ResourceVSwitch:
+				if sw, found := vSwitches[r.Id]; found {
+					compare(r, map[string]string{"cidr": sw.CidrBlock, "zone": sw.ZoneId, "vpc": sw.VpcId})
+				} else {
+					gone(r)
+				}
+			case ResourceDisk:
+				if d, found := disks[r.Id]; found {
+					compare(r, map[string]string{"instance": d.InstanceId, "size": strconv.Itoa(d.Size)})
+				} else {
+					gone(r)
+				}
+			case ResourceSnapshot:
+				if _, found := snapshots[r.Id]; !found {
+					gone(r)
+				}
+			case ResourceImage:
+				if _, found := images[r.Id]; !found {
+					gone(r)
+				}
+			case ResourceEip:
+				if e, found := eips[r.Id]; found {
+					compare(r, map[string]string{"instance": e.InstanceId})
+				} else {
+					gone(r)
+				}
+			case ResourcePublicIp:
+				ins, found := instances[r.Attrs["instance"]]
+				if !found || !strings.Contains(strings.Join(ins.PublicIpAddress.IpAddress, ","), r.Id) {
+					gone(r)
+				}
+			}
+		}
+
+		for id, ins := range instances {
+			if InstanceTag(ins, TagManaged) != "true" || s.Get(ResourceInstance, id) != nil {
+				continue
+			}
+			r := s.Add(ResourceInstance, id, RegionId(ins.RegionId))
+			r.Name = ins.InstanceName
+			r.Attrs = instanceAttrs(ins)
+			r.Event("adopted", "found by refresh")
+			drifts = append(drifts, Drift{Kind: DriftUntracked, Resource: r})
+		}
+	})
+	return drifts, err
+}
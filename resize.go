@@ -0,0 +1,312 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+var (
+	ErrTypeUnavailable = errors.New("instance type is not available")
+	ErrDiskShrink      = errors.New("disks can only grow")
+	ErrNoSuchDisk      = errors.New("no such disk")
+	ErrNotBurstable    = errors.New("instance type is not burstable")
+)
+
+// ResizeOptions is what to change on an instance, zero values are left
+// alone.
+type ResizeOptions struct {
+	Type         InstanceType
+	BandwidthOut int
+	// Disk is the data disk to grow to DiskSize GB, by name or id, the
+	// system disk if empty.
+	Disk       string
+	DiskSize   int
+	CreditMode CreditMode
+}
+
+// TypeAvailable checks that instances of type t can be had in zone right
+// now, with the same billing as ins.
+func (c *EcsClient) TypeAvailable(ctx context.Context, ins *ecs.Instance, t InstanceType) error {
+	req := ecs.CreateDescribeAvailableResourceRequest()
+	req.RegionId = string(c.region)
+	req.ZoneId = ins.ZoneId
+	req.DestinationResource = "InstanceType"
+	req.ResourceType = "instance"
+	req.IoOptimized = "optimized"
+	req.InstanceChargeType = ins.InstanceChargeType
+	req.SpotStrategy = ins.SpotStrategy
+	req.InstanceType = string(t)
+	var resp *ecs.DescribeAvailableResourceResponse
+	err := c.api.call(ctx, "DescribeAvailableResource", func() (err error) {
+		resp, err = c.ecs.DescribeAvailableResource(req)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	for _, z := range resp.AvailableZones.AvailableZone {
+		if z.ZoneId != ins.ZoneId {
+			continue
+		}
+		for _, r := range z.AvailableResources.AvailableResource {
+			for _, s := range r.SupportedResources.SupportedResource {
+				if s.Value == string(t) && s.Status == "Available" {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s in %s", ErrTypeUnavailable, t, ins.ZoneId)
+}
+
+// typeCatalog caches the instance types offered, which hardly ever change.
+type typeCatalog struct {
+	mu        sync.Mutex
+	burstable map[InstanceType]bool
+}
+
+// Burstable reports whether instances of type t run on CPU credits,
+// according to the instance type catalog.
+func (c *EcsClient) Burstable(ctx context.Context, t InstanceType) (bool, error) {
+	c.types.mu.Lock()
+	defer c.types.mu.Unlock()
+	if c.types.burstable == nil {
+		req := ecs.CreateDescribeInstanceTypesRequest()
+		var resp *ecs.DescribeInstanceTypesResponse
+		err := c.api.call(ctx, "DescribeInstanceTypes", func() (err error) {
+			resp, err = c.ecs.DescribeInstanceTypes(req)
+			return
+		})
+		if err != nil {
+			return false, err
+		}
+		burstable := map[InstanceType]bool{}
+		for _, it := range resp.InstanceTypes.InstanceType {
+			burstable[InstanceType(it.InstanceTypeId)] = it.InstanceFamilyLevel == "CreditEntryLevel" || it.BaselineCredit > 0
+		}
+		c.types.burstable = burstable
+	}
+	return c.types.burstable[t], nil
+}
+
+// ModifyBandwidth changes the outbound bandwidth of a running instance, on
+// its EIP if it has one.
+func (c *EcsClient) ModifyBandwidth(ctx context.Context, ins *ecs.Instance, out int) error {
+	log := c.log.With(F("op", "modify-bandwidth"), F("instance", ins.InstanceId))
+	detail := fmt.Sprintf("change outbound bandwidth to %dMbps of", out)
+	var err error
+	if eip := ins.EipAddress.AllocationId; eip != "" {
+		req := ecs.CreateModifyEipAddressAttributeRequest()
+		req.AllocationId = eip
+		req.Bandwidth = strconv.Itoa(out)
+		log.Debug("changing eip %v bandwidth to %dMbps", eip, out)
+		err = c.mutate(ctx, "ModifyEipAddressAttribute", false, ins.InstanceId, detail, func() error {
+			_, err := c.ecs.ModifyEipAddressAttribute(req)
+			return err
+		})
+		if err == nil {
+			c.recordEvent(ResourceEip, eip, "modified", map[string]string{"bandwidth": req.Bandwidth})
+		}
+	} else {
+		req := ecs.CreateModifyInstanceNetworkSpecRequest()
+		req.InstanceId = ins.InstanceId
+		req.InternetMaxBandwidthOut = requests.NewInteger(out)
+		req.ClientToken = NewClientToken()
+		log.Debug("changing bandwidth to %dMbps", out)
+		err = c.mutate(ctx, "ModifyInstanceNetworkSpec", false, ins.InstanceId, detail, func() error {
+			_, err := c.ecs.ModifyInstanceNetworkSpec(req)
+			return err
+		})
+	}
+	if err == nil {
+		c.recordEvent(ResourceInstance, ins.InstanceId, "modified", map[string]string{"bandwidth-out": strconv.Itoa(out)})
+	}
+	return err
+}
+
+// SetCreditMode switches a burstable instance between Standard and
+// Unlimited, running or not.
+func (c *EcsClient) SetCreditMode(ctx context.Context, ins *ecs.Instance, mode CreditMode) error {
+	burstable, err := c.Burstable(ctx, InstanceType(ins.InstanceType))
+	if err != nil {
+		return err
+	}
+	if !burstable {
+		return fmt.Errorf("%w: %s", ErrNotBurstable, ins.InstanceType)
+	}
+	req := ecs.CreateModifyInstanceAttributeRequest()
+	req.InstanceId = ins.InstanceId
+	req.CreditSpecification = string(mode)
+
+	c.log.With(F("op", "credit-mode"), F("instance", ins.InstanceId)).Debug("changing credit mode to %v", mode)
+	err = c.mutate(ctx, "ModifyInstanceAttribute", false, ins.InstanceId, "change credit mode to "+string(mode)+" of", func() error {
+		_, err := c.ecs.ModifyInstanceAttribute(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, ins.InstanceId, "modified", map[string]string{"credit-mode": string(mode)})
+	}
+	return err
+}
+
+// ResizeDisk grows a disk to size GB while its instance keeps running. The
+// file system on it has to be grown separately, see GrowFsCmd.
+func (c *EcsClient) ResizeDisk(ctx context.Context, disk ecs.Disk, size int) error {
+	if size < disk.Size {
+		return fmt.Errorf("%w: %s is %dGB", ErrDiskShrink, disk.DiskId, disk.Size)
+	}
+	req := ecs.CreateResizeDiskRequest()
+	req.DiskId = disk.DiskId
+	req.NewSize = requests.NewInteger(size)
+	req.Type = "online"
+	req.ClientToken = NewClientToken()
+
+	c.log.With(F("op", "resize-disk"), F("disk", disk.DiskId)).Debug("growing disk from %dGB to %dGB", disk.Size, size)
+	err := c.mutate(ctx, "ResizeDisk", false, disk.DiskId, fmt.Sprintf("grow to %dGB disk", size), func() error {
+		_, err := c.ecs.ResizeDisk(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceDisk, disk.DiskId, "resized", map[string]string{"size": strconv.Itoa(size)})
+	}
+	return err
+}
+
+// Resize applies opts to ins. Everything is checked before anything is
+// changed. Bandwidth, disk and credit mode change online; a type change
+// stops the instance and starts it again if it was running, waiting with w.
+// It returns the disk grown, if any.
+func (c *EcsClient) Resize(ctx context.Context, ins *ecs.Instance, opts ResizeOptions, w Waiter) (*ecs.Disk, error) {
+	if opts.Type == InstanceType(ins.InstanceType) {
+		opts.Type = ""
+	}
+	if opts.BandwidthOut == ins.InternetMaxBandwidthOut {
+		opts.BandwidthOut = 0
+	}
+	if opts.CreditMode == CreditMode(ins.CreditSpecification) {
+		opts.CreditMode = ""
+	}
+	if opts.Type != "" {
+		if err := c.TypeAvailable(ctx, ins, opts.Type); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CreditMode != "" {
+		t := opts.Type
+		if t == "" {
+			t = InstanceType(ins.InstanceType)
+		}
+		burstable, err := c.Burstable(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		if !burstable {
+			return nil, fmt.Errorf("%w: %s", ErrNotBurstable, t)
+		}
+	}
+	var disk *ecs.Disk
+	if opts.DiskSize > 0 {
+		disks, err := c.InstanceDisks(ctx, ins.InstanceId)
+		if err != nil {
+			return nil, err
+		}
+		for i, d := range disks {
+			if opts.Disk == "" && d.Type == "system" ||
+				opts.Disk != "" && (d.DiskId == opts.Disk || d.DiskName == opts.Disk || tagValue(d.Tags.Tag, TagDisk) == opts.Disk) {
+				disk = &disks[i]
+				break
+			}
+		}
+		if disk == nil {
+			return nil, fmt.Errorf("%w: %s on %s", ErrNoSuchDisk, opts.Disk, ins.InstanceName)
+		}
+		if opts.DiskSize < disk.Size {
+			return nil, fmt.Errorf("%w: %s is %dGB", ErrDiskShrink, disk.DiskId, disk.Size)
+		}
+		if opts.DiskSize == disk.Size {
+			disk = nil
+		}
+	}
+
+	// in dry run every step is planned, none is done
+	planned := false
+	step := func(err error) error {
+		if errors.Is(err, ErrDryRunOperation) {
+			planned = true
+			return nil
+		}
+		return err
+	}
+	if opts.BandwidthOut > 0 {
+		if err := step(c.ModifyBandwidth(ctx, ins, opts.BandwidthOut)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CreditMode != "" && opts.Type == "" {
+		if err := step(c.SetCreditMode(ctx, ins, opts.CreditMode)); err != nil {
+			return nil, err
+		}
+	}
+	if disk != nil {
+		if err := step(c.ResizeDisk(ctx, *disk, opts.DiskSize)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Type != "" {
+		running := ins.Status == string(Running)
+		if err := step(c.ensureStatus(ctx, w, ins.InstanceId, Stopped)); err != nil {
+			return disk, err
+		}
+		if err := step(c.ModifyInstanceType(ctx, ins.InstanceId, opts.Type)); err != nil {
+			return disk, err
+		}
+		if opts.CreditMode != "" {
+			// after the type change, which may be what makes it burstable
+			changed := *ins
+			changed.InstanceType = string(opts.Type)
+			if err := step(c.SetCreditMode(ctx, &changed, opts.CreditMode)); err != nil {
+				return disk, err
+			}
+		}
+		if running && !planned {
+			if err := c.ensureStatus(ctx, w, ins.InstanceId, Running); err != nil {
+				return disk, err
+			}
+		}
+	}
+	if planned {
+		return disk, ErrDryRunOperation
+	}
+	return disk, nil
+}
+
+// GrowFsCmd is a provisioning step growing the partition and file system on
+// disk to fill its new size in GB.
+func GrowFsCmd(disk ecs.Disk, size int) string {
+	// the system disk is partitioned, data disks are formatted whole
+	part := `part=$(findmnt -n -o SOURCE /)`
+	if disk.Type != "system" {
+		part = `part=$(lsblk -nrpo NAME,MOUNTPOINT "$dev" | awk '$2 != "" {print $1; exit}')
+[ -n "$part" ] || { echo "$dev is not mounted"; exit 0; }`
+	}
+	return fmt.Sprintf(`# grow file system on %[1]s disk %[2]s
+dev=$(readlink -f /dev/disk/by-id/virtio-%[3]s)
+for i in $(seq 30); do [ "$(blockdev --getsize64 "$dev")" -ge %[4]d ] && break; sleep 2; done
+%[5]s
+if [ "$part" != "$dev" ]; then
+  # NOCHANGE exits 1
+  growpart "$dev" "${part##*[!0-9]}" || true
+fi
+case $(findmnt -n -o FSTYPE "$part" | head -1) in
+xfs) xfs_growfs "$(findmnt -n -o TARGET "$part" | head -1)" ;;
+ext*) resize2fs "$part" ;;
+*) echo "don't know how to grow the file system on $part"; exit 1 ;;
+esac`, disk.Type, disk.DiskId, strings.TrimPrefix(disk.DiskId, "d-"), int64(size)<<30, part)
+}
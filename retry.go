@@ -0,0 +1,233 @@
+package aliyun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how a single API operation is retried.
+type RetryPolicy struct {
+	MaxAttempts int
+	// Budget caps the total time spent on one call including backoff.
+	Budget          time.Duration
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+	// RetryOn lists error classes retried for this operation on top of the
+	// transient ones, e.g. ErrIncorrectStatus while an instance transitions.
+	RetryOn []error
+}
+
+func (p RetryPolicy) retryable(op string, err error) bool {
+	switch {
+	case errors.Is(err, ErrThrottled):
+		return true
+	case IsRetryable(err):
+		// the request may have been applied, it is only sent again if
+		// that changes nothing
+		return replayable(op)
+	}
+	for _, class := range p.RetryOn {
+		if errors.Is(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:     5,
+	Budget:          time.Minute,
+	InitialInterval: time.Second,
+	MaxInterval:     15 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// transitionRetryPolicy is for operations racing an instance state change.
+var transitionRetryPolicy = RetryPolicy{
+	MaxAttempts:     8,
+	Budget:          2 * time.Minute,
+	InitialInterval: 2 * time.Second,
+	MaxInterval:     20 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+	RetryOn:         []error{ErrIncorrectStatus, ErrOperationConflict},
+}
+
+// RetryPolicies overrides DefaultRetryPolicy per API operation.
+var RetryPolicies = map[string]RetryPolicy{
+	"CreateInstance":          transitionRetryPolicy,
+	"StartInstance":           transitionRetryPolicy,
+	"StopInstance":            transitionRetryPolicy,
+	"RebootInstance":          transitionRetryPolicy,
+	"DeleteInstance":          transitionRetryPolicy,
+	"AllocatePublicIpAddress": transitionRetryPolicy,
+	"CreateVSwitch":           transitionRetryPolicy,
+	"DeleteVSwitch":           transitionRetryPolicy,
+	"DeleteVpc":               transitionRetryPolicy,
+}
+
+// clientTokenOps are the mutating operations whose requests carry a
+// ClientToken, which makes the API ignore them the second time.
+var clientTokenOps = map[string]bool{
+	"CreateInstance":            true,
+	"CreateVpc":                 true,
+	"CreateVSwitch":             true,
+	"CreateDisk":                true,
+	"CreateSnapshot":            true,
+	"CreateImage":               true,
+	"AllocateEipAddress":        true,
+	"ModifyInstanceSpec":        true,
+	"ModifyInstanceNetworkSpec": true,
+	"ResizeDisk":                true,
+}
+
+// replayable reports whether op can be sent again after a lost response.
+func replayable(op string) bool {
+	for _, read := range []string{"Describe", "List", "Get", "Query", "Check"} {
+		if strings.HasPrefix(op, read) {
+			return true
+		}
+	}
+	return clientTokenOps[op]
+}
+
+func retryPolicyFor(op string) RetryPolicy {
+	if p, found := RetryPolicies[op]; found {
+		return p
+	}
+	return DefaultRetryPolicy
+}
+
+// RateLimiter is a token bucket limiting requests per second.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+const (
+	defaultRequestRate  = 10
+	defaultRequestBurst = 5
+)
+
+// apiCaller funnels every API request through the client side rate limiter
+// and the per operation retry policy.
+type apiCaller struct {
+	limiter *RateLimiter
+	log     Logger
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*RateLimiter{}
+)
+
+// sharedLimiter returns the limiter of the account accessKeyId, shared by
+// all clients of the process since the API limits requests per account.
+func sharedLimiter(accessKeyId string) *RateLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, found := limiters[accessKeyId]
+	if !found {
+		l = NewRateLimiter(defaultRequestRate, defaultRequestBurst)
+		limiters[accessKeyId] = l
+	}
+	return l
+}
+
+func newApiCaller(accessKeyId string, log Logger) *apiCaller {
+	return &apiCaller{limiter: sharedLimiter(accessKeyId), log: log}
+}
+
+func (a *apiCaller) call(ctx context.Context, op string, fn func() error) error {
+	policy := retryPolicyFor(op)
+	start := time.Now()
+	interval := policy.InitialInterval
+	for attempt := 1; ; attempt++ {
+		if err := a.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		// only calls that can be sent again are abandoned when cancelled
+		err := ClassifyError(op, invoke(ctx, replayable(op), fn))
+		if err == nil || !policy.retryable(op, err) {
+			return err
+		}
+
+		delay := Waiter{Jitter: policy.Jitter}.jitter(interval)
+		if attempt >= policy.MaxAttempts || time.Since(start)+delay > policy.Budget {
+			a.log.Debug("giving up %s after %d attempt(s): %v", op, attempt, err)
+			return err
+		}
+
+		a.log.Debug("retrying %s in %v (attempt %d): %v", op, delay.Truncate(time.Millisecond), attempt, err)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+
+		interval = time.Duration(float64(interval) * policy.Multiplier)
+		if interval > policy.MaxInterval {
+			interval = policy.MaxInterval
+		}
+	}
+}
+
+// NewClientToken returns a random idempotency token. Reusing one token for
+// all retries of a create call guarantees at most one resource is created.
+func NewClientToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,529 @@
+package aliyun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedules bring instances up and down at set times. They are kept in their
+// own file next to the state and applied by `ecs tick`, meant to be run
+// every minute by the system cron, or by a long running `ecs daemon`.
+
+var (
+	ErrBadCron           = errors.New("bad cron expression, expecting minute hour day-of-month month day-of-week")
+	ErrBadScheduleAction = errors.New("bad schedule action, expecting up or down")
+	ErrNoSuchSchedule    = errors.New("no such schedule")
+	ErrBadDate           = errors.New("bad date, expecting YYYY-MM-DD")
+	ErrSchedulesLocked   = errors.New("schedules are being applied by another process")
+)
+
+const dateLayout = "2006-01-02"
+
+// maxCatchUp bounds how far back a tick applies the schedules missed since
+// the last one, e.g. while the machine running it was asleep.
+const maxCatchUp = time.Hour
+
+type ScheduleAction string
+
+const (
+	ScheduleUp   ScheduleAction = "up"
+	ScheduleDown ScheduleAction = "down"
+)
+
+// Cron is a five field cron expression, matched in local time.
+type Cron struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	// with either day field a *, only the other one counts, otherwise a
+	// day matching either does
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@weekdays": "0 0 * * 1-5",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dowNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseCron parses "minute hour day-of-month month day-of-week" with the
+// usual *, lists, ranges, steps and month and weekday names, or one of
+// @hourly, @daily, @weekdays, @weekly and @monthly.
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	fields := strings.Fields(expr)
+	if m, ok := cronMacros[expr]; ok {
+		fields = strings.Fields(m)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: %q", ErrBadCron, expr)
+	}
+	c := &Cron{expr: strings.Join(strings.Fields(expr), " ")}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, dowNames); err != nil {
+		return nil, err
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	c.dowAny = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return c, nil
+}
+
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(s, n) {
+				// month names start at 1, weekday names at 0
+				return i + min, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%w: %q out of %d-%d", ErrBadCron, s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%w: bad step in %q", ErrBadCron, part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 on
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("%w: bad range %q", ErrBadCron, part)
+			}
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	if c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// Match reports whether the minute of t matches.
+func (c *Cron) Match(t time.Time) bool {
+	return c.matchDay(t) && c.hour&(1<<uint(t.Hour())) != 0 && c.minute&(1<<uint(t.Minute())) != 0
+}
+
+// Next returns the first matching minute after t, or the zero time if
+// there is none within five years, e.g. for February 30th.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) != 0 {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// Schedule brings the instances Selector matches up or down whenever Cron
+// matches. Up schedules don't run on holidays, down ones always do.
+type Schedule struct {
+	Id       string         `json:"id"`
+	Selector string         `json:"selector"`
+	Action   ScheduleAction `json:"action"`
+	Cron     string         `json:"cron"`
+	// Skip lists the dates it doesn't run on.
+	Skip []string `json:"skip,omitempty"`
+
+	LastRun    time.Time `json:"last_run,omitempty"`
+	LastResult string    `json:"last_result,omitempty"`
+}
+
+// Skips reports whether the schedule doesn't run on the date of t.
+func (sc *Schedule) Skips(t time.Time) bool {
+	date := t.Format(dateLayout)
+	for _, d := range sc.Skip {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleRun is a schedule due at a given minute.
+type ScheduleRun struct {
+	*Schedule
+	At time.Time
+	// Skipped tells why the run is skipped, if it is.
+	Skipped string
+}
+
+type Schedules struct {
+	Schedules []*Schedule `json:"schedules"`
+	// Holidays are dates on which no instance is brought up.
+	Holidays []string `json:"holidays,omitempty"`
+	// LastTick is the minute schedules were last applied up to.
+	LastTick time.Time `json:"last_tick,omitempty"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// SchedulesPath is the default schedules file.
+func SchedulesPath() string {
+	return filepath.Join(HomeDir(), "schedules.json")
+}
+
+// LoadSchedules reads the schedules file at path. A missing file has no
+// schedules.
+func LoadSchedules(path string) (*Schedules, error) {
+	s := &Schedules{path: path}
+	return s, s.load()
+}
+
+func (s *Schedules) load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *Schedules) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// lockStale is how long a lock file can go untouched before its holder is
+// taken to have died without removing it.
+const lockStale = 5 * time.Minute
+
+// Lock makes sure a single process applies the schedules, so a tick still
+// running a long up doesn't overlap the next one. The lock file is touched
+// every minute until unlock is called.
+func (s *Schedules) Lock() (unlock func(), err error) {
+	path := s.path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	create := func() (*os.File, error) {
+		return os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	}
+	f, err := create()
+	if os.IsExist(err) {
+		if fi, statErr := os.Stat(path); statErr == nil && time.Since(fi.ModTime()) > lockStale {
+			os.Remove(path)
+			f, err = create()
+		}
+	}
+	if os.IsExist(err) {
+		return nil, ErrSchedulesLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(path)
+	}, nil
+}
+
+// Reload reads the schedules again, e.g. to pick up ones added since.
+func (s *Schedules) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fresh := &Schedules{path: s.path}
+	if err := fresh.load(); err != nil {
+		return err
+	}
+	s.Schedules, s.Holidays, s.LastTick = fresh.Schedules, fresh.Holidays, fresh.LastTick
+	return nil
+}
+
+// Update reloads the schedules, applies fn and saves them unless fn fails.
+func (s *Schedules) Update(fn func(s *Schedules) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fresh := &Schedules{path: s.path}
+	if err := fresh.load(); err != nil {
+		return err
+	}
+	s.Schedules, s.Holidays, s.LastTick = fresh.Schedules, fresh.Holidays, fresh.LastTick
+	if err := fn(s); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Get returns the schedule with id, or nil.
+func (s *Schedules) Get(id string) *Schedule {
+	for _, sc := range s.Schedules {
+		if sc.Id == id {
+			return sc
+		}
+	}
+	return nil
+}
+
+// Add adds a schedule and returns it.
+func (s *Schedules) Add(selector string, action ScheduleAction, cron string) (*Schedule, error) {
+	if _, err := ParseSelector(selector); err != nil {
+		return nil, err
+	}
+	if action != ScheduleUp && action != ScheduleDown {
+		return nil, ErrBadScheduleAction
+	}
+	cr, err := ParseCron(cron)
+	if err != nil {
+		return nil, err
+	}
+	sc := &Schedule{Selector: selector, Action: action, Cron: cr.String()}
+	err = s.Update(func(s *Schedules) error {
+		last := 0
+		for _, other := range s.Schedules {
+			if n, err := strconv.Atoi(strings.TrimPrefix(other.Id, "s")); err == nil && n > last {
+				last = n
+			}
+		}
+		sc.Id = "s" + strconv.Itoa(last+1)
+		s.Schedules = append(s.Schedules, sc)
+		return nil
+	})
+	return sc, err
+}
+
+// Remove deletes the schedule with id.
+func (s *Schedules) Remove(id string) error {
+	return s.Update(func(s *Schedules) error {
+		for i, sc := range s.Schedules {
+			if sc.Id == id {
+				s.Schedules = append(s.Schedules[:i], s.Schedules[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrNoSuchSchedule, id)
+	})
+}
+
+// SkipDate makes the schedule with id not run on date.
+func (s *Schedules) SkipDate(id, date string) error {
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return ErrBadDate
+	}
+	return s.Update(func(s *Schedules) error {
+		sc := s.Get(id)
+		if sc == nil {
+			return fmt.Errorf("%w: %s", ErrNoSuchSchedule, id)
+		}
+		sc.Skip = addDate(sc.Skip, date)
+		return nil
+	})
+}
+
+// AddHoliday adds a date on which no instance is brought up.
+func (s *Schedules) AddHoliday(date string) error {
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return ErrBadDate
+	}
+	return s.Update(func(s *Schedules) error {
+		s.Holidays = addDate(s.Holidays, date)
+		return nil
+	})
+}
+
+// RemoveHoliday removes a holiday.
+func (s *Schedules) RemoveHoliday(date string) error {
+	return s.Update(func(s *Schedules) error {
+		for i, d := range s.Holidays {
+			if d == date {
+				s.Holidays = append(s.Holidays[:i], s.Holidays[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not a holiday", ErrBadDate, date)
+	})
+}
+
+func addDate(dates []string, date string) []string {
+	for _, d := range dates {
+		if d == date {
+			return dates
+		}
+	}
+	dates = append(dates, date)
+	sort.Strings(dates)
+	return dates
+}
+
+// Holiday reports whether the date of t is a holiday.
+func (s *Schedules) Holiday(t time.Time) bool {
+	date := t.Format(dateLayout)
+	for _, d := range s.Holidays {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// Due returns the runs of schedules matching a minute after the last tick
+// up to now, in order, each schedule once at its latest minute. Runs on
+// skipped dates or holidays are returned with Skipped set.
+func (s *Schedules) Due(now time.Time) []ScheduleRun {
+	now = now.Truncate(time.Minute)
+	from := s.LastTick
+	if from.IsZero() || now.Sub(from) > maxCatchUp {
+		from = now.Add(-time.Minute)
+	}
+
+	runs := []ScheduleRun{}
+	for _, sc := range s.Schedules {
+		cr, err := ParseCron(sc.Cron)
+		if err != nil {
+			continue
+		}
+		var at time.Time
+		for t := now; t.After(from); t = t.Add(-time.Minute) {
+			if cr.Match(t) {
+				at = t
+				break
+			}
+		}
+		if at.IsZero() {
+			continue
+		}
+		run := ScheduleRun{Schedule: sc, At: at}
+		if sc.Skips(at) {
+			run.Skipped = "skipped on " + at.Format(dateLayout)
+		} else if sc.Action == ScheduleUp && s.Holiday(at) {
+			run.Skipped = "holiday"
+		}
+		runs = append(runs, run)
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].At.Before(runs[j].At)
+	})
+	return runs
+}
+
+// Ticked records that schedules were applied up to now, with the result of
+// each run by schedule id.
+func (s *Schedules) Ticked(now time.Time, results map[string]string) error {
+	return s.Update(func(s *Schedules) error {
+		s.LastTick = now.Truncate(time.Minute)
+		for id, result := range results {
+			if sc := s.Get(id); sc != nil {
+				sc.LastRun, sc.LastResult = now, result
+			}
+		}
+		return nil
+	})
+}
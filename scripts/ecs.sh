@@ -5,14 +5,30 @@ set -e
 SCRIPT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" >/dev/null && pwd )"
 
 OP=${1:-"desc"}
-IDX=${2:-0}
+shift || true
+
+# optional target: an index into the desc table or an instance selector.
+# push and pull name their targets in <selector>:<path> arguments instead,
+# plan, apply, tick and daemon work on the whole fleet, image, snapshot,
+# disk and schedule take subcommands.
+IDX=0
+TARGET_ARG=""
+if [ $OP != "push" ] && [ $OP != "pull" ] && [ $OP != "plan" ] && [ $OP != "apply" ] && [ $OP != "image" ] && [ $OP != "snapshot" ] && [ $OP != "disk" ] && [ $OP != "schedule" ] && [ $# -gt 0 ] && [[ $1 != -* ]]; then
+	if [[ $1 =~ ^[0-9]+$ ]]; then
+		IDX=$1
+		TARGET_ARG="-idx=$IDX"
+	else
+		TARGET_ARG="-sel=$1"
+	fi
+	shift
+fi
 N=$((IDX+1))
 
-if [ $OP = "up" ] || [ $OP = "down" ] || [ $OP = "del" ] || [ $OP = "desc" ] || [ $OP = "run" ] || [ $OP = "reboot" ]; then
-	go run $SCRIPT_DIR/../cmd/ecs.go -op=$OP -idx=$IDX
+if [ $OP = "up" ] || [ $OP = "down" ] || [ $OP = "del" ] || [ $OP = "desc" ] || [ $OP = "run" ] || [ $OP = "reboot" ] || [ $OP = "cloud-init" ] || [ $OP = "recipes" ] || [ $OP = "push" ] || [ $OP = "pull" ] || [ $OP = "exec" ] || [ $OP = "refresh" ] || [ $OP = "gc" ] || [ $OP = "plan" ] || [ $OP = "apply" ] || [ $OP = "spot-prices" ] || [ $OP = "watch" ] || [ $OP = "bake" ] || [ $OP = "image" ] || [ $OP = "snapshot" ] || [ $OP = "disk" ] || [ $OP = "resize" ] || [ $OP = "schedule" ] || [ $OP = "tick" ] || [ $OP = "daemon" ] || [ $OP = "top" ] || [ $OP = "stats" ] || [ $OP = "console" ]; then
+	go run $SCRIPT_DIR/../cmd/ecs.go -op=$OP $TARGET_ARG "$@"
 elif [ $OP = "go" ]; then
 	ip=$(go run $SCRIPT_DIR/../cmd/ecs.go -op=desc | grep -v "\-\-\-\-\-\-\-\-\-\-\-\-\-\-\-\-" | grep -v "Public IP" | head -n $N | tail -n 1 | cut -d"|" -f8 | xargs)
     expect -c 'spawn ssh -o StrictHostKeyChecking=no root@'"$ip"'; expect "assword:"; send "'"$ECS_ROOT_PWD"'\r"; interact'
 else
-	echo -e "supported commands are: up, down, del, reboot, desc\n"
+	echo -e "supported commands are: up, down, del, reboot, desc, run, cloud-init, recipes, push, pull, exec, refresh, gc, plan, apply, spot-prices, watch, bake, image, snapshot, disk, resize, schedule, tick, daemon, top, stats, console\n"
 fi
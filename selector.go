@@ -0,0 +1,132 @@
+package aliyun
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+const (
+	// TagManaged marks every resource created by aliecs.
+	TagManaged = "aliecs"
+	// TagName carries the logical name an instance was created for.
+	TagName = "aliecs:name"
+)
+
+var (
+	ErrBadSelector      = errors.New("bad instance selector")
+	ErrAmbiguousMatch   = errors.New("selector matches more than one instance")
+	ErrNotCreatableName = errors.New("selector is not a plain instance name")
+)
+
+// Selector picks instances by ID ("i-..."), tag ("tag:key=value"), or name,
+// where the name may contain shell glob patterns ("build-*").
+type Selector struct {
+	raw string
+
+	id       string
+	tagKey   string
+	tagValue string
+	name     string
+}
+
+func ParseSelector(s string) (Selector, error) {
+	sel := Selector{raw: s}
+	switch {
+	case s == "":
+		return sel, ErrBadSelector
+	case strings.HasPrefix(s, "i-"):
+		sel.id = s
+	case strings.HasPrefix(s, "tag:"):
+		kv := strings.SplitN(strings.TrimPrefix(s, "tag:"), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return sel, ErrBadSelector
+		}
+		sel.tagKey, sel.tagValue = kv[0], kv[1]
+	default:
+		if _, err := path.Match(s, ""); err != nil {
+			return sel, ErrBadSelector
+		}
+		sel.name = s
+	}
+	return sel, nil
+}
+
+func (s Selector) String() string {
+	return s.raw
+}
+
+// Name returns the instance name for selectors that name exactly one
+// instance, which is what new instances get created as.
+func (s Selector) Name() (string, error) {
+	if s.name == "" || strings.ContainsAny(s.name, "*?[") {
+		return "", ErrNotCreatableName
+	}
+	return s.name, nil
+}
+
+func (s Selector) Match(ins *ecs.Instance) bool {
+	switch {
+	case s.id != "":
+		return ins.InstanceId == s.id
+	case s.tagKey != "":
+		return InstanceTag(ins, s.tagKey) == s.tagValue
+	case s.name != "":
+		if ins.InstanceName == s.name {
+			return true
+		}
+		ok, _ := path.Match(s.name, ins.InstanceName)
+		return ok
+	}
+	return false
+}
+
+// Filter returns the instances matched by the selector.
+func (s Selector) Filter(instances []ecs.Instance) []ecs.Instance {
+	r := []ecs.Instance{}
+	for i := range instances {
+		if s.Match(&instances[i]) {
+			r = append(r, instances[i])
+		}
+	}
+	return r
+}
+
+// One returns the single instance matched by the selector, nil if there is
+// none, or ErrAmbiguousMatch.
+func (s Selector) One(instances []ecs.Instance) (*ecs.Instance, error) {
+	matched := s.Filter(instances)
+	switch len(matched) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &matched[0], nil
+	}
+	ids := []string{}
+	for _, ins := range matched {
+		ids = append(ids, ins.InstanceId)
+	}
+	return nil, fmt.Errorf("%w: %s matches %s", ErrAmbiguousMatch, s.raw, strings.Join(ids, ", "))
+}
+
+func InstanceTag(ins *ecs.Instance, key string) string {
+	for _, t := range ins.Tags.Tag {
+		if t.TagKey == key {
+			return t.TagValue
+		}
+	}
+	return ""
+}
+
+// InstanceClientToken derives a ClientToken from the instance name and its
+// generation, so concurrent `up` runs for the same name, from any terminal,
+// create a single instance, while one created after a del is a new one.
+func InstanceClientToken(region RegionId, name string, generation int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", region, name, generation)))
+	return hex.EncodeToString(sum[:])[:32]
+}
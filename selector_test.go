@@ -0,0 +1,90 @@
+package aliyun
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstanceClientToken(t *testing.T) {
+	base := InstanceClientToken(RegionHk, "dev", 0)
+	if len(base) != 32 {
+		t.Fatalf("token %s is %d characters, want 32", base, len(base))
+	}
+	tests := []struct {
+		name       string
+		region     RegionId
+		instance   string
+		generation int
+		same       bool
+	}{
+		{name: "same instance", region: RegionHk, instance: "dev", generation: 0, same: true},
+		{name: "other region", region: RegionSg, instance: "dev", generation: 0},
+		{name: "other name", region: RegionHk, instance: "dev-2", generation: 0},
+		{name: "next generation", region: RegionHk, instance: "dev", generation: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := InstanceClientToken(tt.region, tt.instance, tt.generation)
+			if (got == base) != tt.same {
+				t.Errorf("token %s against %s, want same %v", got, base, tt.same)
+			}
+		})
+	}
+}
+
+func TestInstanceGoneStartsNewGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aliecs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	client := func(region RegionId) *EcsClient {
+		t.Helper()
+		s, err := LoadState(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &EcsCfg{AccessKeyId: "id", AccessKeySecret: "secret"}
+		config.Derived.Region = region
+		c, err := NewEcsClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.UseState(s)
+		return c
+	}
+	// a and b are two aliecs processes sharing the state file
+	a, b, sg := client(RegionHk), client(RegionHk), client(RegionSg)
+
+	first := a.InstanceClientToken("dev")
+	if got := a.InstanceClientToken("dev"); got != first {
+		t.Errorf("token changed from %s to %s without a delete", first, got)
+	}
+	sgFirst := sg.InstanceClientToken("dev")
+
+	a.InstanceGone("dev")
+	second := b.InstanceClientToken("dev")
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "other process sees the new generation", token: second, want: InstanceClientToken(RegionHk, "dev", 1)},
+		{name: "other names keep theirs", token: b.InstanceClientToken("build"), want: InstanceClientToken(RegionHk, "build", 0)},
+		{name: "other regions keep theirs", token: sg.InstanceClientToken("dev"), want: sgFirst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.token != tt.want {
+				t.Errorf("got %s, want %s", tt.token, tt.want)
+			}
+		})
+	}
+	if second == first {
+		t.Error("token did not change after the instance was deleted")
+	}
+}
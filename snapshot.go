@@ -0,0 +1,296 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+// TagSnapshotSet groups the snapshots of an instance's disks taken
+// together, so they can be restored together.
+const TagSnapshotSet = "aliecs:snapshot-set"
+
+var ErrNoSnapshot = errors.New("no matching snapshot")
+
+// SnapshotSet is the snapshots of all disks of an instance taken at once.
+type SnapshotSet struct {
+	Id string
+	// Name is the instance's name.
+	Name    string
+	Created time.Time
+	System  *ecs.Snapshot
+	Data    []ecs.Snapshot
+}
+
+// Status is accomplished once every snapshot of the set is.
+func (s *SnapshotSet) Status() string {
+	for _, sn := range s.Snapshots() {
+		if sn.Status != "accomplished" {
+			return sn.Status
+		}
+	}
+	return "accomplished"
+}
+
+func (s *SnapshotSet) Snapshots() []ecs.Snapshot {
+	all := []ecs.Snapshot{}
+	if s.System != nil {
+		all = append(all, *s.System)
+	}
+	return append(all, s.Data...)
+}
+
+// Size is the total size of the snapshotted disks in GB.
+func (s *SnapshotSet) Size() int {
+	size := 0
+	for _, sn := range s.Snapshots() {
+		n, _ := strconv.Atoi(sn.SourceDiskSize)
+		size += n
+	}
+	return size
+}
+
+// InstanceDisks returns the disks attached to an instance, the system disk
+// first.
+func (c *EcsClient) InstanceDisks(ctx context.Context, instanceId string) ([]ecs.Disk, error) {
+	req := ecs.CreateDescribeDisksRequest()
+	req.RegionId = string(c.region)
+	req.InstanceId = instanceId
+	req.PageSize = requests.NewInteger(100)
+	var resp *ecs.DescribeDisksResponse
+	err := c.api.call(ctx, "DescribeDisks", func() (err error) {
+		resp, err = c.ecs.DescribeDisks(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	disks := resp.Disks.Disk
+	sort.SliceStable(disks, func(i, j int) bool {
+		return disks[i].Type == "system" && disks[j].Type != "system"
+	})
+	return disks, nil
+}
+
+// CreateSnapshot snapshots a disk of the instance called name as part of
+// set and returns the snapshot id without waiting for it to finish.
+func (c *EcsClient) CreateSnapshot(ctx context.Context, disk ecs.Disk, name, set string) (string, error) {
+	req := ecs.CreateCreateSnapshotRequest()
+	req.DiskId = disk.DiskId
+	req.SnapshotName = fmt.Sprintf("%s-%s-%s", name, disk.Type, set)
+	req.ClientToken = NewClientToken()
+	req.Tag = &[]ecs.CreateSnapshotTag{
+		{Key: TagManaged, Value: "true"},
+		{Key: TagName, Value: name},
+		{Key: TagSnapshotSet, Value: set},
+	}
+
+	c.log.With(F("op", "snapshot"), F("disk", disk.DiskId)).Debug("creating snapshot %v", req.SnapshotName)
+	var resp *ecs.CreateSnapshotResponse
+	err := c.mutate(ctx, "CreateSnapshot", false, disk.DiskId, "snapshot "+disk.Type+" disk", func() (err error) {
+		resp, err = c.ecs.CreateSnapshot(req)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	c.record(func(s *State) {
+		r := s.Add(ResourceSnapshot, resp.SnapshotId, c.region)
+		r.Name = req.SnapshotName
+		r.Params = map[string]string{
+			"disk":          disk.DiskId,
+			"type":          disk.Type,
+			"category":      disk.Category,
+			"size":          strconv.Itoa(disk.Size),
+			"instance":      disk.InstanceId,
+			"instance-name": name,
+			"set":           set,
+		}
+		r.Event("created", "")
+	})
+	return resp.SnapshotId, nil
+}
+
+func (c *EcsClient) describeSnapshotsById(ctx context.Context, ids []string) ([]ecs.Snapshot, error) {
+	req := ecs.CreateDescribeSnapshotsRequest()
+	req.RegionId = string(c.region)
+	req.SnapshotIds = `["` + strings.Join(ids, `","`) + `"]`
+	req.PageSize = requests.NewInteger(100)
+	var resp *ecs.DescribeSnapshotsResponse
+	err := c.api.call(ctx, "DescribeSnapshots", func() (err error) {
+		resp, err = c.ecs.DescribeSnapshots(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Snapshots.Snapshot, nil
+}
+
+func (c *EcsClient) waitSnapshots(ctx context.Context, w Waiter, ids []string) error {
+	return w.WaitFor(ctx, "snapshots "+strings.Join(ids, ", "), func(ctx context.Context) (bool, error) {
+		snapshots, err := c.describeSnapshotsById(ctx, ids)
+		if err != nil {
+			return false, err
+		}
+		done := 0
+		for _, s := range snapshots {
+			switch s.Status {
+			case "accomplished":
+				done++
+			case "failed":
+				return false, fmt.Errorf("snapshot %s failed", s.SnapshotId)
+			default:
+				RecordState(ctx, s.Status+" "+s.Progress)
+			}
+		}
+		return done == len(ids), nil
+	})
+}
+
+// SnapshotInstance snapshots every disk of an instance as one set, waits
+// for the snapshots to finish and returns the set id.
+func (c *EcsClient) SnapshotInstance(ctx context.Context, w Waiter, ins *ecs.Instance) (string, error) {
+	disks, err := c.InstanceDisks(ctx, ins.InstanceId)
+	if err != nil {
+		return "", err
+	}
+	set := time.Now().Format("20060102-150405")
+	ids := []string{}
+	for _, d := range disks {
+		if tagValue(d.Tags.Tag, TagDisk) != "" {
+			// persistent disks outlive the instance, they are attached
+			// again rather than restored
+			continue
+		}
+		id, err := c.CreateSnapshot(ctx, d, ins.InstanceName, set)
+		if errors.Is(err, ErrDryRunOperation) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return set, ErrDryRunOperation
+	}
+	return set, c.waitSnapshots(ctx, w, ids)
+}
+
+// SnapshotSets returns the snapshot sets of the instance called name, or of
+// all instances if name is empty, newest first.
+func (c *EcsClient) SnapshotSets(ctx context.Context, name string) ([]*SnapshotSet, error) {
+	snapshots, err := c.describeSnapshots(ctx, c.region)
+	if err != nil {
+		return nil, err
+	}
+	byId := map[string]*SnapshotSet{}
+	sets := []*SnapshotSet{}
+	for i, sn := range snapshots {
+		id := tagValue(sn.Tags.Tag, TagSnapshotSet)
+		insName := tagValue(sn.Tags.Tag, TagName)
+		if id == "" || (name != "" && insName != name) {
+			continue
+		}
+		key := insName + "/" + id
+		set := byId[key]
+		if set == nil {
+			created, _ := time.ParseInLocation("20060102-150405", id, time.Local)
+			set = &SnapshotSet{Id: id, Name: insName, Created: created}
+			byId[key] = set
+			sets = append(sets, set)
+		}
+		if strings.EqualFold(sn.SourceDiskType, "system") {
+			set.System = &snapshots[i]
+		} else {
+			set.Data = append(set.Data, sn)
+		}
+	}
+	sort.SliceStable(sets, func(i, j int) bool {
+		return sets[i].Created.After(sets[j].Created)
+	})
+	return sets, nil
+}
+
+// FindSnapshotSet returns the set of the instance called name that ref
+// refers to: "latest" for its newest complete set, a set id or the id of
+// one of its snapshots.
+func (c *EcsClient) FindSnapshotSet(ctx context.Context, name, ref string) (*SnapshotSet, error) {
+	sets, err := c.SnapshotSets(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if ref == "latest" {
+			if set.Name == name && set.System != nil && set.Status() == "accomplished" {
+				return set, nil
+			}
+			continue
+		}
+		if set.Id == ref && (name == "" || set.Name == name) {
+			return set, nil
+		}
+		for _, sn := range set.Snapshots() {
+			if sn.SnapshotId == ref {
+				return set, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s of %s", ErrNoSnapshot, ref, name)
+}
+
+// RestoreDisks returns what a new instance needs to be created with the
+// disks of set: an image made from the system snapshot, and data disks
+// made from the others.
+func (c *EcsClient) RestoreDisks(ctx context.Context, set *SnapshotSet) (ImageId, []ecs.CreateInstanceDataDisk, error) {
+	if set.System == nil {
+		return "", nil, fmt.Errorf("%w: set %s has no system disk snapshot", ErrNoSnapshot, set.Id)
+	}
+	if st := set.Status(); st != "accomplished" {
+		return "", nil, fmt.Errorf("snapshot set %s is %s", set.Id, st)
+	}
+	image, err := c.imageFromSnapshot(ctx, set.Name, set.System.SnapshotId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	disks := []ecs.CreateInstanceDataDisk{}
+	for _, sn := range set.Data {
+		category := string(c.config.SystemDiskCategory)
+		if c.state != nil {
+			if r := c.state.Get(ResourceSnapshot, sn.SnapshotId); r != nil && r.Params["category"] != "" {
+				category = r.Params["category"]
+			}
+		}
+		disks = append(disks, ecs.CreateInstanceDataDisk{
+			SnapshotId:         sn.SnapshotId,
+			Size:               sn.SourceDiskSize,
+			Category:           category,
+			DeleteWithInstance: "true",
+		})
+	}
+	return image, disks, nil
+}
+
+// DeleteSnapshot deletes a snapshot. Images made from it must go first.
+func (c *EcsClient) DeleteSnapshot(ctx context.Context, id string) error {
+	req := ecs.CreateDeleteSnapshotRequest()
+	req.SnapshotId = id
+	err := c.mutate(ctx, "DeleteSnapshot", false, id, "delete snapshot", func() error {
+		_, err := c.ecs.DeleteSnapshot(req)
+		return err
+	})
+	if err == nil {
+		c.recordEvent(ResourceSnapshot, id, "deleted", nil)
+	}
+	return err
+}
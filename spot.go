@@ -0,0 +1,273 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+)
+
+var ErrNoSpotPrice = errors.New("no spot price found")
+
+// spotTerminationURL answers 404 on the instance itself until it is about to
+// be reclaimed, then the UTC time it will go away.
+const spotTerminationURL = "http://100.100.100.200/latest/meta-data/instance/spot/termination-time"
+
+// SpotPrice is the latest hourly spot price of an instance type in a zone.
+type SpotPrice struct {
+	Zone         ZoneId
+	InstanceType InstanceType
+	Price        float64
+	OriginPrice  float64
+	Time         time.Time
+}
+
+// SpotPrices returns the latest spot price of t in every zone of the
+// client's region, cheapest first.
+func (c *EcsClient) SpotPrices(ctx context.Context, t InstanceType) ([]SpotPrice, error) {
+	latest := map[ZoneId]SpotPrice{}
+	for offset := 0; ; {
+		req := ecs.CreateDescribeSpotPriceHistoryRequest()
+		req.RegionId = string(c.region)
+		req.InstanceType = string(t)
+		req.NetworkType = "vpc"
+		req.IoOptimized = "optimized"
+		req.StartTime = time.Now().UTC().Add(-3 * time.Hour).Format("2006-01-02T15:04:05Z")
+		req.Offset = requests.NewInteger(offset)
+
+		var resp *ecs.DescribeSpotPriceHistoryResponse
+		err := c.api.call(ctx, "DescribeSpotPriceHistory", func() (err error) {
+			resp, err = c.ecs.DescribeSpotPriceHistory(req)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range resp.SpotPrices.SpotPriceType {
+			ts, _ := time.Parse("2006-01-02T15:04:05Z", p.Timestamp)
+			zone := ZoneId(p.ZoneId)
+			if prev, found := latest[zone]; found && !ts.After(prev.Time) {
+				continue
+			}
+			latest[zone] = SpotPrice{Zone: zone, InstanceType: t, Price: p.SpotPrice, OriginPrice: p.OriginPrice, Time: ts}
+		}
+		if resp.NextOffset == 0 || resp.NextOffset == offset {
+			break
+		}
+		offset = resp.NextOffset
+	}
+
+	prices := []SpotPrice{}
+	for _, p := range latest {
+		prices = append(prices, p)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		if prices[i].Price == prices[j].Price {
+			return prices[i].Zone < prices[j].Zone
+		}
+		return prices[i].Price < prices[j].Price
+	})
+	return prices, nil
+}
+
+// CheapestSpotZone returns the zone of the client's region where a spot
+// instance of type t costs the least right now.
+func (c *EcsClient) CheapestSpotZone(ctx context.Context, t InstanceType) (SpotPrice, error) {
+	prices, err := c.SpotPrices(ctx, t)
+	if err != nil {
+		return SpotPrice{}, err
+	}
+	if len(prices) == 0 {
+		return SpotPrice{}, fmt.Errorf("%w for %s in %s", ErrNoSpotPrice, t, c.region)
+	}
+	return prices[0], nil
+}
+
+// Preempted reports whether a spot instance is being reclaimed.
+func Preempted(ins *ecs.Instance) bool {
+	for _, l := range ins.OperationLocks.LockReason {
+		if l.LockReason == "Recycling" {
+			return true
+		}
+	}
+	return false
+}
+
+// SpotTerminationTime asks the instance metadata service whether the
+// instance is about to be reclaimed. It returns the zero time if not.
+func (s *SSHSession) SpotTerminationTime(ctx context.Context) (time.Time, error) {
+	out, err := s.Output(ctx, "curl -s -f "+spotTerminationURL+" || true")
+	if err != nil {
+		return time.Time{}, err
+	}
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, out)
+}
+
+// SpotNotice tells that a spot instance is being reclaimed.
+type SpotNotice struct {
+	InstanceId string
+	// TerminationTime is when the instance goes away, zero if the notice
+	// came from its status rather than its metadata.
+	TerminationTime time.Time
+	// Source is "metadata", "status" or "gone".
+	Source string
+}
+
+func (n *SpotNotice) String() string {
+	if n.TerminationTime.IsZero() {
+		return fmt.Sprintf("spot instance %s is being reclaimed (%s)", n.InstanceId, n.Source)
+	}
+	return fmt.Sprintf("spot instance %s will be reclaimed at %s (%s)", n.InstanceId, n.TerminationTime.Local().Format("15:04:05"), n.Source)
+}
+
+// WatchSpot polls a spot instance every interval until it is about to be
+// reclaimed, then returns the notice. If sshCfg is not nil the instance
+// metadata is checked over SSH, which gives a couple of minutes' warning;
+// the instance status is polled either way in case SSH is down.
+func (c *EcsClient) WatchSpot(ctx context.Context, instanceId, host string, sshCfg *SSHConfig, interval time.Duration) (*SpotNotice, error) {
+	log := c.log.With(F("op", "watch-spot"), F("instance", instanceId))
+	w := Waiter{InitialInterval: interval, MaxInterval: interval, Multiplier: 1, Jitter: 0.1}
+
+	var sess *SSHSession
+	defer func() {
+		if sess != nil {
+			sess.Close()
+		}
+	}()
+
+	var notice *SpotNotice
+	err := w.WaitFor(ctx, "spot instance "+instanceId, func(ctx context.Context) (bool, error) {
+		if sshCfg != nil && host != "" {
+			if sess == nil {
+				cfg := *sshCfg
+				cfg.Timeout = interval
+				if s, err := NewSSHSession(ctx, host, cfg); err != nil {
+					log.Debug("ssh not available: %v", err)
+				} else {
+					sess = s
+				}
+			}
+			if sess != nil {
+				t, err := sess.SpotTerminationTime(ctx)
+				if err != nil {
+					log.Debug("error reading spot metadata: %v", err)
+					sess.Close()
+					sess = nil
+				} else if !t.IsZero() {
+					notice = &SpotNotice{InstanceId: instanceId, TerminationTime: t, Source: "metadata"}
+					return true, nil
+				}
+			}
+		}
+
+		ins, err := c.DescribeInstance(ctx, instanceId)
+		if err != nil {
+			if IsRetryable(err) {
+				log.Warn("error querying instance: %v", err)
+				return false, nil
+			}
+			return false, err
+		}
+		if ins == nil {
+			notice = &SpotNotice{InstanceId: instanceId, Source: "gone"}
+			return true, nil
+		}
+		RecordState(ctx, ins.Status)
+		if Preempted(ins) {
+			notice = &SpotNotice{InstanceId: instanceId, Source: "status"}
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Warn("%v", notice)
+	c.recordEvent(ResourceInstance, instanceId, "preempted", nil)
+	return notice, nil
+}
+
+// WaitReclaimed waits for a preempted spot instance to be released.
+func (c *EcsClient) WaitReclaimed(ctx context.Context, w Waiter, instanceId string) error {
+	err := w.WaitFor(ctx, "spot instance "+instanceId+" to be reclaimed", func(ctx context.Context) (bool, error) {
+		ins, err := c.DescribeInstance(ctx, instanceId)
+		if err != nil {
+			return false, err
+		}
+		if ins != nil {
+			RecordState(ctx, ins.Status)
+		}
+		return ins == nil, nil
+	})
+	if err == nil {
+		c.recordEvent(ResourceInstance, instanceId, "deleted", nil)
+	}
+	return err
+}
+
+// ReplacementImage returns the image to re-create the instance called name
+// from: the newest image tagged with its name, or else an image made from
+// the newest snapshot of its system disk. It returns "" if there is neither.
+func (c *EcsClient) ReplacementImage(ctx context.Context, name string) (ImageId, error) {
+	req := ecs.CreateDescribeImagesRequest()
+	req.RegionId = string(c.region)
+	req.ImageOwnerAlias = "self"
+	req.Status = "Available"
+	req.PageSize = requests.NewInteger(100)
+	req.Tag = &[]ecs.DescribeImagesTag{{Key: TagName, Value: name}}
+	var resp *ecs.DescribeImagesResponse
+	err := c.api.call(ctx, "DescribeImages", func() (err error) {
+		resp, err = c.ecs.DescribeImages(req)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	images := resp.Images.Image
+	if len(images) > 0 {
+		sort.Slice(images, func(i, j int) bool { return images[i].CreationTime > images[j].CreationTime })
+		return ImageId(images[0].ImageId), nil
+	}
+
+	snapshots, err := c.describeSnapshots(ctx, c.region)
+	if err != nil {
+		return "", err
+	}
+	var latest *ecs.Snapshot
+	for i, s := range snapshots {
+		if tagValue(s.Tags.Tag, TagName) != name || !strings.EqualFold(s.SourceDiskType, "system") || s.Status != "accomplished" {
+			continue
+		}
+		if latest == nil || s.CreationTime > latest.CreationTime {
+			latest = &snapshots[i]
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return c.imageFromSnapshot(ctx, name, latest.SnapshotId)
+}
+
+func (c *EcsClient) imageFromSnapshot(ctx context.Context, name, snapshotId string) (ImageId, error) {
+	if c.state != nil {
+		for _, r := range c.state.Live(ResourceImage) {
+			if r.Region == c.region && r.Params["snapshot"] == snapshotId {
+				return ImageId(r.Id), nil
+			}
+		}
+	}
+	req := ecs.CreateCreateImageRequest()
+	req.SnapshotId = snapshotId
+	params := map[string]string{"snapshot": snapshotId, "instance-name": name}
+	return c.createImage(ctx, DefaultWaiter, req, name, snapshotId, params)
+}
@@ -0,0 +1,206 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshDialTimeout = 5 * time.Second
+
+type SSHConfig struct {
+	User     string
+	Password string
+	// KeyPath is used when Password is empty, ~/.ssh/id_rsa by default.
+	KeyPath string
+	Port    int
+	// Timeout bounds how long connecting is retried, e.g. while a new
+	// instance is booting.
+	Timeout time.Duration
+}
+
+// RootSSHConfig is how aliecs logs into its instances.
+func (c *EcsCfg) RootSSHConfig() SSHConfig {
+	return SSHConfig{User: "root", Password: c.RootPwd, Port: 22, Timeout: 10 * time.Minute}
+}
+
+func (c SSHConfig) clientConfig() (*ssh.ClientConfig, error) {
+	var am ssh.AuthMethod
+	if c.Password != "" {
+		am = ssh.Password(c.Password)
+	} else {
+		path := c.KeyPath
+		if path == "" {
+			path = filepath.Join(os.Getenv("HOME"), ".ssh", "id_rsa")
+		}
+		pk, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		am = ssh.PublicKeys(signer)
+	}
+
+	return &ssh.ClientConfig{
+		User: c.User,
+		Auth: []ssh.AuthMethod{am},
+		// instances are created on demand, their host keys are never known
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback:  func(message string) error { return nil },
+		Timeout:         sshDialTimeout,
+	}, nil
+}
+
+// SSHSession is a connection to an instance on which commands and file
+// transfers run.
+type SSHSession struct {
+	host string
+	c    *ssh.Client
+}
+
+// NewSSHSession connects to host, retrying until cfg.Timeout while the
+// instance isn't accepting connections yet. Authentication failures are
+// not retried.
+func NewSSHSession(ctx context.Context, host string, cfg SSHConfig) (*SSHSession, error) {
+	cc, err := cfg.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	w := DefaultWaiter
+	w.Timeout = cfg.Timeout
+	w.MaxInterval = 5 * time.Second
+
+	var c *ssh.Client
+	var lastErr error
+	err = w.WaitFor(ctx, "ssh on "+addr, func(ctx context.Context) (bool, error) {
+		c, lastErr = ssh.Dial("tcp", addr, cc)
+		if lastErr == nil {
+			return true, nil
+		}
+		if strings.Contains(lastErr.Error(), "unable to authenticate") {
+			return false, lastErr
+		}
+		RecordState(ctx, lastErr.Error())
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SSHSession{host: host, c: c}, nil
+}
+
+// SSHTimedOut reports whether err is NewSSHSession giving up on a host that
+// never answered.
+func SSHTimedOut(err error) bool {
+	var te *TimeoutError
+	return errors.As(err, &te) && strings.HasPrefix(te.Resource, "ssh on ")
+}
+
+func (s *SSHSession) Host() string {
+	return s.host
+}
+
+func (s *SSHSession) Close() error {
+	return s.c.Close()
+}
+
+// Run executes cmd with bash, streaming its output to stdout and stderr.
+// Cancelling ctx closes the remote session.
+func (s *SSHSession) Run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	sess, err := s.c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	sess.Stdin = stdin
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+
+	if err := sess.Start("/bin/bash -c " + shellQuote(cmd)); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		sess.Signal(ssh.SIGKILL)
+		sess.Close()
+		return ctx.Err()
+	}
+}
+
+// Output runs cmd and returns its stdout, failing with stderr included if
+// the command fails.
+func (s *SSHSession) Output(ctx context.Context, cmd string) (string, error) {
+	var out, errOut bytes.Buffer
+	if err := s.Run(ctx, cmd, nil, &out, &errOut); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(errOut.String()))
+	}
+	return out.String(), nil
+}
+
+// LineWriter calls fn for every complete line written to it.
+type LineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	fn  func(line string)
+}
+
+func NewLineWriter(fn func(line string)) *LineWriter {
+	return &LineWriter{fn: fn}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits a trailing partial line, if any.
+func (w *LineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,193 @@
+package aliyun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The state file remembers what aliecs created, with which parameters and
+// what happened to it since, so it doesn't have to be rediscovered from the
+// API and out-of-band changes can be spotted.
+
+type ResourceKind string
+
+const (
+	ResourceInstance  ResourceKind = "instance"
+	ResourceVpc       ResourceKind = "vpc"
+	ResourceVSwitch   ResourceKind = "vswitch"
+	ResourcePublicIp  ResourceKind = "public-ip"
+	ResourceDisk      ResourceKind = "disk"
+	ResourceSnapshot  ResourceKind = "snapshot"
+	ResourceImage     ResourceKind = "image"
+	ResourceEip       ResourceKind = "eip"
+	ResourceDnsRecord ResourceKind = "dns-record"
+)
+
+const stateVersion = 1
+
+type StateEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Resource is a cloud resource created by aliecs. Params are the creation
+// parameters, Attrs what it last looked like.
+type Resource struct {
+	Kind    ResourceKind      `json:"kind"`
+	Id      string            `json:"id"`
+	Region  RegionId          `json:"region,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Profile string            `json:"profile,omitempty"`
+	Params  map[string]string `json:"params,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Created time.Time         `json:"created"`
+	Deleted bool              `json:"deleted,omitempty"`
+	History []StateEvent      `json:"history,omitempty"`
+}
+
+type State struct {
+	Version   int         `json:"version"`
+	Resources []*Resource `json:"resources"`
+	// Generations counts the instances deleted per region/name, see
+	// InstanceClientToken.
+	Generations map[string]int `json:"generations,omitempty"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// StatePath is the default state file.
+func StatePath() string {
+	return filepath.Join(HomeDir(), "state.json")
+}
+
+// LoadState reads the state file at path. A missing file is an empty state.
+func LoadState(path string) (*State, error) {
+	s := &State{Version: stateVersion, path: path}
+	return s, s.load()
+}
+
+func (s *State) load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *State) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	// written aside and renamed so a crash never leaves a truncated file
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Update reloads the state, applies fn and saves it. Reloading first keeps
+// changes made by other aliecs processes in the meantime.
+func (s *State) Update(fn func(s *State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fresh := &State{Version: stateVersion, path: s.path}
+	if err := fresh.load(); err != nil {
+		return err
+	}
+	s.Resources = fresh.Resources
+	s.Generations = fresh.Generations
+	fn(s)
+	return s.save()
+}
+
+// Generation returns the generation of the instance named name in region,
+// as last saved by any aliecs process.
+func (s *State) Generation(region RegionId, name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fresh := &State{path: s.path}
+	if err := fresh.load(); err != nil {
+		return 0, err
+	}
+	return fresh.Generations[generationKey(region, name)], nil
+}
+
+// nextGeneration makes the next instance named name in region a new one.
+func (s *State) nextGeneration(region RegionId, name string) {
+	if s.Generations == nil {
+		s.Generations = map[string]int{}
+	}
+	s.Generations[generationKey(region, name)]++
+}
+
+func generationKey(region RegionId, name string) string {
+	return string(region) + "/" + name
+}
+
+// Get returns the resource, deleted or not, or nil if it isn't known.
+func (s *State) Get(kind ResourceKind, id string) *Resource {
+	for _, r := range s.Resources {
+		if r.Kind == kind && r.Id == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// Live returns the resources of kind, all kinds if empty, not known to be
+// deleted, ordered by creation.
+func (s *State) Live(kind ResourceKind) []*Resource {
+	live := []*Resource{}
+	for _, r := range s.Resources {
+		if !r.Deleted && (kind == "" || r.Kind == kind) {
+			live = append(live, r)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Created.Before(live[j].Created)
+	})
+	return live
+}
+
+// Add records a new resource, or returns the existing one with the same
+// kind and id.
+func (s *State) Add(kind ResourceKind, id string, region RegionId) *Resource {
+	if r := s.Get(kind, id); r != nil {
+		return r
+	}
+	r := &Resource{Kind: kind, Id: id, Region: region, Created: time.Now(), Attrs: map[string]string{}}
+	s.Resources = append(s.Resources, r)
+	return r
+}
+
+func (r *Resource) Event(event, format string, a ...interface{}) {
+	r.History = append(r.History, StateEvent{Time: time.Now(), Event: event, Detail: fmt.Sprintf(format, a...)})
+}
+
+func (r *Resource) setAttr(k, v string) {
+	if r.Attrs == nil {
+		r.Attrs = map[string]string{}
+	}
+	r.Attrs[k] = v
+}
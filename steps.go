@@ -0,0 +1,127 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrStepFailed = errors.New("step failed")
+)
+
+type StepStatus string
+
+const (
+	StepOK      StepStatus = "ok"
+	StepFailed  StepStatus = "failed"
+	StepSkipped StepStatus = "skipped"
+)
+
+// StepError is a step that exited non-zero, or didn't run to completion in
+// which case ExitCode is -1. It matches ErrStepFailed with errors.Is.
+type StepError struct {
+	Step     int
+	Name     string
+	ExitCode int
+	Err      error
+}
+
+func (e *StepError) Error() string {
+	if e.ExitCode < 0 {
+		return fmt.Sprintf("step %d (%s): %v", e.Step+1, e.Name, e.Err)
+	}
+	return fmt.Sprintf("step %d (%s) exited with status %d", e.Step+1, e.Name, e.ExitCode)
+}
+
+func (e *StepError) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+type StepResult struct {
+	Name     string
+	Status   StepStatus
+	ExitCode int
+	Duration time.Duration
+	Err      error
+}
+
+type StepOptions struct {
+	// ContinueOnError runs the remaining steps after one fails. By default
+	// they are skipped, like set -e.
+	ContinueOnError bool
+	// Timeout bounds each step, 0 for no limit.
+	Timeout time.Duration
+	// Output receives the combined output of all steps.
+	Output io.Writer
+}
+
+// StepName names a command for reports: the recipe it was rendered from,
+// or else its first line.
+func StepName(cmd string) string {
+	lines := strings.Split(strings.TrimSpace(cmd), "\n")
+	for _, l := range lines {
+		if strings.HasPrefix(l, "echo '"+recipeBanner) {
+			return strings.TrimSuffix(strings.TrimPrefix(l, "echo '"+recipeBanner), "'")
+		}
+	}
+	name := strings.TrimSpace(lines[0])
+	if len(name) > 40 {
+		name = name[:37] + "..."
+	}
+	return name
+}
+
+// RunSteps runs cmds in order and reports how each one went. The returned
+// error is the first failure, a *StepError unless ctx was cancelled.
+func (s *SSHSession) RunSteps(ctx context.Context, cmds []string, opts StepOptions) ([]StepResult, error) {
+	results := make([]StepResult, len(cmds))
+	var firstErr error
+	for i, cmd := range cmds {
+		r := &results[i]
+		r.Name = StepName(cmd)
+		if ctx.Err() != nil || (firstErr != nil && !opts.ContinueOnError) {
+			r.Status = StepSkipped
+			continue
+		}
+
+		stepCtx := ctx
+		cancel := context.CancelFunc(func() {})
+		if opts.Timeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		start := time.Now()
+		err := s.Run(stepCtx, cmd, nil, opts.Output, opts.Output)
+		cancel()
+		r.Duration = time.Since(start)
+
+		if err == nil {
+			r.Status = StepOK
+			continue
+		}
+		r.Status = StepFailed
+		r.ExitCode = -1
+		if e, ok := err.(*ssh.ExitError); ok {
+			r.ExitCode = e.ExitStatus()
+		} else if err == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %v", opts.Timeout)
+		}
+		r.Err = &StepError{Step: i, Name: r.Name, ExitCode: r.ExitCode, Err: err}
+		if firstErr == nil {
+			firstErr = r.Err
+		}
+		if ctx.Err() != nil {
+			firstErr = ctx.Err()
+		}
+	}
+	return results, firstErr
+}
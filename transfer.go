@@ -0,0 +1,381 @@
+package aliyun
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files are copied over plain SSH commands (cat, tail, sha256sum) so any
+// instance with a shell works, no sftp subsystem required.
+
+const partialSuffix = ".aliecs-part"
+
+var (
+	ErrIsDirectory = errors.New("is a directory, use recursive copy")
+)
+
+type TransferOptions struct {
+	Recursive bool
+	// Resume continues interrupted transfers from the partial file left
+	// behind, after checking its content matches the source.
+	Resume bool
+	// Delta skips files whose content is already identical on the other
+	// side, making repeated syncs of a project directory cheap.
+	Delta bool
+	// Progress is called as bytes are copied.
+	Progress func(file string, done, total int64)
+}
+
+type TransferStats struct {
+	Files   int
+	Skipped int
+	Bytes   int64
+}
+
+type remoteFile struct {
+	rel  string
+	size int64
+	mode os.FileMode
+}
+
+// progressReader reports the running byte count of a transfer, at most a
+// few times a second.
+type progressReader struct {
+	r     io.Reader
+	file  string
+	done  int64
+	total int64
+	last  time.Time
+	fn    func(file string, done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if p.fn != nil && (time.Since(p.last) > 200*time.Millisecond || err == io.EOF) {
+		p.last = time.Now()
+		p.fn(p.file, p.done, p.total)
+	}
+	return n, err
+}
+
+func fileSha256(path string, limit int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *SSHSession) remoteSize(ctx context.Context, p string) (int64, error) {
+	out, err := s.Output(ctx, "stat -c %s "+shellQuote(p)+" 2>/dev/null || echo -1")
+	if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (s *SSHSession) remoteSha256(ctx context.Context, p string, limit int64) (string, error) {
+	cmd := "sha256sum " + shellQuote(p)
+	if limit >= 0 {
+		cmd = fmt.Sprintf("head -c %d %s | sha256sum", limit, shellQuote(p))
+	}
+	out, err := s.Output(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unexpected sha256sum output %q", out)
+	}
+	return fields[0], nil
+}
+
+// remoteHashes lists sha256 sums of all files under dir keyed by relative
+// path.
+func (s *SSHSession) remoteHashes(ctx context.Context, dir string) (map[string]string, error) {
+	out, err := s.Output(ctx, "cd "+shellQuote(dir)+" 2>/dev/null && find . -type f -exec sha256sum {} + || true")
+	if err != nil {
+		return nil, err
+	}
+	hashes := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		hashes[strings.TrimPrefix(fields[1], "./")] = fields[0]
+	}
+	return hashes, nil
+}
+
+// Push copies a local file, or directory with Recursive, to remote.
+func (s *SSHSession) Push(ctx context.Context, local, remote string, opts TransferOptions) (*TransferStats, error) {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	stats := &TransferStats{}
+	if !fi.IsDir() {
+		if strings.HasSuffix(remote, "/") {
+			remote = path.Join(remote, filepath.Base(local))
+		}
+		if opts.Delta {
+			if h, err := s.remoteSha256(ctx, remote, -1); err == nil && sameSha256(local, h) {
+				stats.Skipped++
+				return stats, nil
+			}
+		}
+		return stats, s.pushFile(ctx, local, remote, fi, opts, stats)
+	}
+	if !opts.Recursive {
+		return nil, fmt.Errorf("%s %w", local, ErrIsDirectory)
+	}
+
+	var hashes map[string]string
+	if opts.Delta {
+		if hashes, err = s.remoteHashes(ctx, remote); err != nil {
+			return nil, err
+		}
+	}
+
+	err = filepath.Walk(local, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remote, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			_, err := s.Output(ctx, "mkdir -p "+shellQuote(target))
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		// files missing from hashes aren't on the remote yet
+		if h, found := hashes[filepath.ToSlash(rel)]; found && sameSha256(p, h) {
+			stats.Skipped++
+			return nil
+		}
+		return s.pushFile(ctx, p, target, fi, opts, stats)
+	})
+	return stats, err
+}
+
+// sameSha256 reports whether the local file at p has the sha256 sum h.
+func sameSha256(p, h string) bool {
+	sum, err := fileSha256(p, -1)
+	return err == nil && sum == h
+}
+
+// pushFile copies a single file, its delta check is up to the caller.
+func (s *SSHSession) pushFile(ctx context.Context, local, remote string, fi os.FileInfo, opts TransferOptions, stats *TransferStats) error {
+	part := remote + partialSuffix
+	offset := int64(0)
+	if opts.Resume {
+		size, err := s.remoteSize(ctx, part)
+		if err != nil {
+			return err
+		}
+		if size > 0 && size <= fi.Size() {
+			sumL, errL := fileSha256(local, size)
+			sumR, errR := s.remoteSha256(ctx, part, size)
+			if errL == nil && errR == nil && sumL == sumR {
+				offset = size
+			}
+		}
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	redirect := ">"
+	if offset > 0 {
+		redirect = ">>"
+	}
+	cmd := fmt.Sprintf("mkdir -p %s && cat %s %s", shellQuote(path.Dir(remote)), redirect, shellQuote(part))
+	r := &progressReader{r: f, file: local, done: offset, total: fi.Size(), fn: opts.Progress}
+	if _, err := s.runWithInput(ctx, cmd, r); err != nil {
+		return err
+	}
+
+	cmd = fmt.Sprintf("chmod %o %s && mv -f %s %s", fi.Mode().Perm(), shellQuote(part), shellQuote(part), shellQuote(remote))
+	if _, err := s.Output(ctx, cmd); err != nil {
+		return err
+	}
+	stats.Files++
+	stats.Bytes += fi.Size() - offset
+	return nil
+}
+
+func (s *SSHSession) runWithInput(ctx context.Context, cmd string, in io.Reader) (string, error) {
+	var out, errOut strings.Builder
+	if err := s.Run(ctx, cmd, in, &out, &errOut); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(errOut.String()))
+	}
+	return out.String(), nil
+}
+
+// listRemote returns the regular files under p, or p itself if it is a
+// file, in which case rel is empty.
+func (s *SSHSession) listRemote(ctx context.Context, p string) ([]remoteFile, bool, error) {
+	q := shellQuote(p)
+	cmd := "if [ -d " + q + " ]; then echo dir; find " + q + ` -type f -printf '%P\t%s\t%m\n'; ` +
+		"else echo file; stat --printf '\\t%s\\t%a\\n' " + q + "; fi"
+	out, err := s.Output(ctx, cmd)
+	if err != nil {
+		return nil, false, err
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(out))
+	if !sc.Scan() {
+		return nil, false, fmt.Errorf("unexpected listing of %s", p)
+	}
+	isDir := sc.Text() == "dir"
+
+	files := []remoteFile{}
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		mode, err := strconv.ParseUint(fields[2], 8, 32)
+		if err != nil {
+			return nil, false, err
+		}
+		files = append(files, remoteFile{rel: fields[0], size: size, mode: os.FileMode(mode)})
+	}
+	return files, isDir, nil
+}
+
+// Pull copies a remote file, or directory with Recursive, to local.
+func (s *SSHSession) Pull(ctx context.Context, remote, local string, opts TransferOptions) (*TransferStats, error) {
+	files, isDir, err := s.listRemote(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	if isDir && !opts.Recursive {
+		return nil, fmt.Errorf("%s %w", remote, ErrIsDirectory)
+	}
+
+	stats := &TransferStats{}
+	if !isDir {
+		if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+			local = filepath.Join(local, path.Base(remote))
+		}
+		f := files[0]
+		return stats, s.pullFile(ctx, remote, local, f.size, f.mode, opts, stats)
+	}
+
+	for _, f := range files {
+		target := filepath.Join(local, filepath.FromSlash(f.rel))
+		if err := s.pullFile(ctx, path.Join(remote, f.rel), target, f.size, f.mode, opts, stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *SSHSession) pullFile(ctx context.Context, remote, local string, size int64, mode os.FileMode, opts TransferOptions, stats *TransferStats) error {
+	if opts.Delta {
+		if sum, err := fileSha256(local, -1); err == nil {
+			if h, err := s.remoteSha256(ctx, remote, -1); err == nil && sum == h {
+				stats.Skipped++
+				return nil
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+
+	part := local + partialSuffix
+	offset := int64(0)
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if opts.Resume {
+		if fi, err := os.Stat(part); err == nil && fi.Size() > 0 && fi.Size() <= size {
+			sumL, errL := fileSha256(part, -1)
+			sumR, errR := s.remoteSha256(ctx, remote, fi.Size())
+			if errL == nil && errR == nil && sumL == sumR {
+				offset = fi.Size()
+				flags = os.O_WRONLY | os.O_APPEND
+			}
+		}
+	}
+
+	f, err := os.OpenFile(part, flags, 0600)
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("tail -c +%d %s", offset+1, shellQuote(remote))
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		r := &progressReader{r: pr, file: remote, done: offset, total: size, fn: opts.Progress}
+		_, err := io.Copy(f, r)
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+
+	var errOut strings.Builder
+	runErr := s.Run(ctx, cmd, nil, pw, &errOut)
+	pw.Close()
+	copyErr := <-errCh
+	closeErr := f.Close()
+
+	if runErr != nil {
+		return fmt.Errorf("%v: %s", runErr, strings.TrimSpace(errOut.String()))
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if err := os.Chmod(part, mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(part, local); err != nil {
+		return err
+	}
+	stats.Files++
+	stats.Bytes += size - offset
+	return nil
+}
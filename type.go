@@ -7,6 +7,27 @@ const (
 	PostPaid InstanceChargeType = "PostPaid"
 )
 
+// SpotStrategy selects whether new pay-as-you-go instances are spot
+// instances, which are much cheaper but can be reclaimed at any time.
+type SpotStrategy string
+
+const (
+	NoSpot             SpotStrategy = "NoSpot"
+	SpotWithPriceLimit SpotStrategy = "SpotWithPriceLimit"
+	SpotAsPriceGo      SpotStrategy = "SpotAsPriceGo"
+)
+
+// StoppedMode selects whether a stopped pay-as-you-go instance keeps its
+// compute resources, and keeps paying for them.
+type StoppedMode string
+
+const (
+	KeepCharging StoppedMode = "KeepCharging"
+	// StopCharging releases the vCPUs, memory and public IP, which may not
+	// be available again on the next start.
+	StopCharging StoppedMode = "StopCharging"
+)
+
 type RegionId string
 
 const (
@@ -56,9 +77,20 @@ const (
 	T5c4m8 InstanceType = "ecs.t5-c1m2.xlarge" // 4Core-8GB 0.61 + 0.01/hr
 )
 
+// CreditMode is how a burstable instance behaves once out of CPU credits:
+// Standard ones are throttled to their baseline, Unlimited ones keep going
+// and are charged for the surplus. Empty leaves it to the account default.
+type CreditMode string
+
+const (
+	CreditStandard  CreditMode = "Standard"
+	CreditUnlimited CreditMode = "Unlimited"
+)
+
 type InstanceStatus string
 
 const (
+	Pending  InstanceStatus = "Pending"
 	Running  InstanceStatus = "Running"
 	Starting InstanceStatus = "Starting"
 	Stopping InstanceStatus = "Stopping"
@@ -81,5 +113,74 @@ const (
 type SystemDiskCategory string
 
 const (
-	CloudSsd SystemDiskCategory = "cloud_ssd"
+	CloudEfficiency SystemDiskCategory = "cloud_efficiency"
+	CloudSsd        SystemDiskCategory = "cloud_ssd"
+	CloudEssd       SystemDiskCategory = "cloud_essd"
+)
+
+// PerformanceLevel is the performance tier of a cloud_essd disk.
+type PerformanceLevel string
+
+const (
+	PL0 PerformanceLevel = "PL0"
+	PL1 PerformanceLevel = "PL1"
+	PL2 PerformanceLevel = "PL2"
+	PL3 PerformanceLevel = "PL3"
+)
+
+/*
+ * 1：可注册；
+ * 3：预登记；
+ * 4：可删除预订；
+ * 0：不可注册；
+ * -1：异常；
+ * -2：暂停注册；
+ * -3：黑名单。
+ */
+type DomainStatus int
+
+const (
+	DomainAvailable       DomainStatus = 1
+	DomainPreRegistration DomainStatus = 3
+	DomainPendingDelete   DomainStatus = 4
+	DomainUnavailable     DomainStatus = 0
+	DomainAbnormal        DomainStatus = -1
+	DomainSuspended       DomainStatus = -2
+	DomainBlacklisted     DomainStatus = -3
+)
+
+func (s DomainStatus) String() string {
+	switch s {
+	case DomainAvailable:
+		return "available"
+	case DomainPreRegistration:
+		return "pre-registration"
+	case DomainPendingDelete:
+		return "pending-delete"
+	case DomainUnavailable:
+		return "unavailable"
+	case DomainAbnormal:
+		return "abnormal"
+	case DomainSuspended:
+		return "suspended"
+	case DomainBlacklisted:
+		return "blacklisted"
+	}
+	return "unknown"
+}
+
+type FeeCommand string
+
+const (
+	FeeCreate   FeeCommand = "create"
+	FeeRenew    FeeCommand = "renew"
+	FeeTransfer FeeCommand = "transfer"
+	FeeRestore  FeeCommand = "restore"
+)
+
+type Currency string
+
+const (
+	CNY Currency = "CNY"
+	USD Currency = "USD"
 )
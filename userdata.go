@@ -0,0 +1,193 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type Provisioner string
+
+const (
+	// ProvisionSSH runs InitCmds over SSH once the instance is reachable.
+	ProvisionSSH Provisioner = "ssh"
+	// ProvisionCloudInit passes InitCmds as user data, run by cloud-init on
+	// first boot.
+	ProvisionCloudInit Provisioner = "cloud-init"
+)
+
+// maxUserDataSize is the API limit on base64 encoded user data.
+const maxUserDataSize = 16 * 1024
+
+var (
+	ErrBadUserData      = errors.New("user data must start with #cloud-config or #!")
+	ErrUserDataTooLarge = errors.New("user data exceeds 16KB once encoded")
+)
+
+// defaultUserData wraps InitCmds into a cloud-config document. The commands
+// go into a script rather than runcmd entries so multi-line commands keep
+// working, and their output lands in /var/log/cloud-init-output.log. The
+// script stops at the first failing step so cloud-init reports the failure.
+const defaultUserData = `#cloud-config
+write_files:
+  - path: /var/lib/aliecs/init.sh
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      set -eo pipefail
+{{- range .InitCmds }}
+{{ indent 6 . }}
+{{- end }}
+runcmd:
+  - [bash, /var/lib/aliecs/init.sh]
+`
+
+// UserDataVars is what user data templates are rendered with.
+type UserDataVars struct {
+	Name         string
+	Region       RegionId
+	Zone         ZoneId
+	InstanceType InstanceType
+	InitCmds     []string
+}
+
+var userDataFuncs = template.FuncMap{
+	"indent": func(n int, s string) string {
+		// only padded, the block scalar keeps the lines' own indentation,
+		// which heredocs and Makefiles depend on
+		pad := strings.Repeat(" ", n)
+		lines := strings.Split(strings.Trim(s, "\n"), "\n")
+		for i, l := range lines {
+			if l != "" {
+				lines[i] = pad + l
+			}
+		}
+		return strings.Join(lines, "\n")
+	},
+	"join": strings.Join,
+}
+
+func RenderUserData(tmpl string, vars UserDataVars) (string, error) {
+	t, err := template.New("userdata").Funcs(userDataFuncs).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, vars); err != nil {
+		return "", err
+	}
+
+	s := b.String()
+	if !strings.HasPrefix(s, "#cloud-config") && !strings.HasPrefix(s, "#!") {
+		return "", ErrBadUserData
+	}
+	if base64.StdEncoding.EncodedLen(len(s)) > maxUserDataSize {
+		return "", ErrUserDataTooLarge
+	}
+	return s, nil
+}
+
+// userData returns the rendered user data for an instance, or "" if none is
+// configured.
+func (c *EcsCfg) userData(name string) (string, error) {
+	tmpl := c.UserData
+	if tmpl == "" {
+		if c.Provisioner != ProvisionCloudInit {
+			return "", nil
+		}
+		tmpl = defaultUserData
+	}
+
+	return RenderUserData(tmpl, UserDataVars{
+		Name:         name,
+		Region:       c.Derived.Region,
+		Zone:         c.Zone,
+		InstanceType: c.InstanceType,
+		InitCmds:     c.InitCmds,
+	})
+}
+
+type CloudInitState string
+
+const (
+	CloudInitRunning  CloudInitState = "running"
+	CloudInitDone     CloudInitState = "done"
+	CloudInitError    CloudInitState = "error"
+	CloudInitDisabled CloudInitState = "disabled"
+	CloudInitNotRun   CloudInitState = "not run"
+)
+
+type CloudInitStatus struct {
+	State  CloudInitState
+	Detail string
+	// Log is the tail of /var/log/cloud-init-output.log.
+	Log string
+}
+
+const cloudInitLogMarker = "==== aliecs cloud-init log ===="
+
+// cloudInitStatusScript falls back to the boot-finished marker on images
+// whose cloud-init predates the status subcommand.
+const cloudInitStatusScript = `
+if cloud-init status --help >/dev/null 2>&1; then
+	cloud-init status --long 2>&1
+elif [ -f /var/lib/cloud/instance/boot-finished ]; then
+	echo "status: done"
+else
+	echo "status: running"
+fi
+echo '%s'
+tail -n %d /var/log/cloud-init-output.log 2>/dev/null
+true
+`
+
+// CloudInitStatus fetches cloud-init progress and its output log through
+// Cloud Assistant, so no SSH connection is needed.
+func (c *EcsClient) CloudInitStatus(ctx context.Context, instanceId string, logLines int) (*CloudInitStatus, error) {
+	script := fmt.Sprintf(cloudInitStatusScript, cloudInitLogMarker, logLines)
+	r, err := c.RunShellCommand(ctx, instanceId, script, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return parseCloudInitStatus(r.Output), nil
+}
+
+func parseCloudInitStatus(out string) *CloudInitStatus {
+	s := &CloudInitStatus{State: CloudInitNotRun}
+
+	parts := strings.SplitN(out, cloudInitLogMarker+"\n", 2)
+	if len(parts) == 2 {
+		s.Log = parts[1]
+	}
+
+	inDetail := false
+	for _, line := range strings.Split(parts[0], "\n") {
+		line = strings.TrimSpace(line)
+		if inDetail && line != "" {
+			// older releases put the detail on the following line
+			s.Detail, inDetail = line, false
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "status":
+			s.State = CloudInitState(v)
+		case "detail":
+			s.Detail, inDetail = v, v == ""
+		}
+	}
+	if s.Detail == "" && s.State == CloudInitNotRun {
+		s.Detail = strings.TrimSpace(parts[0])
+	}
+	return s
+}
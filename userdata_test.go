@@ -0,0 +1,67 @@
+package aliyun
+
+import (
+	"strings"
+	"testing"
+)
+
+// initScript returns the init.sh embedded in rendered default user data,
+// with the block scalar's indentation removed.
+func initScript(t *testing.T, userData string) string {
+	t.Helper()
+	start := strings.Index(userData, "content: |\n")
+	end := strings.Index(userData, "runcmd:")
+	if start < 0 || end < 0 {
+		t.Fatalf("unexpected user data:\n%s", userData)
+	}
+	lines := strings.Split(strings.TrimRight(userData[start+len("content: |\n"):end], "\n"), "\n")
+	for i, l := range lines {
+		if l != "" && !strings.HasPrefix(l, "      ") {
+			t.Fatalf("line %q is not indented into the block", l)
+		}
+		lines[i] = strings.TrimPrefix(l, "      ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestDefaultUserDataIndentation(t *testing.T) {
+	tests := []struct {
+		name string
+		cmds []string
+		want string
+	}{
+		{
+			name: "plain",
+			cmds: []string{"apt-get update", "apt-get -y install git"},
+			want: "apt-get update\napt-get -y install git",
+		},
+		{
+			name: "heredoc keeps indentation",
+			cmds: []string{"cat > /etc/app.yaml <<'END'\nserver:\n  port: 80\n  hosts:\n    - a\nEND"},
+			want: "cat > /etc/app.yaml <<'END'\nserver:\n  port: 80\n  hosts:\n    - a\nEND",
+		},
+		{
+			name: "tabs and blank lines",
+			cmds: []string{"cat > Makefile <<'END'\nall:\n\techo hi\n\nEND\n"},
+			want: "cat > Makefile <<'END'\nall:\n\techo hi\n\nEND",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := RenderUserData(defaultUserData, UserDataVars{Name: "dev", InitCmds: tt.cmds})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "#!/bin/bash\nset -eo pipefail\n" + tt.want
+			if got := initScript(t, s); got != want {
+				t.Errorf("init.sh is\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestRenderUserDataRejectsUnknownFormat(t *testing.T) {
+	if _, err := RenderUserData("echo hi", UserDataVars{}); err != ErrBadUserData {
+		t.Errorf("got %v, want ErrBadUserData", err)
+	}
+}
@@ -0,0 +1,148 @@
+package aliyun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Predicate reports whether the awaited condition holds. A non-nil error
+// aborts the wait. Predicates may also drive the resource towards the
+// desired state, e.g. by starting a stopped instance.
+type Predicate func(ctx context.Context) (bool, error)
+
+// Waiter polls a predicate with exponential backoff and jitter until it
+// holds, the deadline passes or the context is cancelled.
+type Waiter struct {
+	Timeout         time.Duration
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter randomizes each interval by up to this fraction, e.g. 0.2 is
+	// +/- 20%.
+	Jitter float64
+}
+
+var DefaultWaiter = Waiter{
+	Timeout:         10 * time.Minute,
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     10 * time.Second,
+	Multiplier:      1.5,
+	Jitter:          0.2,
+}
+
+// TimeoutError is returned when a resource does not reach the awaited
+// state in time.
+type TimeoutError struct {
+	Resource string
+	Timeout  time.Duration
+	// State is the last state observed, if the predicate reported one.
+	State string
+}
+
+func (e *TimeoutError) Error() string {
+	if e.State != "" {
+		return fmt.Sprintf("timed out after %v waiting for %s, last state %s", e.Timeout, e.Resource, e.State)
+	}
+	return fmt.Sprintf("timed out after %v waiting for %s", e.Timeout, e.Resource)
+}
+
+// WaitFor waits on predicate with DefaultWaiter.
+func WaitFor(ctx context.Context, resource string, predicate Predicate) error {
+	return DefaultWaiter.WaitFor(ctx, resource, predicate)
+}
+
+func (w Waiter) WaitFor(ctx context.Context, resource string, predicate Predicate) error {
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	rec := &stateRecorder{}
+	ctx = context.WithValue(ctx, waitStateKey{}, rec)
+
+	interval := w.InitialInterval
+	for {
+		done, err := predicate(ctx)
+		if err != nil {
+			return w.wrap(ctx, rec, resource, err)
+		}
+		if done {
+			return nil
+		}
+
+		timer := time.NewTimer(w.jitter(interval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return w.wrap(ctx, rec, resource, ctx.Err())
+		case <-timer.C:
+		}
+
+		interval = time.Duration(float64(interval) * w.Multiplier)
+		if w.MaxInterval > 0 && interval > w.MaxInterval {
+			interval = w.MaxInterval
+		}
+	}
+}
+
+func (w Waiter) jitter(d time.Duration) time.Duration {
+	if w.Jitter <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * w.Jitter * float64(d)
+	return d + time.Duration(delta)
+}
+
+// wrap turns our own deadline into a TimeoutError while passing through
+// the caller's cancellation and predicate errors untouched.
+func (w Waiter) wrap(ctx context.Context, rec *stateRecorder, resource string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Resource: resource, Timeout: w.Timeout, State: rec.state}
+	}
+	return err
+}
+
+type waitStateKey struct{}
+
+// stateRecorder lets a predicate publish the last observed state, which is
+// reported in TimeoutError.
+type stateRecorder struct {
+	state string
+}
+
+// RecordState notes the current state of the awaited resource from inside
+// a predicate, so a timeout can report where it got stuck.
+func RecordState(ctx context.Context, state string) {
+	if r, ok := ctx.Value(waitStateKey{}).(*stateRecorder); ok {
+		r.state = state
+	}
+}
+
+// invoke runs an API call. With abandon, it returns early with the
+// context's error if it is cancelled before the call completes; otherwise
+// the call is waited for, so a change that goes through anyway is never
+// reported as failed.
+func invoke(ctx context.Context, abandon bool, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !abandon {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
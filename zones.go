@@ -1,19 +1,24 @@
 package aliyun
 
 import (
-	"fmt"
+	"context"
 
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
 )
 
-func (c *EcsClient) DescribeZones(region RegionId, instanceChargeType InstanceChargeType) {
+func (c *EcsClient) DescribeZones(ctx context.Context, region RegionId, instanceChargeType InstanceChargeType) {
 	req := ecs.CreateDescribeZonesRequest()
 	req.RegionId = string(region)
 	req.InstanceChargeType = string(instanceChargeType)
 
-	response, err := c.ecs.DescribeZones(req)
+	var response *ecs.DescribeZonesResponse
+	err := c.api.call(ctx, "DescribeZones", func() (err error) {
+		response, err = c.ecs.DescribeZones(req)
+		return
+	})
 	if err != nil {
-		fmt.Print(err.Error())
+		c.log.Error("error describing zones: %v", err)
+		return
 	}
-	fmt.Printf("response is %#v\n", response)
+	c.log.Debug("response is %#v", response)
 }